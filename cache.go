@@ -0,0 +1,76 @@
+package socks
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/terawatthour/socks/internal/codec"
+	"github.com/terawatthour/socks/internal/helpers"
+	"github.com/terawatthour/socks/runtime"
+	"io"
+	"slices"
+)
+
+// compiledFormatVersion must be bumped on every change to the binary format of compiled templates.
+const compiledFormatVersion = 16
+
+var compiledMagic = []byte("SOCKS\x00")
+
+// SaveCompiled writes all compiled templates to w, so that they can be restored with LoadCompiled
+// without parsing and preprocessing them again. Loops over the static context that pass their variables
+// to components or macros keep the values they iterate over, which must be of basic types, or slices
+// and maps with string keys of them, to be written.
+func (s *Socks) SaveCompiled(w io.Writer) error {
+	if !s.compiled {
+		return fmt.Errorf("templates not compiled")
+	}
+
+	templates := s.fs.allTemplates()
+	names := helpers.Keys(templates)
+	slices.Sort(names)
+
+	cw := codec.NewWriter(w)
+	cw.Raw(compiledMagic)
+	cw.Uint(compiledFormatVersion)
+	cw.Uint(uint64(len(names)))
+	for _, name := range names {
+		cw.String(name)
+		runtime.EncodeStatements(cw, templates[name].Statements())
+	}
+
+	return cw.Flush()
+}
+
+// LoadCompiled replaces all templates with the ones written by SaveCompiled. Caches written
+// with a different format version are refused. Templates restored this way can't be recompiled.
+// The cache is read into memory at once.
+func (s *Socks) LoadCompiled(r io.Reader) error {
+	// lengths are checked against the size of the cache, which has to be known for that
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	cr := codec.NewReader(data)
+	if magic := cr.Raw(len(compiledMagic)); cr.Err() != nil || !bytes.Equal(magic, compiledMagic) {
+		return fmt.Errorf("not a compiled templates cache")
+	}
+
+	if version := cr.Uint(); version != compiledFormatVersion {
+		return fmt.Errorf("compiled templates cache has format version %d, expected %d", version, compiledFormatVersion)
+	}
+
+	templates := make(map[string]*runtime.Evaluator)
+	for i := cr.Length(); i > 0 && cr.Err() == nil; i-- {
+		name := cr.String()
+		templates[name] = s.fs.newEvaluator(runtime.DecodeStatements(cr))
+	}
+
+	if err := cr.Err(); err != nil {
+		return fmt.Errorf("malformed compiled templates cache: %w", err)
+	}
+
+	s.fs.restore(templates)
+	s.compiled = true
+
+	return nil
+}
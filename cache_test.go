@@ -0,0 +1,68 @@
+package socks
+
+import (
+	"bytes"
+	"github.com/terawatthour/socks/internal/codec"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestCompiledCache(t *testing.T) {
+	s := New()
+	s.LoadTemplate("layout.html", io.NopCloser(strings.NewReader(`<v-props><v-prop name="kind" default="plain"/><v-prop name="size" required/></v-props><main :class="kind + size"><v-slot name="content" :size="size"></v-slot></main>`)))
+	s.LoadTemplate("page.html", io.NopCloser(strings.NewReader(`<v-component name="layout.html" :kind="kind" size="-l"><div :slot="content" :let="size">{{ size }}<p :for="item, i in items" :if="i > 0">{{ item.Name + "!" }} {{ 1.5 * 2 }}</p><p :elif="flag">flag</p><p :else>{{ missing() }}</p></div></v-component><v-component :is="'layout.html'" size="-s"><template :slot="content" :let="size">{{ size }}</template></v-component>`)))
+	if err := s.Compile(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var cache bytes.Buffer
+	if err := s.SaveCompiled(&cache); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := New()
+	if err := loaded.LoadCompiled(bytes.NewReader(cache.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+
+	type Item struct{ Name string }
+	for _, ctx := range []map[string]any{
+		{"kind": "wide", "items": []Item{{"a"}, {"b"}}},
+		{"kind": "narrow", "items": []Item{}, "flag": true},
+		{"kind": "narrow", "items": []Item{}},
+	} {
+		expected, expectedErr := s.ExecuteToString("page.html", ctx)
+		res, err := loaded.ExecuteToString("page.html", ctx)
+		if res != expected {
+			t.Errorf("expected `%s`, got `%s`", expected, res)
+		}
+		if (err == nil) != (expectedErr == nil) || err != nil && err.Error() != expectedErr.Error() {
+			t.Errorf("expected error `%v`, got `%v`", expectedErr, err)
+		}
+	}
+
+	outdated := slices.Clone(cache.Bytes())
+	outdated[len(compiledMagic)]++
+	if err := New().LoadCompiled(bytes.NewReader(outdated)); err == nil || !strings.Contains(err.Error(), "format version") {
+		t.Errorf("expected format version error, got %v", err)
+	}
+
+	if err := New().LoadCompiled(bytes.NewReader(cache.Bytes()[:cache.Len()/2])); err == nil {
+		t.Errorf("expected error for truncated cache")
+	}
+	// lengths longer than the rest of the cache are refused before anything is allocated for them
+	var corrupt bytes.Buffer
+	cw := codec.NewWriter(&corrupt)
+	cw.Raw(compiledMagic)
+	cw.Uint(compiledFormatVersion)
+	cw.Uint(1)
+	cw.Uint(1 << 29)
+	if err := cw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := New().LoadCompiled(&corrupt); err == nil || !strings.Contains(err.Error(), "invalid length 536870912") {
+		t.Errorf("expected invalid length error, got %v", err)
+	}
+}
@@ -1,13 +1,31 @@
 package errors
 
 import (
+	stderrors "errors"
 	"fmt"
 	"github.com/terawatthour/socks/internal/helpers"
 )
 
+// ErrLimitExceeded is wrapped by errors of executions exceeding one of their limits.
+var ErrLimitExceeded = stderrors.New("limit exceeded")
+
 type Error struct {
 	Message  string
 	Location helpers.Location
+
+	// Expression is the source of the expression being evaluated when the error occurred, if known.
+	Expression string
+
+	// Template is the executed template and Components the chain of components included from it
+	// down to the file of the error. They're filled in for errors of executions only.
+	Template   string
+	Components []string
+
+	// ContextKeys are the sorted keys of the context the template was executed with.
+	ContextKeys []string
+
+	// Err is the error that caused this one, if any, e.g. context.Canceled.
+	Err error
 }
 
 func New(message string, location helpers.Location) *Error {
@@ -17,9 +35,36 @@ func New(message string, location helpers.Location) *Error {
 	}
 }
 
+// Wrap returns an error located at location, caused by err.
+func Wrap(err error, location helpers.Location) *Error {
+	return &Error{
+		Message:  err.Error(),
+		Location: location,
+		Err:      err,
+	}
+}
+
+// LimitExceeded returns an error located at location, reporting that the limit was exceeded.
+func LimitExceeded(limit string, location helpers.Location) *Error {
+	return &Error{
+		Message:  fmt.Sprintf("limit of %s exceeded", limit),
+		Location: location,
+		Err:      ErrLimitExceeded,
+	}
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
 func (e *Error) Error() string {
+	message := e.Message
+	if e.Expression != "" {
+		message = fmt.Sprintf("%s, in `%s`", message, e.Expression)
+	}
+
 	if e.Location.File == "" {
-		return e.Message
+		return message
 	}
-	return fmt.Sprintf("%s:%d:%d: %s", e.Location.File, e.Location.Line, e.Location.Column, e.Message)
+	return fmt.Sprintf("%s:%d:%d: %s", e.Location.File, e.Location.Line, e.Location.Column, message)
 }
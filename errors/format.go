@@ -0,0 +1,143 @@
+package errors
+
+import (
+	"fmt"
+	"html"
+	"strings"
+)
+
+// Style selects how Format decorates its output.
+type Style int
+
+const (
+	// StylePlain produces plain text.
+	StylePlain Style = iota
+	// StyleANSI colors the output with ANSI escape sequences, for terminals.
+	StyleANSI
+	// StyleHTML produces a <pre> element, e.g. for an error page.
+	StyleHTML
+)
+
+// contextLines is the number of lines shown before and after the line of the error.
+const contextLines = 2
+
+// parts of the report decorated according to the style
+const (
+	partGutter = iota
+	partCode
+	partUnderline
+	partMessage
+	partNote
+)
+
+var ansiColors = map[int]string{
+	partGutter:    "\x1b[34m",
+	partUnderline: "\x1b[1;31m",
+	partMessage:   "\x1b[1m",
+	partNote:      "\x1b[2m",
+}
+
+var htmlClasses = map[int]string{
+	partGutter:    "socks-error-gutter",
+	partCode:      "socks-error-code",
+	partUnderline: "socks-error-underline",
+	partMessage:   "socks-error-message",
+	partNote:      "socks-error-note",
+}
+
+// Format renders the error together with an excerpt of the template it points at, with the
+// erroneous part underlined. sources maps file names to their contents; if the file of the
+// error isn't among them, only the location and the message are printed.
+//
+//	  ┌─ templates/index.html:2:20:
+//	1 | <body>
+//	2 |   <p>{{ user.name + }}</p>
+//	  |                    ^
+//	3 | </body>
+//	unexpected end of expression
+func (e *Error) Format(sources map[string]string, style Style) string {
+	var b strings.Builder
+	write := func(part int, text string) {
+		switch style {
+		case StyleANSI:
+			if color, ok := ansiColors[part]; ok && text != "" {
+				b.WriteString(color + text + "\x1b[0m")
+				return
+			}
+		case StyleHTML:
+			b.WriteString(fmt.Sprintf(`<span class="%s">%s</span>`, htmlClasses[part], html.EscapeString(text)))
+			return
+		}
+		b.WriteString(text)
+	}
+
+	if style == StyleHTML {
+		b.WriteString(`<pre class="socks-error">`)
+	}
+
+	source, ok := sources[e.Location.File]
+	if e.Location.File != "" && ok && e.Location.Line > 0 {
+		lines := strings.Split(source, "\n")
+		first := max(e.Location.Line-contextLines, 1)
+		last := min(e.Location.Line+contextLines, len(lines))
+		width := len(fmt.Sprint(last))
+		gutter := strings.Repeat(" ", width)
+
+		write(partGutter, fmt.Sprintf("%s ┌─ %s:%d:%d:", gutter, e.Location.File, e.Location.Line, e.Location.Column))
+		b.WriteByte('\n')
+		for n := first; n <= last; n++ {
+			line := strings.TrimRight(lines[n-1], "\r")
+			write(partGutter, fmt.Sprintf("%*d | ", width, n))
+			write(partCode, line)
+			b.WriteByte('\n')
+
+			if n == e.Location.Line {
+				write(partGutter, gutter+" | ")
+				write(partUnderline, underline(line, e.Location.Column, e.Location.Length))
+				b.WriteByte('\n')
+			}
+		}
+	} else if e.Location.File != "" {
+		write(partGutter, fmt.Sprintf("┌─ %s:%d:%d:", e.Location.File, e.Location.Line, e.Location.Column))
+		b.WriteByte('\n')
+	}
+
+	write(partMessage, e.Message)
+	if e.Expression != "" {
+		b.WriteByte('\n')
+		write(partNote, fmt.Sprintf("in `%s`", e.Expression))
+	}
+
+	if style == StyleHTML {
+		b.WriteString(`</pre>`)
+	}
+
+	return b.String()
+}
+
+// underline returns the padding up to column, keeping the tabs of line so that it stays aligned,
+// followed by a caret and tildes spanning the rest of length.
+func underline(line string, column, length int) string {
+	var b strings.Builder
+	padding := 0
+	for _, r := range line {
+		if padding >= column-1 {
+			break
+		}
+		if r == '\t' {
+			b.WriteRune('\t')
+		} else {
+			b.WriteRune(' ')
+		}
+		padding++
+	}
+	// the error may point past the end of the line
+	b.WriteString(strings.Repeat(" ", max(column-1-padding, 0)))
+
+	b.WriteByte('^')
+	if length > 1 {
+		b.WriteString(strings.Repeat("~", length-1))
+	}
+
+	return b.String()
+}
@@ -0,0 +1,44 @@
+package errors
+
+import (
+	"github.com/terawatthour/socks/internal/helpers"
+	"strings"
+	"testing"
+)
+
+func TestFormat(t *testing.T) {
+	sources := map[string]string{
+		"index.html": "<html>\n<body>\n\t<p>{{ user.name + }}</p>\n</body>\n</html>\n<!-- end -->",
+	}
+	err := New("unexpected end of expression", helpers.Location{File: "index.html", Line: 3, Column: 20, Length: 1})
+
+	expected := `  ┌─ index.html:3:20:
+1 | <html>
+2 | <body>
+3 | 	<p>{{ user.name + }}</p>
+  | 	                  ^
+4 | </body>
+5 | </html>
+unexpected end of expression`
+	if formatted := err.Format(sources, StylePlain); formatted != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, formatted)
+	}
+
+	err = &Error{Message: "panic: boom", Location: helpers.Location{File: "index.html", Line: 3, Column: 8, Length: 9}, Expression: "user.name"}
+	if formatted := err.Format(sources, StylePlain); !strings.Contains(formatted, "\n  | \t      ^~~~~~~~~\n") || !strings.HasSuffix(formatted, "panic: boom\nin `user.name`") {
+		t.Errorf("expected underline spanning the length and the expression, got\n%s", formatted)
+	}
+
+	if formatted := err.Format(sources, StyleANSI); !strings.Contains(formatted, "\x1b[1;31m\t      ^~~~~~~~~\x1b[0m") {
+		t.Errorf("expected colored underline, got %q", formatted)
+	}
+
+	formatted := err.Format(sources, StyleHTML)
+	if !strings.HasPrefix(formatted, `<pre class="socks-error">`) || !strings.Contains(formatted, `<span class="socks-error-code">	&lt;p&gt;{{ user.name + }}&lt;/p&gt;</span>`) {
+		t.Errorf("expected escaped html, got %s", formatted)
+	}
+
+	if formatted := err.Format(nil, StylePlain); formatted != "┌─ index.html:3:8:\npanic: boom\nin `user.name`" {
+		t.Errorf("expected report without excerpt, got\n%s", formatted)
+	}
+}
@@ -258,6 +258,51 @@ func (s *Array) String() string {
 	return fmt.Sprintf("[array: %s]", items)
 }
 
+type Map struct {
+	Keys   []string
+	Values []Expression
+	Token  Token
+}
+
+func (s *Map) Location() helpers.Location {
+	return s.Token.Location
+}
+
+func (s *Map) IsEqual(node Node) bool {
+	if node, ok := node.(*Map); ok {
+		if len(s.Keys) != len(node.Keys) {
+			return false
+		}
+		for i, key := range s.Keys {
+			if key != node.Keys[i] || !s.Values[i].IsEqual(node.Values[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+func (s *Map) Kind() string {
+	return "map"
+}
+
+func (s *Map) Literal() string {
+	entries := []string{}
+	for i, key := range s.Keys {
+		entries = append(entries, fmt.Sprintf("%q: %s", key, s.Values[i].Literal()))
+	}
+	return fmt.Sprintf("{%s}", strings.Join(entries, ", "))
+}
+
+func (s *Map) String() string {
+	entries := ""
+	for i, key := range s.Keys {
+		entries += fmt.Sprintf("%q: %s, ", key, s.Values[i].String())
+	}
+	return fmt.Sprintf("[map: %s]", entries)
+}
+
 type PrefixExpression struct {
 	Token  Token
 	Op     TokenKind
@@ -1,7 +1,10 @@
 package expression
 
 import (
+	"context"
 	"fmt"
+	"github.com/terawatthour/socks/errors"
+	"github.com/terawatthour/socks/internal/helpers"
 	"reflect"
 )
 
@@ -22,6 +25,37 @@ var builtinsOne = map[string]any{
 	"length":  length,
 	"range":   _range,
 	"raw":     raw,
+
+	"upper":     upper,
+	"lower":     lower,
+	"title":     title,
+	"trim":      trim,
+	"split":     split,
+	"join":      join,
+	"replace":   replace,
+	"contains":  contains,
+	"hasPrefix": hasPrefix,
+	"truncate":  truncate,
+
+	"keys":    keys,
+	"values":  values,
+	"sort":    _sort,
+	"reverse": reverse,
+	"first":   first,
+	"last":    last,
+	"slice":   slice,
+	"uniq":    uniq,
+
+	"min":   _min,
+	"max":   _max,
+	"abs":   abs,
+	"round": round,
+	"floor": floor,
+	"ceil":  ceil,
+
+	"format":       format,
+	"formatNumber": formatNumber,
+	"formatDate":   formatDate,
 }
 
 var builtinNames = reflect.ValueOf(builtinsOne).MapKeys()
@@ -50,7 +84,28 @@ func raw(_val any) Raw {
 	return Raw{_val}
 }
 
-func _range(_start, _end, _step any) any {
+// callSettings are the settings of the frame that builtins follow, passed to them in the context.
+type callSettings struct {
+	lengthLimit  int
+	sandbox      *Sandbox
+	taggedFields bool
+}
+
+type callSettingsKey struct{}
+
+// settingsOf returns the settings of the frame calling a builtin with ctx.
+func settingsOf(ctx context.Context) callSettings {
+	settings, _ := ctx.Value(callSettingsKey{}).(callSettings)
+	return settings
+}
+
+// printable returns an error if the sandbox of the calling frame forbids printing value.
+func printable(ctx context.Context, value any) error {
+	settings := settingsOf(ctx)
+	return settings.sandbox.Printable(value, settings.taggedFields)
+}
+
+func _range(ctx context.Context, _start, _end, _step any) any {
 	start, startOk := castInt(_start).(int)
 	end, endOk := castInt(_end).(int)
 	step, stepOk := castInt(_step).(int)
@@ -67,9 +122,21 @@ func _range(_start, _end, _step any) any {
 	if start > end && step > 0 {
 		return fmt.Errorf("step cannot be positive while start > end")
 	}
-	var result []int
-	for i := start; i < end; i += step {
-		result = append(result, i)
+
+	var length int
+	if step > 0 {
+		length = (end - start + step - 1) / step
+	} else {
+		length = (start - end - step - 1) / -step
+	}
+	// the length is checked before the list is allocated, as it could take all the memory
+	if limit := settingsOf(ctx).lengthLimit; limit > 0 && length > limit {
+		return errors.LimitExceeded(fmt.Sprintf("%d loop iterations", limit), helpers.Location{})
+	}
+
+	result := make([]int, length)
+	for i := range result {
+		result[i] = start + i*step
 	}
 	return result
 }
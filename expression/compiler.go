@@ -2,6 +2,7 @@ package expression
 
 import (
 	"github.com/terawatthour/socks/errors"
+	"github.com/terawatthour/socks/internal/helpers"
 	"slices"
 )
 
@@ -9,6 +10,10 @@ type Program struct {
 	Instructions []int
 	Constants    []any
 	Lookups      []Expression
+
+	// Source is the expression the program was compiled from, Location - where it starts.
+	Source   string
+	Location helpers.Location
 }
 
 type Compiler struct {
@@ -45,6 +50,16 @@ func (c *Compiler) compile(expr Expression) error {
 		c.emit(OpArray)
 		c.addLookup(expr)
 		c.emit(len(expr.Items))
+	case *Map:
+		for i, key := range expr.Keys {
+			c.emitConstant(key)
+			if err := c.compile(expr.Values[i]); err != nil {
+				return err
+			}
+		}
+		c.emit(OpMap)
+		c.addLookup(expr)
+		c.emit(len(expr.Keys))
 	case *Boolean:
 		c.emitConstant(expr.Value)
 		c.addLookup(expr)
@@ -95,7 +110,12 @@ func (c *Compiler) compile(expr Expression) error {
 				c.addLookup(part)
 				c.emit(len(part.Args))
 			case *Identifier:
-				if i == 0 {
+				if i == 0 && len(expr.Parts) > 1 && isCall(expr.Parts[1]) {
+					// builtins are only resolved when called, so that they don't shadow missing variables
+					c.emit(OpGetFunction)
+					c.addLookup(part)
+					c.emit(c.createConstant(part.Value))
+				} else if i == 0 {
 					if err := c.compile(part); err != nil {
 						return err
 					}
@@ -201,6 +221,11 @@ func (c *Compiler) compile(expr Expression) error {
 	return nil
 }
 
+func isCall(expr Expression) bool {
+	_, ok := expr.(*FunctionCall)
+	return ok
+}
+
 func (c *Compiler) emit(op int) {
 	c.chunk.Instructions = append(c.chunk.Instructions, op)
 }
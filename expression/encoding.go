@@ -0,0 +1,275 @@
+package expression
+
+import (
+	"fmt"
+	"github.com/terawatthour/socks/internal/codec"
+)
+
+// node tags of the binary format, 0 stands for a nil expression
+const (
+	tagNil byte = iota
+	tagDotAccess
+	tagOptionalAccess
+	tagIdentifier
+	tagNilLiteral
+	tagBoolean
+	tagInteger
+	tagFloat
+	tagArray
+	tagPrefix
+	tagInfix
+	tagString
+	tagFunctionCall
+	tagFieldAccess
+	tagChain
+	tagTernary
+	tagMap
+)
+
+// constant tags of the binary format
+const (
+	constString byte = iota
+	constInt
+	constFloat
+	constBool
+)
+
+// EncodeVM writes the program of vm, including the expressions kept for error locations.
+func EncodeVM(w *codec.Writer, vm *VM) {
+	w.Bool(vm != nil)
+	if vm == nil {
+		return
+	}
+
+	program := vm.program
+
+	w.String(program.Source)
+	w.Location(program.Location)
+
+	w.Uint(uint64(len(program.Instructions)))
+	for _, instruction := range program.Instructions {
+		w.Int(instruction)
+	}
+
+	w.Uint(uint64(len(program.Constants)))
+	for _, constant := range program.Constants {
+		switch constant := constant.(type) {
+		case string:
+			w.Byte(constString)
+			w.String(constant)
+		case int:
+			w.Byte(constInt)
+			w.Int(constant)
+		case float64:
+			w.Byte(constFloat)
+			w.Float(constant)
+		case bool:
+			w.Byte(constBool)
+			w.Bool(constant)
+		default:
+			w.Fail(fmt.Errorf("can't encode constant of type %T", constant))
+		}
+	}
+
+	w.Uint(uint64(len(program.Lookups)))
+	for _, lookup := range program.Lookups {
+		EncodeExpression(w, lookup)
+	}
+}
+
+// DecodeVM reads a program written by EncodeVM.
+func DecodeVM(r *codec.Reader) *VM {
+	if !r.Bool() {
+		return nil
+	}
+
+	program := Program{
+		Source:   r.String(),
+		Location: r.Location(),
+	}
+
+	program.Instructions = make([]int, r.Length())
+	for i := range program.Instructions {
+		program.Instructions[i] = r.Int()
+	}
+
+	program.Constants = make([]any, r.Length())
+	for i := range program.Constants {
+		switch tag := r.Byte(); tag {
+		case constString:
+			program.Constants[i] = r.String()
+		case constInt:
+			program.Constants[i] = r.Int()
+		case constFloat:
+			program.Constants[i] = r.Float()
+		case constBool:
+			program.Constants[i] = r.Bool()
+		default:
+			r.Fail(fmt.Errorf("unknown constant tag %d", tag))
+		}
+	}
+
+	program.Lookups = make([]Expression, r.Length())
+	for i := range program.Lookups {
+		program.Lookups[i] = DecodeExpression(r)
+	}
+
+	return NewVM(program)
+}
+
+func encodeToken(w *codec.Writer, token Token) {
+	w.Int(int(token.Kind))
+	w.String(token.Literal)
+	w.Int(token.Start)
+	w.Int(token.Length)
+	w.Location(token.Location)
+}
+
+func decodeToken(r *codec.Reader) Token {
+	return Token{
+		Kind:     TokenKind(r.Int()),
+		Literal:  r.String(),
+		Start:    r.Int(),
+		Length:   r.Int(),
+		Location: r.Location(),
+	}
+}
+
+func encodeExpressions(w *codec.Writer, exprs []Expression) {
+	w.Uint(uint64(len(exprs)))
+	for _, expr := range exprs {
+		EncodeExpression(w, expr)
+	}
+}
+
+func decodeExpressions(r *codec.Reader) []Expression {
+	exprs := make([]Expression, r.Length())
+	for i := range exprs {
+		exprs[i] = DecodeExpression(r)
+	}
+	return exprs
+}
+
+// EncodeExpression writes the expression tree, expr may be nil.
+func EncodeExpression(w *codec.Writer, expr Expression) {
+	switch expr := expr.(type) {
+	case nil:
+		w.Byte(tagNil)
+	case *DotAccess:
+		w.Byte(tagDotAccess)
+		encodeToken(w, expr.Token)
+		w.String(expr.Property)
+	case *OptionalAccess:
+		w.Byte(tagOptionalAccess)
+		encodeToken(w, expr.Token)
+	case *Identifier:
+		w.Byte(tagIdentifier)
+		encodeToken(w, expr.Token)
+		w.String(expr.Value)
+	case *Nil:
+		w.Byte(tagNilLiteral)
+		encodeToken(w, expr.Token)
+	case *Boolean:
+		w.Byte(tagBoolean)
+		encodeToken(w, expr.Token)
+		w.Bool(expr.Value)
+	case *Integer:
+		w.Byte(tagInteger)
+		encodeToken(w, expr.Token)
+		w.Int(expr.Value)
+	case *Float:
+		w.Byte(tagFloat)
+		encodeToken(w, expr.Token)
+		w.Float(expr.Value)
+	case *Array:
+		w.Byte(tagArray)
+		encodeToken(w, expr.Token)
+		encodeExpressions(w, expr.Items)
+	case *PrefixExpression:
+		w.Byte(tagPrefix)
+		encodeToken(w, expr.Token)
+		w.Int(int(expr.Op))
+		w.String(expr.Action)
+		EncodeExpression(w, expr.Right)
+	case *InfixExpression:
+		w.Byte(tagInfix)
+		encodeToken(w, expr.Token)
+		w.Int(int(expr.Op))
+		EncodeExpression(w, expr.Left)
+		EncodeExpression(w, expr.Right)
+	case *StringLiteral:
+		w.Byte(tagString)
+		encodeToken(w, expr.Token)
+		w.String(expr.Value)
+	case *FunctionCall:
+		w.Byte(tagFunctionCall)
+		encodeToken(w, expr.Token)
+		encodeToken(w, expr.closeToken)
+		encodeExpressions(w, expr.Args)
+	case *FieldAccess:
+		w.Byte(tagFieldAccess)
+		encodeToken(w, expr.Token)
+		encodeToken(w, expr.closeToken)
+		EncodeExpression(w, expr.Index)
+	case *Chain:
+		w.Byte(tagChain)
+		encodeToken(w, expr.Token)
+		encodeExpressions(w, expr.Parts)
+	case *Ternary:
+		w.Byte(tagTernary)
+		encodeToken(w, expr.Token)
+		EncodeExpression(w, expr.Condition)
+		EncodeExpression(w, expr.Consequence)
+		EncodeExpression(w, expr.Alternative)
+	case *Map:
+		w.Byte(tagMap)
+		encodeToken(w, expr.Token)
+		w.Strings(expr.Keys)
+		encodeExpressions(w, expr.Values)
+	default:
+		w.Fail(fmt.Errorf("can't encode %s expression", expr.Kind()))
+	}
+}
+
+// DecodeExpression reads an expression tree written by EncodeExpression.
+func DecodeExpression(r *codec.Reader) Expression {
+	switch tag := r.Byte(); tag {
+	case tagNil:
+		return nil
+	case tagDotAccess:
+		return &DotAccess{Token: decodeToken(r), Property: r.String()}
+	case tagOptionalAccess:
+		return &OptionalAccess{Token: decodeToken(r)}
+	case tagIdentifier:
+		return &Identifier{Token: decodeToken(r), Value: r.String()}
+	case tagNilLiteral:
+		return &Nil{Token: decodeToken(r)}
+	case tagBoolean:
+		return &Boolean{Token: decodeToken(r), Value: r.Bool()}
+	case tagInteger:
+		return &Integer{Token: decodeToken(r), Value: r.Int()}
+	case tagFloat:
+		return &Float{Token: decodeToken(r), Value: r.Float()}
+	case tagArray:
+		return &Array{Token: decodeToken(r), Items: decodeExpressions(r)}
+	case tagPrefix:
+		return &PrefixExpression{Token: decodeToken(r), Op: TokenKind(r.Int()), Action: r.String(), Right: DecodeExpression(r)}
+	case tagInfix:
+		return &InfixExpression{Token: decodeToken(r), Op: TokenKind(r.Int()), Left: DecodeExpression(r), Right: DecodeExpression(r)}
+	case tagString:
+		return &StringLiteral{Token: decodeToken(r), Value: r.String()}
+	case tagFunctionCall:
+		return &FunctionCall{Token: decodeToken(r), closeToken: decodeToken(r), Args: decodeExpressions(r)}
+	case tagFieldAccess:
+		return &FieldAccess{Token: decodeToken(r), closeToken: decodeToken(r), Index: DecodeExpression(r)}
+	case tagChain:
+		return &Chain{Token: decodeToken(r), Parts: decodeExpressions(r)}
+	case tagTernary:
+		return &Ternary{Token: decodeToken(r), Condition: DecodeExpression(r), Consequence: DecodeExpression(r), Alternative: DecodeExpression(r)}
+	case tagMap:
+		return &Map{Token: decodeToken(r), Keys: r.Strings(), Values: decodeExpressions(r)}
+	default:
+		r.Fail(fmt.Errorf("unknown expression tag %d", tag))
+		return nil
+	}
+}
@@ -1,6 +1,10 @@
 package expression
 
-import "github.com/terawatthour/socks/internal/helpers"
+import (
+	"github.com/terawatthour/socks/internal/helpers"
+	"strings"
+	"unicode"
+)
 
 func Create(source string, blockLocation helpers.Location) (*VM, []string, error) {
 	tokens, err := Tokenize(source, blockLocation)
@@ -18,5 +22,8 @@ func Create(source string, blockLocation helpers.Location) (*VM, []string, error
 		return nil, nil, err
 	}
 
+	program.Source = strings.TrimSpace(source)
+	program.Location = blockLocation.Advance(source[:len(source)-len(strings.TrimLeftFunc(source, unicode.IsSpace))])
+
 	return NewVM(program), ast.Dependencies, nil
 }
@@ -0,0 +1,95 @@
+package expression
+
+import (
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// structFields are the fields of a struct type accessible from expressions, by name.
+type structFields struct {
+	indices map[string][]int
+
+	// hidden are the Go names of the fields that aren't accessible, unexported or tagged with "-"
+	hidden map[string]bool
+}
+
+type fieldsKey struct {
+	typ    reflect.Type
+	tagged bool
+}
+
+// fieldsCache caches structFields by fieldsKey, as resolving names walks all fields and their tags.
+var fieldsCache sync.Map
+
+// fieldsOf returns the accessible fields of the struct type, named by their `socks` tag. If tagged is set,
+// the `json` tag is used for fields without a `socks` tag. Fields without a tag keep their Go name,
+// and a "-" tag hides the field.
+func fieldsOf(typ reflect.Type, tagged bool) *structFields {
+	key := fieldsKey{typ: typ, tagged: tagged}
+	if fields, ok := fieldsCache.Load(key); ok {
+		return fields.(*structFields)
+	}
+
+	fields := &structFields{indices: make(map[string][]int), hidden: make(map[string]bool)}
+	// embedded fields are accessible by their type name or tag, same as other fields, besides promoting theirs
+	for _, field := range reflect.VisibleFields(typ) {
+		name, visible := fieldName(field, tagged)
+		if !field.IsExported() || !visible {
+			fields.hidden[field.Name] = true
+			continue
+		}
+
+		// fields of the outer struct shadow promoted ones, which are listed right after their embedded field,
+		// so the shallowest field wins regardless of the order
+		if index, ok := fields.indices[name]; !ok || len(field.Index) < len(index) {
+			fields.indices[name] = field.Index
+		}
+	}
+
+	fieldsCache.Store(key, fields)
+	return fields
+}
+
+// field returns the value of the field of the struct value named name. Fields promoted
+// through a nil embedded pointer are nil.
+func (fields *structFields) field(value reflect.Value, name string) (any, bool) {
+	index, ok := fields.indices[name]
+	if !ok {
+		return nil, false
+	}
+
+	result, err := value.FieldByIndexErr(index)
+	if err != nil {
+		return nil, true
+	}
+	return result.Interface(), true
+}
+
+// fieldName returns the name of the field according to its tags, false if the field is hidden.
+func fieldName(field reflect.StructField, tagged bool) (string, bool) {
+	keys := []string{"socks"}
+	if tagged {
+		keys = append(keys, "json")
+	}
+
+	for _, key := range keys {
+		tag, ok := field.Tag.Lookup(key)
+		if !ok {
+			continue
+		}
+
+		name, _, _ := strings.Cut(tag, ",")
+		switch name {
+		case "-":
+			return "", false
+		case "":
+			// e.g. `json:",omitempty"`, which keeps the Go name
+			return field.Name, true
+		default:
+			return name, true
+		}
+	}
+
+	return field.Name, true
+}
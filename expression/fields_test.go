@@ -0,0 +1,106 @@
+package expression
+
+import (
+	"testing"
+	"time"
+)
+
+type taggedBase struct {
+	ID int `json:"id"`
+}
+
+type taggedPost struct {
+	*taggedBase
+	Title     string    `json:"title"`
+	Slug      string    `socks:"path" json:"slug"`
+	CreatedAt time.Time `json:"created_at,omitempty"`
+	Draft     bool      `json:",omitempty"`
+	Secret    string    `json:"-"`
+	Author    taggedAuthor
+}
+
+// taggedComment shadows the id of the embedded struct with one of its own
+type taggedComment struct {
+	taggedBase
+	CommentID int `json:"id"`
+}
+
+type taggedAuthor struct {
+	Name string `json:"name"`
+}
+
+type TaggedProfile struct {
+	Bio string `json:"bio"`
+}
+
+// taggedUser embeds exported structs, which are accessible by their type name or tag
+type taggedUser struct {
+	TaggedProfile
+	taggedAuthor `json:"author"`
+	*taggedBase  `json:"-"`
+}
+
+func TestTaggedFields(t *testing.T) {
+	created := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	post := &taggedPost{
+		taggedBase: &taggedBase{ID: 7},
+		Title:      "Hello",
+		Slug:       "hello",
+		CreatedAt:  created,
+		Draft:      true,
+		Secret:     "secret",
+		Author:     taggedAuthor{Name: "Ann"},
+	}
+	comment := taggedComment{taggedBase: taggedBase{ID: 1}, CommentID: 2}
+	user := taggedUser{TaggedProfile: TaggedProfile{Bio: "bio"}, taggedAuthor: taggedAuthor{Name: "Ann"}, taggedBase: &taggedBase{ID: 3}}
+	env := map[string]any{"post": post, "value": *post, "orphan": &taggedPost{}, "comment": comment, "user": user}
+
+	sets := []struct {
+		expr   string
+		expect any
+	}{
+		{`post.title`, "Hello"},
+		{`post["title"]`, "Hello"},
+		{`value.title`, "Hello"},
+		{`value["created_at"]`, created},
+		{`post.path`, "hello"},
+		{`post.slug`, nil},
+		{`post.Draft`, true},
+		{`post.Secret`, nil},
+		{`post.Title`, nil},
+		{`post.id`, 7},
+		{`orphan.id`, nil},
+		{`comment.id`, 2},
+		{`post.Author.name`, "Ann"},
+		{`post["Author"]["name"]`, "Ann"},
+		{`user.TaggedProfile.bio`, "bio"},
+		{`user.bio`, "bio"},
+		{`user.name`, "Ann"},
+		{`user.id`, 3},
+		{`user.taggedBase`, nil},
+	}
+
+	for _, set := range sets {
+		vm, err := compileExpression(set.expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		frame := NewFrame()
+		frame.SetTaggedFields(true)
+		result, err := vm.RunFrame(frame, env)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", set.expr, err)
+			continue
+		}
+		if result != set.expect {
+			t.Errorf("%s: expected %v, got %v", set.expr, set.expect, result)
+		}
+	}
+
+	// Go names are used unless enabled
+	result, err := runExpression(`post.Title`, env)
+	if err != nil || result != "Hello" {
+		t.Errorf("expected the Go name to be used, got %v, %v", result, err)
+	}
+}
@@ -0,0 +1,203 @@
+package expression
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"reflect"
+	"sync"
+)
+
+var (
+	contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+	errorType   = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// Function is a Go function callable from expressions, whose signature was inspected up front.
+// A leading context.Context parameter is filled in by the VM and isn't counted as an argument,
+// a trailing error result fails the execution when it's not nil.
+type Function struct {
+	name      string
+	fn        reflect.Value
+	signature *signature
+}
+
+// NewFunction inspects the signature of fn, which may return at most one value and an optional error.
+func NewFunction(name string, fn any) (*Function, error) {
+	value := reflect.ValueOf(fn)
+	if !value.IsValid() || value.Kind() != reflect.Func || value.IsNil() {
+		return nil, fmt.Errorf("function `%s` must be a non-nil func, got %T", name, fn)
+	}
+
+	sig := signatureOf(value.Type())
+	if sig.results > 1 {
+		return nil, fmt.Errorf("function `%s` must return at most one value and an error, got %s", name, value.Type())
+	}
+
+	return &Function{name: name, fn: value, signature: sig}, nil
+}
+
+func (fn *Function) Name() string {
+	return fn.name
+}
+
+// TakesContext reports whether fn takes a leading context.Context.
+func (fn *Function) TakesContext() bool {
+	return fn.signature.takesContext
+}
+
+// signature describes the parameters and results of a function type.
+type signature struct {
+	params       []reflect.Type
+	variadic     bool
+	takesContext bool
+	results      int
+	returnsError bool
+}
+
+// signatures caches inspected signatures by function type, as functions from the context
+// are inspected on every call.
+var signatures sync.Map
+
+func signatureOf(typ reflect.Type) *signature {
+	if sig, ok := signatures.Load(typ); ok {
+		return sig.(*signature)
+	}
+
+	sig := &signature{variadic: typ.IsVariadic(), results: typ.NumOut()}
+	for i := 0; i < typ.NumIn(); i++ {
+		param := typ.In(i)
+		if i == 0 && param == contextType {
+			sig.takesContext = true
+			continue
+		}
+		sig.params = append(sig.params, param)
+	}
+	if sig.results > 0 && typ.Out(sig.results-1) == errorType {
+		sig.returnsError = true
+		sig.results--
+	}
+
+	signatures.Store(typ, sig)
+	return sig
+}
+
+// call checks the arguments against the signature, converting them where possible, and calls fn.
+// A returned error, either as the trailing result or as the only value, is returned as the error.
+func (sig *signature) call(ctx context.Context, fn reflect.Value, args []any) (any, error) {
+	required := len(sig.params)
+	if sig.variadic {
+		required--
+		if len(args) < required {
+			return nil, fmt.Errorf("wrong number of arguments, expected at least %d, got %d", required, len(args))
+		}
+	} else if len(args) != required {
+		return nil, fmt.Errorf("wrong number of arguments, expected %d, got %d", required, len(args))
+	}
+
+	in := make([]reflect.Value, 0, len(args)+1)
+	if sig.takesContext {
+		in = append(in, reflect.ValueOf(ctx))
+	}
+	for i, arg := range args {
+		var param reflect.Type
+		if sig.variadic && i >= required {
+			param = sig.params[required].Elem()
+		} else {
+			param = sig.params[i]
+		}
+
+		value, ok := convertArgument(arg, param)
+		if !ok {
+			if value := reflect.ValueOf(arg); value.IsValid() && isNumericConversion(value.Kind(), param.Kind()) {
+				return nil, fmt.Errorf("argument %d: %v overflows %s", i+1, arg, param)
+			}
+			return nil, fmt.Errorf("argument %d: %s", i+1, cerr(arg, param.String()).Error())
+		}
+		in = append(in, value)
+	}
+
+	out := fn.Call(in)
+	if sig.returnsError {
+		if err, _ := out[len(out)-1].Interface().(error); err != nil {
+			return nil, err
+		}
+		out = out[:len(out)-1]
+	}
+
+	switch len(out) {
+	case 0:
+		return nil, nil
+	case 1:
+		result := out[0].Interface()
+		if err, ok := result.(error); ok {
+			return nil, err
+		}
+		return result, nil
+	default:
+		return reflectedSliceToInterfaceSlice(out), nil
+	}
+}
+
+// convertArgument makes arg usable as a value of typ. nil becomes the zero value of nillable types and
+// numbers are converted between numeric types, as long as floats aren't truncated to integers
+// and the value fits in typ.
+func convertArgument(arg any, typ reflect.Type) (reflect.Value, bool) {
+	if arg == nil {
+		switch typ.Kind() {
+		case reflect.Pointer, reflect.Interface, reflect.Map, reflect.Slice, reflect.Func, reflect.Chan:
+			return reflect.Zero(typ), true
+		}
+		return reflect.Value{}, false
+	}
+
+	value := reflect.ValueOf(arg)
+	if value.Type().AssignableTo(typ) {
+		return value, true
+	}
+
+	if isNumericConversion(value.Kind(), typ.Kind()) && fits(value, typ) {
+		return value.Convert(typ), true
+	}
+
+	return reflect.Value{}, false
+}
+
+// fits reports whether the number value is in the range of the numeric type typ. Integers always fit in floats,
+// even if they lose precision.
+func fits(value reflect.Value, typ reflect.Type) bool {
+	target := reflect.Zero(typ)
+	switch {
+	case isFloatKind(typ.Kind()):
+		return !isFloatKind(value.Kind()) || !target.OverflowFloat(value.Float())
+	case isSignedKind(value.Kind()):
+		n := value.Int()
+		if isSignedKind(typ.Kind()) {
+			return !target.OverflowInt(n)
+		}
+		return n >= 0 && !target.OverflowUint(uint64(n))
+	default:
+		n := value.Uint()
+		if isSignedKind(typ.Kind()) {
+			return n <= math.MaxInt64 && !target.OverflowInt(int64(n))
+		}
+		return !target.OverflowUint(n)
+	}
+}
+
+// isNumericConversion reports whether numbers of kind from are converted to kind to, as long as they fit.
+func isNumericConversion(from, to reflect.Kind) bool {
+	return isIntegerKind(from) && (isIntegerKind(to) || isFloatKind(to)) || isFloatKind(from) && isFloatKind(to)
+}
+
+func isSignedKind(kind reflect.Kind) bool {
+	return reflect.Int <= kind && kind <= reflect.Int64
+}
+
+func isIntegerKind(kind reflect.Kind) bool {
+	return reflect.Int <= kind && kind <= reflect.Uintptr
+}
+
+func isFloatKind(kind reflect.Kind) bool {
+	return kind == reflect.Float32 || kind == reflect.Float64
+}
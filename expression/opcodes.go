@@ -25,6 +25,8 @@ const (
 
 	// OpGet | <<LITERAL_CONST_ID>>
 	OpGet
+	// OpGetFunction | <<LITERAL_CONST_ID>>, same as OpGet but falls back to a builtin if the identifier isn't in the env
+	OpGetFunction
 	OpCall
 	OpChain
 	OpOptionalChain // OpOptionalChain | <<JUMP_BY_IF_NIL>>
@@ -36,6 +38,7 @@ const (
 	OpNot
 	OpNegate
 	OpArray
+	OpMap // OpMap | <<ENTRY_COUNT>>, keys and values are on the stack
 
 	OpNil
 )
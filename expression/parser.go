@@ -50,7 +50,47 @@ func (p *parser) parse() (*WrappedExpression, error) {
 }
 
 func (p *parser) expression() (Expression, error) {
-	return p.ternary()
+	return p.pipe()
+}
+
+// pipe parses `value | filter | filter(arguments)`, which is desugared into `filter(filter(value), arguments)`.
+// The calls are located at the filter names, so that errors point at the failing filter.
+func (p *parser) pipe() (Expression, error) {
+	left, err := p.ternary()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.currentIs(TokPipe) {
+		p.advance()
+
+		name := p.advance()
+		if name.Kind != TokIdent {
+			return nil, p.error(fmt.Sprintf("unexpected %s, expected filter name", name.Kind), name.Location)
+		}
+		p.addDependency(name.Literal, true)
+
+		call := &FunctionCall{Token: name, Args: []Expression{left}, closeToken: name}
+		if p.currentIs(TokLparen) {
+			p.advance()
+
+			args, err := p.list(TokRparen, ")")
+			if err != nil {
+				return nil, err
+			}
+			assert(p.currentToken.Kind == TokRparen, "p.currentToken after p.list must always be the end literal")
+
+			call.Args = append(call.Args, args...)
+			call.closeToken = p.advance()
+		}
+
+		left = &Chain{
+			Token: name,
+			Parts: []Expression{&Identifier{Token: name, Value: name.Literal}, call},
+		}
+	}
+
+	return left, nil
 }
 
 func (p *parser) ternary() (Expression, error) {
@@ -271,6 +311,8 @@ func (p *parser) primary() (Expression, error) {
 		return p.identifier(token)
 	case TokLbrack:
 		return p.array()
+	case TokLbrace:
+		return p.mapLiteral()
 	case TokLparen:
 		expr, err := p.expression()
 		if err != nil {
@@ -288,8 +330,10 @@ func (p *parser) primary() (Expression, error) {
 		}
 
 		return expr, nil
+	case TokEmpty:
+		return nil, p.error("unexpected end of expression", p.endLocation())
 	default:
-		return nil, p.error("unexpected token "+p.currentToken.Literal, p.currentToken.Location)
+		return nil, p.error("unexpected token "+token.Literal, token.Location)
 	}
 }
 
@@ -353,21 +397,63 @@ func (p *parser) chain(left Expression) (Expression, error) {
 
 func (p *parser) array() (Expression, error) {
 	var err error
-	array := &Array{Token: p.currentToken}
+	array := &Array{Token: p.previousToken}
 	array.Items, err = p.list(TokRbrack, "]")
 	if err != nil {
 		return nil, err
 	}
 	assert(p.currentToken.Kind == TokRbrack, "p.currentToken after p.list must always be the end literal")
 
-	if p.nextIs(TokLbrack) {
-		p.advance()
+	p.advance()
+	if p.currentIs(TokLbrack, TokDot) {
 		return p.chain(array)
 	}
 
 	return array, err
 }
 
+func (p *parser) mapLiteral() (Expression, error) {
+	literal := &Map{Token: p.previousToken}
+
+	for !p.currentIs(TokRbrace) {
+		if len(literal.Keys) > 0 {
+			if !p.currentIs(TokComma) {
+				return nil, p.error("expected `,` or `}`", p.currentToken.Location)
+			}
+			p.advance()
+		}
+
+		// keys are never dependencies, so identifiers are taken literally instead of being parsed as expressions
+		key := p.advance()
+		if key.Kind != TokString && key.Kind != TokIdent {
+			return nil, p.error(fmt.Sprintf("unexpected %s, expected string or identifier as map key", key.Kind), key.Location)
+		}
+		if slices.Contains(literal.Keys, key.Literal) {
+			return nil, p.error(fmt.Sprintf("duplicate map key `%s`", key.Literal), key.Location)
+		}
+
+		if !p.currentIs(TokColon) {
+			return nil, p.error("expected `:`", p.currentToken.Location)
+		}
+		p.advance()
+
+		value, err := p.expression()
+		if err != nil {
+			return nil, err
+		}
+
+		literal.Keys = append(literal.Keys, key.Literal)
+		literal.Values = append(literal.Values, value)
+	}
+
+	p.advance()
+	if p.currentIs(TokLbrack, TokDot) {
+		return p.chain(literal)
+	}
+
+	return literal, nil
+}
+
 func (p *parser) list(end TokenKind, endLiteral string) ([]Expression, error) {
 	list := make([]Expression, 0)
 	if p.currentIs(end) {
@@ -397,11 +483,7 @@ func (p *parser) list(end TokenKind, endLiteral string) ([]Expression, error) {
 }
 
 func (p *parser) identifier(token Token) (Expression, error) {
-	if !slices.ContainsFunc(builtinNames, func(value reflect.Value) bool {
-		return value.String() == token.Literal
-	}) {
-		p.dependencies = append(p.dependencies, token.Literal)
-	}
+	p.addDependency(token.Literal, p.currentIs(TokLparen))
 
 	ident := &Identifier{Token: token, Value: token.Literal}
 
@@ -412,6 +494,18 @@ func (p *parser) identifier(token Token) (Expression, error) {
 	return ident, nil
 }
 
+// addDependency records that the expression depends on the identifier, unless it's a called builtin.
+// Builtins referenced without being called are still dependencies, as many of them have names
+// that are commonly used for variables, e.g. `title` or `first`.
+func (p *parser) addDependency(name string, isCall bool) {
+	if isCall && slices.ContainsFunc(builtinNames, func(value reflect.Value) bool {
+		return value.String() == name
+	}) {
+		return
+	}
+	p.dependencies = append(p.dependencies, name)
+}
+
 func (p *parser) string(token Token) (Expression, error) {
 	str := &StringLiteral{Token: token, Value: token.Literal}
 
@@ -486,6 +580,19 @@ func (p *parser) advance() Token {
 	return p.previousToken
 }
 
+// endLocation points right after the last token.
+func (p *parser) endLocation() helpers.Location {
+	if len(p.tokens) == 0 {
+		return helpers.Location{}
+	}
+
+	last := p.tokens[len(p.tokens)-1]
+	location := last.Location
+	location.Column += last.Length
+	location.Length = 1
+	return location
+}
+
 func (p *parser) error(message string, location helpers.Location) error {
 	return errors2.New(message, location)
 }
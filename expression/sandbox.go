@@ -0,0 +1,176 @@
+package expression
+
+import (
+	"fmt"
+	"reflect"
+	"slices"
+)
+
+// Sandbox restricts what expressions can reach through reflection, for templates written by untrusted users.
+// Maps, slices and functions from the context aren't restricted, as they're provided explicitly.
+//
+// Fields of sandboxed structs follow the `socks` struct tag: `socks:"-"` hides the field and
+// `socks:"name"` makes it accessible under that name only. Unexported and hidden fields are forbidden.
+// With tagged field names, `json` tags are followed as well.
+type Sandbox struct {
+	// Types allow-lists the types whose fields and methods can be accessed. Pointers are looked up
+	// by the types they point to. Nil allows all types.
+	Types []reflect.Type
+
+	// Methods allow-lists the callable methods by type, e.g. the ones without side effects. Pointers are
+	// looked up by the types they point to, so pointer-receiver methods are listed under the type itself.
+	// Methods of types missing from it can't be called at all.
+	Methods map[reflect.Type][]string
+}
+
+// access returns the property of base allowed by the sandbox, or an error if it's forbidden.
+// Missing properties are nil, same as outside the sandbox.
+func (s *Sandbox) access(base any, property string, tagged bool) (any, error) {
+	value := reflect.ValueOf(base)
+	target := value
+	for target.Kind() == reflect.Pointer || target.Kind() == reflect.Interface {
+		if target.IsNil() {
+			return nil, nil
+		}
+		target = target.Elem()
+	}
+
+	if !target.IsValid() {
+		return nil, nil
+	}
+	if target.Kind() == reflect.Map {
+		return mapIndex(target, property), nil
+	}
+
+	if s.Types != nil && !slices.Contains(s.Types, target.Type()) {
+		return nil, fmt.Errorf("access to properties of %s is forbidden", target.Type())
+	}
+
+	hidden := false
+	if target.Kind() == reflect.Struct {
+		fields := fieldsOf(target.Type(), tagged)
+		if field, ok := fields.field(target, property); ok {
+			return field, nil
+		}
+		hidden = fields.hidden[property]
+	}
+
+	method := value.MethodByName(property)
+	if !method.IsValid() && value.Kind() != reflect.Pointer {
+		// pointer-receiver methods of values
+		pointer := reflect.New(value.Type())
+		pointer.Elem().Set(value)
+		method = pointer.MethodByName(property)
+	}
+
+	switch {
+	case method.IsValid() && !slices.Contains(s.Methods[target.Type()], property):
+		return nil, fmt.Errorf("call of method `%s` of %s is forbidden", property, value.Type())
+	case method.IsValid():
+		return method.Interface(), nil
+	case hidden:
+		return nil, fmt.Errorf("access to field `%s` of %s is forbidden", property, target.Type())
+	}
+
+	return nil, nil
+}
+
+// printingMethods are the methods fmt calls on the values it prints, instead of printing their fields.
+var printingMethods = []struct {
+	name string
+	typ  reflect.Type
+}{
+	{"Format", reflect.TypeOf((*fmt.Formatter)(nil)).Elem()},
+	{"GoString", reflect.TypeOf((*fmt.GoStringer)(nil)).Elem()},
+	{"Error", reflect.TypeOf((*error)(nil)).Elem()},
+	{"String", reflect.TypeOf((*fmt.Stringer)(nil)).Elem()},
+}
+
+// Printable returns an error if printing value with fmt would reveal what the sandbox forbids: fields
+// of types that aren't allowed, hidden fields, or results of methods fmt calls on its own, such as String,
+// that aren't allow-listed. A nil sandbox allows everything.
+func (s *Sandbox) Printable(value any, tagged bool) error {
+	if s == nil {
+		return nil
+	}
+	if raw, ok := value.(Raw); ok {
+		value = raw.Value
+	}
+	return s.printable(reflect.ValueOf(value), tagged, 0)
+}
+
+// printable follows the way fmt prints the value at the provided depth.
+func (s *Sandbox) printable(value reflect.Value, tagged bool, depth int) error {
+	if !value.IsValid() {
+		return nil
+	}
+
+	// fmt calls the methods of values that can be interfaced, i.e. not of unexported fields,
+	// and of the values held by interfaces rather than of the interfaces
+	if value.CanInterface() && value.Kind() != reflect.Interface {
+		target := value.Type()
+		if target.Kind() == reflect.Pointer {
+			target = target.Elem()
+		}
+
+		implemented := false
+		for _, method := range printingMethods {
+			if !value.Type().Implements(method.typ) {
+				continue
+			}
+			if !slices.Contains(s.Methods[target], method.name) {
+				return fmt.Errorf("call of method `%s` of %s is forbidden", method.name, value.Type())
+			}
+			implemented = true
+		}
+		if implemented {
+			return nil
+		}
+	}
+
+	switch value.Kind() {
+	case reflect.Pointer:
+		// nested pointers are printed as addresses
+		if value.IsNil() || depth > 0 {
+			return nil
+		}
+		return s.printable(value.Elem(), tagged, depth+1)
+	case reflect.Interface:
+		return s.printable(value.Elem(), tagged, depth+1)
+	case reflect.Struct:
+		if s.Types != nil && !slices.Contains(s.Types, value.Type()) {
+			return fmt.Errorf("access to properties of %s is forbidden", value.Type())
+		}
+		for i := 0; i < value.NumField(); i++ {
+			field := value.Type().Field(i)
+			if _, visible := fieldName(field, tagged); !field.Anonymous && (!field.IsExported() || !visible) {
+				return fmt.Errorf("access to field `%s` of %s is forbidden", field.Name, value.Type())
+			}
+			if err := s.printable(value.Field(i), tagged, depth+1); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		iter := value.MapRange()
+		for iter.Next() {
+			if err := s.printable(iter.Key(), tagged, depth+1); err != nil {
+				return err
+			}
+			if err := s.printable(iter.Value(), tagged, depth+1); err != nil {
+				return err
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		// e.g. []byte, which would be walked byte by byte
+		if elem := value.Type().Elem(); (elem.Kind() <= reflect.Complex128 || elem.Kind() == reflect.String) && elem.NumMethod() == 0 {
+			return nil
+		}
+		for i := 0; i < value.Len(); i++ {
+			if err := s.printable(value.Index(i), tagged, depth+1); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
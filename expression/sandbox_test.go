@@ -0,0 +1,123 @@
+package expression
+
+import (
+	"reflect"
+	"testing"
+)
+
+type sandboxedUser struct {
+	Name     string
+	Email    string `socks:"email"`
+	Password string `socks:"-"`
+	secret   string
+	Profile  *sandboxedProfile
+}
+
+func (u *sandboxedUser) Greeting() string {
+	return "Hi " + u.Name
+}
+
+func (u *sandboxedUser) Delete() string {
+	return "deleted"
+}
+
+type sandboxedProfile struct {
+	Bio string
+}
+
+// sandboxedToken is printed by its String method, which isn't allow-listed
+type sandboxedToken struct {
+	Value string
+}
+
+func (t sandboxedToken) String() string {
+	return t.Value
+}
+
+type sandboxedTag string
+
+func (t sandboxedTag) String() string {
+	return "#" + string(t)
+}
+
+type sandboxedDB struct {
+	DSN string
+}
+
+func (db sandboxedDB) Exec(query string) string {
+	return query
+}
+
+func TestSandbox(t *testing.T) {
+	sandbox := &Sandbox{
+		Types: []reflect.Type{reflect.TypeOf(sandboxedUser{}), reflect.TypeOf(sandboxedProfile{}), reflect.TypeOf(sandboxedToken{})},
+		Methods: map[reflect.Type][]string{
+			reflect.TypeOf(sandboxedUser{}):  {"Greeting"},
+			reflect.TypeOf(sandboxedTag("")): {"String"},
+		},
+	}
+	env := map[string]any{
+		"user":  &sandboxedUser{Name: "Ann", Email: "ann@example.com", Password: "hunter2", secret: "s", Profile: &sandboxedProfile{Bio: "bio"}},
+		"value": sandboxedUser{Name: "Jan", Email: "jan@example.com"},
+		"db":    sandboxedDB{DSN: "postgres://"},
+		"data":  map[string]any{"user": &sandboxedUser{Name: "Eve"}},
+		"token": sandboxedToken{Value: "t0k3n"},
+		"tags":  []any{sandboxedTag("go"), &sandboxedProfile{Bio: "bio"}},
+	}
+
+	sets := []struct {
+		expr   string
+		expect any
+		err    string
+	}{
+		{expr: `user.Name`, expect: "Ann"},
+		{expr: `user.email`, expect: "ann@example.com"},
+		{expr: `value["email"]`, expect: "jan@example.com"},
+		{expr: `value["Password"]`, err: "debug.html:1:7: access to field `Password` of expression.sandboxedUser is forbidden"},
+		{expr: `user.Profile.Bio`, expect: "bio"},
+		{expr: `data.user.Name`, expect: "Eve"},
+		{expr: `user.Greeting()`, expect: "Hi Ann"},
+		{expr: `value.Greeting()`, expect: "Hi Jan"},
+		{expr: `user.Missing`, expect: nil},
+		{expr: `user.Email`, expect: nil},
+		{expr: `user.Password`, err: "debug.html:1:6: access to field `Password` of expression.sandboxedUser is forbidden"},
+		{expr: `user.secret`, err: "debug.html:1:6: access to field `secret` of expression.sandboxedUser is forbidden"},
+		{expr: `user.Delete()`, err: "debug.html:1:6: call of method `Delete` of *expression.sandboxedUser is forbidden"},
+		{expr: `db.DSN`, err: "debug.html:1:4: access to properties of expression.sandboxedDB is forbidden"},
+		{expr: `db.Exec("DROP TABLE users")`, err: "debug.html:1:4: access to properties of expression.sandboxedDB is forbidden"},
+		{expr: `format("%v", user.Profile)`, expect: "&{bio}"},
+		{expr: `tags | join(", ")`, expect: "#go, &{bio}"},
+		{expr: `upper(tags[0])`, expect: "#GO"},
+		{expr: `format("%+v", user)`, err: "debug.html:1:7: access to field `Password` of expression.sandboxedUser is forbidden"},
+		{expr: `format("%v", [value])`, err: "debug.html:1:7: access to field `Password` of expression.sandboxedUser is forbidden"},
+		{expr: `format("%v", raw(value))`, err: "debug.html:1:7: access to field `Password` of expression.sandboxedUser is forbidden"},
+		{expr: `format("%v", token)`, err: "debug.html:1:7: call of method `String` of expression.sandboxedToken is forbidden"},
+		{expr: `[token] | join("")`, err: "debug.html:1:11: call of method `String` of expression.sandboxedToken is forbidden"},
+		{expr: `upper(token)`, err: "debug.html:1:6: can't cast expression.sandboxedToken to string"},
+		{expr: `format("%v", db)`, err: "debug.html:1:7: access to properties of expression.sandboxedDB is forbidden"},
+	}
+
+	for _, set := range sets {
+		vm, err := compileExpression(set.expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		frame := NewFrame()
+		frame.SetSandbox(sandbox)
+		result, err := vm.RunFrame(frame, env)
+		if set.err != "" {
+			if err == nil || err.Error() != set.err {
+				t.Errorf("%s: expected error %q, got %v", set.expr, set.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", set.expr, err)
+			continue
+		}
+		if result != set.expect {
+			t.Errorf("%s: expected %v, got %v", set.expr, set.expect, result)
+		}
+	}
+}
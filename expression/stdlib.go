@@ -0,0 +1,608 @@
+package expression
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"github.com/terawatthour/socks/internal/helpers"
+	"math"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// ---------------------- argument helpers ----------------------
+
+// castString returns strings as they are and stringers stringified, if the sandbox allows printing them.
+func castString(ctx context.Context, val any) (string, *castError) {
+	switch val := val.(type) {
+	case string:
+		return val, nil
+	case fmt.Stringer:
+		if printable(ctx, val) == nil {
+			return val.String(), nil
+		}
+	}
+	return "", cerr(val, "string")
+}
+
+func castList(val any) (reflect.Value, *castError) {
+	value := reflect.ValueOf(val)
+	if value.Kind() != reflect.Slice && value.Kind() != reflect.Array {
+		return reflect.Value{}, cerr(val, "<slice | array>")
+	}
+	return value, nil
+}
+
+func castMap(val any) (reflect.Value, *castError) {
+	value := reflect.ValueOf(val)
+	if value.Kind() != reflect.Map {
+		return reflect.Value{}, cerr(val, "map")
+	}
+	return value, nil
+}
+
+func castNumber(val any) (float64, *castError) {
+	f, ok := castFloat64(val).(float64)
+	if !ok {
+		return 0, cerr(val, "number")
+	}
+	return f, nil
+}
+
+func castInteger(val any) (int, *castError) {
+	i, ok := castInt(val).(int)
+	if !ok {
+		return 0, cerr(val, "int")
+	}
+	return i, nil
+}
+
+func isInteger(val any) bool {
+	switch val.(type) {
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, uintptr:
+		return true
+	}
+	return false
+}
+
+func listItems(value reflect.Value) []any {
+	items := make([]any, value.Len())
+	for i := range items {
+		items[i] = value.Index(i).Interface()
+	}
+	return items
+}
+
+// equal compares two values, treating numbers of different types as equal if their values are.
+// Values of uncomparable types, such as maps and slices, are compared deeply.
+func equal(a, b any) bool {
+	if reflect.DeepEqual(a, b) {
+		return true
+	}
+	fa, aErr := castNumber(a)
+	fb, bErr := castNumber(b)
+	return aErr == nil && bErr == nil && fa == fb
+}
+
+// compare orders two strings or two numbers.
+func compare(a, b any) (int, *castError) {
+	if sa, ok := a.(string); ok {
+		sb, ok := b.(string)
+		if !ok {
+			return 0, cerr(b, "string")
+		}
+		return strings.Compare(sa, sb), nil
+	}
+
+	fa, err := castNumber(a)
+	if err != nil {
+		return 0, err
+	}
+	fb, err := castNumber(b)
+	if err != nil {
+		return 0, err
+	}
+	return cmp.Compare(fa, fb), nil
+}
+
+// ---------------------- string helpers ----------------------
+
+func upper(ctx context.Context, s any) any {
+	str, err := castString(ctx, s)
+	if err != nil {
+		return err
+	}
+	return strings.ToUpper(str)
+}
+
+func lower(ctx context.Context, s any) any {
+	str, err := castString(ctx, s)
+	if err != nil {
+		return err
+	}
+	return strings.ToLower(str)
+}
+
+func title(ctx context.Context, s any) any {
+	str, err := castString(ctx, s)
+	if err != nil {
+		return err
+	}
+
+	runes := []rune(str)
+	for i, r := range runes {
+		if i == 0 || unicode.IsSpace(runes[i-1]) {
+			runes[i] = unicode.ToTitle(r)
+		}
+	}
+	return string(runes)
+}
+
+func trim(ctx context.Context, s any) any {
+	str, err := castString(ctx, s)
+	if err != nil {
+		return err
+	}
+	return strings.TrimSpace(str)
+}
+
+func split(ctx context.Context, s, separator any) any {
+	str, err := castString(ctx, s)
+	if err != nil {
+		return err
+	}
+	sep, err := castString(ctx, separator)
+	if err != nil {
+		return err
+	}
+	return strings.Split(str, sep)
+}
+
+func join(ctx context.Context, list, separator any) any {
+	value, err := castList(list)
+	if err != nil {
+		return err
+	}
+	sep, err := castString(ctx, separator)
+	if err != nil {
+		return err
+	}
+
+	parts := make([]string, value.Len())
+	for i := range parts {
+		part := value.Index(i).Interface()
+		if err := printable(ctx, part); err != nil {
+			return err
+		}
+		parts[i] = fmt.Sprint(part)
+	}
+	return strings.Join(parts, sep)
+}
+
+func replace(ctx context.Context, s, old, new any) any {
+	str, err := castString(ctx, s)
+	if err != nil {
+		return err
+	}
+	o, err := castString(ctx, old)
+	if err != nil {
+		return err
+	}
+	n, err := castString(ctx, new)
+	if err != nil {
+		return err
+	}
+	return strings.ReplaceAll(str, o, n)
+}
+
+// contains checks whether a string contains a substring, a list contains an item or a map contains a key.
+func contains(ctx context.Context, haystack, needle any) any {
+	if str, ok := haystack.(string); ok {
+		substr, err := castString(ctx, needle)
+		if err != nil {
+			return err
+		}
+		return strings.Contains(str, substr)
+	}
+
+	value := reflect.ValueOf(haystack)
+	switch value.Kind() {
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < value.Len(); i++ {
+			if equal(value.Index(i).Interface(), needle) {
+				return true
+			}
+		}
+		return false
+	case reflect.Map:
+		key := reflect.ValueOf(needle)
+		if !key.IsValid() || !key.Type().AssignableTo(value.Type().Key()) {
+			return false
+		}
+		return value.MapIndex(key).IsValid()
+	}
+
+	return cerr(haystack, "<string | slice | array | map>")
+}
+
+func hasPrefix(ctx context.Context, s, prefix any) any {
+	str, err := castString(ctx, s)
+	if err != nil {
+		return err
+	}
+	p, err := castString(ctx, prefix)
+	if err != nil {
+		return err
+	}
+	return strings.HasPrefix(str, p)
+}
+
+// truncate shortens the string to at most length characters, marking the cut with an ellipsis.
+func truncate(ctx context.Context, s, length any) any {
+	str, err := castString(ctx, s)
+	if err != nil {
+		return err
+	}
+	n, err := castInteger(length)
+	if err != nil {
+		return err
+	}
+	if n < 0 {
+		return fmt.Errorf("truncate length can't be negative")
+	}
+
+	if utf8.RuneCountInString(str) <= n {
+		return str
+	}
+	return string([]rune(str)[:n]) + "…"
+}
+
+// ---------------------- collection helpers ----------------------
+
+// keys returns the keys of the map in sorted order.
+func keys(m any) any {
+	value, err := castMap(m)
+	if err != nil {
+		return err
+	}
+
+	keys := helpers.SortedMapKeys(value)
+	result := make([]any, len(keys))
+	for i, key := range keys {
+		result[i] = key.Interface()
+	}
+	return result
+}
+
+// values returns the values of the map in the order of their sorted keys.
+func values(m any) any {
+	value, err := castMap(m)
+	if err != nil {
+		return err
+	}
+
+	keys := helpers.SortedMapKeys(value)
+	result := make([]any, len(keys))
+	for i, key := range keys {
+		result[i] = value.MapIndex(key).Interface()
+	}
+	return result
+}
+
+// _sort returns a sorted copy of a list of strings or numbers.
+func _sort(list any) any {
+	value, err := castList(list)
+	if err != nil {
+		return err
+	}
+
+	items := listItems(value)
+	var sortErr *castError
+	slices.SortStableFunc(items, func(a, b any) int {
+		result, err := compare(a, b)
+		if err != nil && sortErr == nil {
+			sortErr = err
+		}
+		return result
+	})
+	if sortErr != nil {
+		return sortErr
+	}
+	return items
+}
+
+// reverse returns a reversed copy of a list or string.
+func reverse(val any) any {
+	if str, ok := val.(string); ok {
+		runes := []rune(str)
+		slices.Reverse(runes)
+		return string(runes)
+	}
+
+	value, err := castList(val)
+	if err != nil {
+		return err
+	}
+
+	items := listItems(value)
+	slices.Reverse(items)
+	return items
+}
+
+// first returns the first item of a list or the first character of a string, nil if it's empty.
+func first(val any) any {
+	if str, ok := val.(string); ok {
+		if str == "" {
+			return nil
+		}
+		r, _ := utf8.DecodeRuneInString(str)
+		return string(r)
+	}
+
+	value, err := castList(val)
+	if err != nil {
+		return err
+	}
+	if value.Len() == 0 {
+		return nil
+	}
+	return value.Index(0).Interface()
+}
+
+// last returns the last item of a list or the last character of a string, nil if it's empty.
+func last(val any) any {
+	if str, ok := val.(string); ok {
+		if str == "" {
+			return nil
+		}
+		r, _ := utf8.DecodeLastRuneInString(str)
+		return string(r)
+	}
+
+	value, err := castList(val)
+	if err != nil {
+		return err
+	}
+	if value.Len() == 0 {
+		return nil
+	}
+	return value.Index(value.Len() - 1).Interface()
+}
+
+// slice returns the part of a list or string between start and end, end defaults to its length.
+func slice(val any, start any, end ...any) any {
+	var length int
+	str, isString := val.(string)
+	var runes []rune
+	var value reflect.Value
+	if isString {
+		runes = []rune(str)
+		length = len(runes)
+	} else {
+		var err *castError
+		if value, err = castList(val); err != nil {
+			return err
+		}
+		length = value.Len()
+	}
+
+	from, err := castInteger(start)
+	if err != nil {
+		return err
+	}
+	to := length
+	if len(end) > 1 {
+		return fmt.Errorf("slice expects at most 3 arguments, got %d", len(end)+2)
+	} else if len(end) == 1 {
+		if to, err = castInteger(end[0]); err != nil {
+			return err
+		}
+	}
+
+	if from < 0 || to < from || to > length {
+		return fmt.Errorf("slice bounds [%d:%d] out of range with length %d", from, to, length)
+	}
+
+	if isString {
+		return string(runes[from:to])
+	}
+	return listItems(value.Slice(from, to))
+}
+
+// uniq returns the items of the list without duplicates, keeping the first occurrence of each.
+func uniq(list any) any {
+	value, err := castList(list)
+	if err != nil {
+		return err
+	}
+
+	var result []any
+	for _, item := range listItems(value) {
+		if !slices.ContainsFunc(result, func(other any) bool { return equal(item, other) }) {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+// ---------------------- math helpers ----------------------
+
+func extremum(name string, sign int, numbers []any) any {
+	if len(numbers) == 0 {
+		return fmt.Errorf("%s expects at least one argument", name)
+	}
+
+	best := numbers[0]
+	allIntegers := isInteger(best)
+	for _, n := range numbers[1:] {
+		allIntegers = allIntegers && isInteger(n)
+		result, err := compare(n, best)
+		if err != nil {
+			return err
+		}
+		if result*sign > 0 {
+			best = n
+		}
+	}
+
+	if _, err := castNumber(best); err != nil {
+		return err
+	}
+	if allIntegers {
+		return castInt(best)
+	}
+	return castFloat64(best)
+}
+
+func _min(numbers ...any) any {
+	return extremum("min", -1, numbers)
+}
+
+func _max(numbers ...any) any {
+	return extremum("max", 1, numbers)
+}
+
+func abs(val any) any {
+	if isInteger(val) {
+		i, err := castInteger(val)
+		if err != nil {
+			return err
+		}
+		if i < 0 {
+			return -i
+		}
+		return i
+	}
+
+	f, err := castNumber(val)
+	if err != nil {
+		return err
+	}
+	return math.Abs(f)
+}
+
+// round rounds the number half away from zero, to the provided number of decimal places or to an integer.
+func round(val any, places ...any) any {
+	f, err := castNumber(val)
+	if err != nil {
+		return err
+	}
+
+	if len(places) > 1 {
+		return fmt.Errorf("round expects at most 2 arguments, got %d", len(places)+1)
+	} else if len(places) == 1 {
+		p, err := castInteger(places[0])
+		if err != nil {
+			return err
+		}
+		shift := math.Pow(10, float64(p))
+		return math.Round(f*shift) / shift
+	}
+
+	if isInteger(val) {
+		return castInt(val)
+	}
+	return math.Round(f)
+}
+
+func floor(val any) any {
+	if isInteger(val) {
+		return castInt(val)
+	}
+	f, err := castNumber(val)
+	if err != nil {
+		return err
+	}
+	return math.Floor(f)
+}
+
+func ceil(val any) any {
+	if isInteger(val) {
+		return castInt(val)
+	}
+	f, err := castNumber(val)
+	if err != nil {
+		return err
+	}
+	return math.Ceil(f)
+}
+
+// ---------------------- formatting helpers ----------------------
+
+// format works like fmt.Sprintf.
+func format(ctx context.Context, layout any, args ...any) any {
+	str, err := castString(ctx, layout)
+	if err != nil {
+		return err
+	}
+	for _, arg := range args {
+		if err := printable(ctx, arg); err != nil {
+			return err
+		}
+	}
+	return fmt.Sprintf(str, args...)
+}
+
+// formatNumber prints the number with thousands separated by commas and the provided number of decimal places,
+// which defaults to 0.
+func formatNumber(val any, decimals ...any) any {
+	f, err := castNumber(val)
+	if err != nil {
+		return err
+	}
+
+	places := 0
+	if len(decimals) > 1 {
+		return fmt.Errorf("formatNumber expects at most 2 arguments, got %d", len(decimals)+1)
+	} else if len(decimals) == 1 {
+		if places, err = castInteger(decimals[0]); err != nil {
+			return err
+		}
+		if places < 0 {
+			return fmt.Errorf("number of decimal places can't be negative")
+		}
+	}
+
+	formatted := strconv.FormatFloat(math.Abs(f), 'f', places, 64)
+	integer, fraction, _ := strings.Cut(formatted, ".")
+
+	var b strings.Builder
+	if f < 0 && strings.Trim(formatted, "0.") != "" {
+		b.WriteByte('-')
+	}
+	for i, digit := range integer {
+		if i > 0 && (len(integer)-i)%3 == 0 {
+			b.WriteByte(',')
+		}
+		b.WriteRune(digit)
+	}
+	if fraction != "" {
+		b.WriteByte('.')
+		b.WriteString(fraction)
+	}
+	return b.String()
+}
+
+// formatDate formats a time.Time using a Go time layout.
+func formatDate(ctx context.Context, date any, layout any) any {
+	l, err := castString(ctx, layout)
+	if err != nil {
+		return err
+	}
+
+	switch date := date.(type) {
+	case time.Time:
+		return date.Format(l)
+	case *time.Time:
+		if date == nil {
+			return cerr(date, "time.Time")
+		}
+		return date.Format(l)
+	}
+	return cerr(date, "time.Time")
+}
@@ -0,0 +1,111 @@
+package expression
+
+import (
+	"github.com/terawatthour/socks/internal/helpers"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func compileExpression(expr string) (*VM, error) {
+	tokens, err := Tokenize(expr, helpers.Location{File: "debug.html", Line: 1, Column: 1})
+	if err != nil {
+		return nil, err
+	}
+	parsed, err := Parse(tokens)
+	if err != nil {
+		return nil, err
+	}
+	program, err := NewCompiler(parsed.Expr).Compile()
+	if err != nil {
+		return nil, err
+	}
+	return NewVM(program), nil
+}
+
+func runExpression(expr string, env map[string]any) (any, error) {
+	vm, err := compileExpression(expr)
+	if err != nil {
+		return nil, err
+	}
+	return vm.Run(env)
+}
+
+func TestStandardLibrary(t *testing.T) {
+	env := map[string]any{
+		"name":   "  the socks  ",
+		"tags":   []string{"go", "html", "go", "templates"},
+		"nums":   []int{3, 1, 2},
+		"prices": map[string]float64{"b": 2.5, "a": 1},
+		"date":   time.Date(2024, 3, 9, 0, 0, 0, 0, time.UTC),
+		"pairs":  [][]int{{1, 2}, {3}, {1, 2}},
+	}
+
+	sets := []struct {
+		expr   string
+		expect any
+	}{
+		{`name | trim | title`, "The Socks"},
+		{`upper("a") + lower("B")`, "Ab"},
+		{`split("a,b,c", ",") | join(" - ")`, "a - b - c"},
+		{`replace("a-b-c", "-", "+")`, "a+b+c"},
+		{`contains(name, "sock")`, true},
+		{`contains(tags, "go")`, true},
+		{`contains(prices, "c")`, false},
+		{`contains(nums, 2.0)`, true},
+		{`contains([{ a: 1 }, { b: 2 }], { b: 2 })`, true},
+		{`contains(pairs, pairs[1])`, true},
+		{`pairs | uniq | length`, 2},
+		{`hasPrefix("socks", "so")`, true},
+		{`"żółwie" | truncate(3)`, "żół…"},
+		{`"short" | truncate(10)`, "short"},
+		{`prices | keys | join(",")`, "a,b"},
+		{`prices | values | first`, 1.0},
+		{`nums | sort | join("")`, "123"},
+		{`tags | uniq | reverse | join(",")`, "templates,html,go"},
+		{`tags | last`, "templates"},
+		{`[] | first`, nil},
+		{`tags | slice(1, 3) | join(",")`, "html,go"},
+		{`"socks" | slice(1)`, "ocks"},
+		{`min(3, 1, 2)`, 1},
+		{`max(1, 2.5)`, 2.5},
+		{`abs(-3.0) + abs(-1.5)`, 4.5}, {`abs(-3)`, 3},
+		{`round(2.345, 2)`, 2.35},
+		{`floor(2.7) + ceil(2.1)`, 5.0},
+		{`format("%s has %d tags", "post", tags | length)`, "post has 4 tags"},
+		{`formatNumber(1234567.891, 2)`, "1,234,567.89"},
+		{`formatNumber(-999)`, "-999"},
+		{`date | formatDate("2006-01-02")`, "2024-03-09"},
+	}
+
+	for i, set := range sets {
+		result, err := runExpression(set.expr, env)
+		if err != nil {
+			t.Errorf("unexpected error for set %d: %v", i, err)
+			continue
+		}
+		if !reflect.DeepEqual(result, set.expect) {
+			t.Errorf("set %d: expected %v (%T), got %v (%T)", i, set.expect, set.expect, result, result)
+		}
+	}
+}
+
+func TestStandardLibraryErrors(t *testing.T) {
+	sets := []struct {
+		expr string
+		err  string
+	}{
+		{`upper(1)`, "debug.html:1:6: can't cast int to string"},
+		{`[1, "a"] | sort`, "debug.html:1:12: can't cast int to string"},
+		{`[1, 2] | slice(1, 5)`, "debug.html:1:10: slice bounds [1:5] out of range with length 2"},
+		{`formatDate("today", "2006")`, "debug.html:1:11: can't cast string to time.Time"},
+		{`max()`, "debug.html:1:4: max expects at least one argument"},
+	}
+
+	for i, set := range sets {
+		_, err := runExpression(set.expr, nil)
+		if err == nil || err.Error() != set.err {
+			t.Errorf("set %d: expected error %q, got %v", i, set.err, err)
+		}
+	}
+}
@@ -80,14 +80,16 @@ func (t *_tokenizer) tokenize() ([]Token, error) {
 			parens.Push('[')
 		case ']':
 			token.Kind = TokRbrack
-			if parens.IsEmpty() {
-				return nil, t.error("unexpected `]`", t.location())
-			} else if parens.Pop() != '[' {
-				return nil, t.error("unexpected `]`, as it closes `(`", t.location())
+			if err := t.closeParen(&parens, '['); err != nil {
+				return nil, err
 			}
+		case '{':
+			token.Kind = TokLbrace
+			parens.Push('{')
 		case '}':
-			if t.nextRune() == '}' {
-				return tokens, nil
+			token.Kind = TokRbrace
+			if err := t.closeParen(&parens, '{'); err != nil {
+				return nil, err
 			}
 		case '@':
 			token.Kind = TokAt
@@ -150,8 +152,8 @@ func (t *_tokenizer) tokenize() ([]Token, error) {
 			parens.Push('(')
 		case ')':
 			token.Kind = TokRparen
-			if parens.Pop() != '(' {
-				return nil, t.error("unexpected `)`, as it closes `[`", t.location())
+			if err := t.closeParen(&parens, '('); err != nil {
+				return nil, err
 			}
 		case '&':
 			if t.nextRune() == '&' {
@@ -164,6 +166,8 @@ func (t *_tokenizer) tokenize() ([]Token, error) {
 				token.Kind = TokOr
 				token.Literal = "||"
 				t.forward()
+			} else {
+				token.Kind = TokPipe
 			}
 		case '=':
 			if t.nextRune() == '=' {
@@ -218,6 +222,17 @@ func (t *_tokenizer) tokenize() ([]Token, error) {
 	return tokens, nil
 }
 
+// closeParen pops the innermost open paren, which is expected to be the opening counterpart of the current rune.
+func (t *_tokenizer) closeParen(parens *helpers.Stack[rune], opening rune) error {
+	if parens.IsEmpty() {
+		return t.error(fmt.Sprintf("unexpected `%c`", t.rune()), t.location())
+	}
+	if open := parens.Pop(); open != opening {
+		return t.error(fmt.Sprintf("unexpected `%c`, as it closes `%c`", t.rune(), open), t.location())
+	}
+	return nil
+}
+
 func (t *_tokenizer) numeric() (token Token, err error) {
 	token.Location = t.location()
 
@@ -271,7 +286,7 @@ func (t *_tokenizer) numeric() (token Token, err error) {
 }
 
 func (t *_tokenizer) location() helpers.Location {
-	return helpers.Location{t.blockLocation.File, t.line, t.column, 1}
+	return helpers.Location{Line: t.line, Column: t.column, Length: 1}.WithBase(t.blockLocation)
 }
 
 func (t *_tokenizer) skipWhitespace() {
@@ -22,6 +22,8 @@ const (
 	TokRparen
 	TokLbrack
 	TokRbrack
+	TokLbrace
+	TokRbrace
 	TokLt
 	TokGt
 	TokEq
@@ -46,6 +48,7 @@ const (
 	TokFalse
 	TokAnd
 	TokOr
+	TokPipe
 	TokWith
 	TokNil
 )
@@ -62,6 +65,8 @@ var TokenKinds = []string{
 	"rparen",
 	"lbrack",
 	"rbrack",
+	"lbrace",
+	"rbrace",
 	"lt",
 	"gt",
 	"eq",
@@ -86,6 +91,7 @@ var TokenKinds = []string{
 	"false",
 	"and",
 	"or",
+	"pipe",
 	"with",
 	"nil",
 }
@@ -1,220 +1,401 @@
 package expression
 
 import (
+	"context"
 	"fmt"
 	errors2 "github.com/terawatthour/socks/errors"
 	"github.com/terawatthour/socks/internal/helpers"
 	"reflect"
+	"strings"
+	"sync"
 )
 
+// VM executes a compiled Program. It holds no execution state of its own, so a single VM
+// may be run from many goroutines at once; each run gets its own Frame.
 type VM struct {
-	program      Program
+	program Program
+}
+
+// Frame holds the state of a single VM execution.
+type Frame struct {
+	program      *Program
 	stack        helpers.Stack[any]
 	ip           int
 	currentError error
+
+	// ctx is passed to called functions taking a context.Context, it's kept across runs
+	ctx context.Context
+
+	// callCtx is ctx carrying the callSettings read by builtins, built on the first call after a change
+	callCtx context.Context
+
+	// lengthLimit limits the length of lists built by builtins such as range, zero means no limit
+	lengthLimit int
+
+	// instructions executed across runs since the last SetInstructionLimit, zero limit means no limit
+	executed         int
+	instructionLimit int
+
+	// sandbox restricts the reflection access of the following runs, nil means no restrictions
+	sandbox *Sandbox
+
+	// taggedFields names struct fields by their `socks` and `json` tags
+	taggedFields bool
+}
+
+var framePool = sync.Pool{
+	New: func() any {
+		return NewFrame()
+	},
+}
+
+// NewFrame returns an empty frame. Frames may be reused across runs, but not concurrently.
+func NewFrame() *Frame {
+	return &Frame{stack: make(helpers.Stack[any], 0, 16)}
+}
+
+func (f *Frame) reset() {
+	clear(f.stack)
+	f.stack = f.stack[:0]
+	f.program = nil
+	f.ip = 0
+	f.currentError = nil
+}
+
+// SetContext sets the context passed to functions called by the following runs of the frame.
+func (f *Frame) SetContext(ctx context.Context) {
+	f.ctx = ctx
+	f.callCtx = nil
+}
+
+// SetLengthLimit limits the length of lists built by builtins such as range in the following runs of the frame,
+// so that they fail before allocating them. Zero means no limit.
+func (f *Frame) SetLengthLimit(limit int) {
+	f.lengthLimit = limit
+	f.callCtx = nil
+}
+
+// SetInstructionLimit limits the number of instructions executed by the following runs of the frame in total.
+// Zero means no limit.
+func (f *Frame) SetInstructionLimit(limit int) {
+	f.instructionLimit = limit
+	f.executed = 0
+}
+
+// SetSandbox restricts the reflection access of the following runs of the frame, nil lifts the restrictions.
+func (f *Frame) SetSandbox(sandbox *Sandbox) {
+	f.sandbox = sandbox
+	f.callCtx = nil
+}
+
+// SetTaggedFields makes the following runs of the frame name struct fields by their `socks` tags,
+// falling back to their `json` tags and their Go names.
+func (f *Frame) SetTaggedFields(tagged bool) {
+	f.taggedFields = tagged
+	f.callCtx = nil
 }
 
 func NewVM(program Program) *VM {
 	return &VM{
 		program: program,
-		stack:   []any{},
 	}
 }
 
+// Run executes the program with a frame taken from the shared pool.
 func (vm *VM) Run(env map[string]any) (any, error) {
 	if vm == nil {
 		return nil, nil
 	}
 
+	frame := framePool.Get().(*Frame)
+	defer framePool.Put(frame)
+
+	return vm.RunFrame(frame, env)
+}
+
+// RunFrame executes the program using the caller provided frame.
+func (vm *VM) RunFrame(frame *Frame, env map[string]any) (any, error) {
+	if vm == nil {
+		return nil, nil
+	}
+
+	frame.reset()
+	frame.program = &vm.program
+
+	// the frame is left as it is when the run panics, so that Interrupted can tell where it happened
+	result, err := frame.run(env)
+	frame.reset()
+
+	return result, err
+}
+
+// Source returns the expression the program of vm was compiled from.
+func (vm *VM) Source() string {
+	return vm.program.Source
+}
+
+// Location returns the location of the expression the program of vm was compiled from.
+func (vm *VM) Location() helpers.Location {
+	return vm.program.Location
+}
+
+// Interrupted reports whether the last run of the frame was interrupted by a panic, returning
+// the location of the instruction being executed and the source of its program.
+func (f *Frame) Interrupted() (helpers.Location, string, bool) {
+	if f.program == nil {
+		return helpers.Location{}, "", false
+	}
+
+	return f.location(), f.program.Source, true
+}
+
+func (f *Frame) run(env map[string]any) (any, error) {
 outerLoop:
-	for vm.ip = 0; vm.ip < len(vm.program.Instructions); vm.ip++ {
-		vm.currentError = nil
-		switch vm.program.Instructions[vm.ip] {
+	for f.ip = 0; f.ip < len(f.program.Instructions); f.ip++ {
+		f.currentError = nil
+		if f.instructionLimit > 0 {
+			if f.executed++; f.executed > f.instructionLimit {
+				return nil, errors2.LimitExceeded(fmt.Sprintf("%d instructions", f.instructionLimit), f.location())
+			}
+		}
+
+		switch f.program.Instructions[f.ip] {
 		case OpChain:
-			object := vm.stack.Pop()
+			object := f.stack.Pop()
 			if object == nil {
-				return nil, vm.error("can't access properties of <nil>", vm.program.Lookups[vm.ip].Location())
+				return nil, f.error("can't access properties of <nil>", f.program.Lookups[f.ip].Location())
 			}
-			property := vm.program.Constants[vm.takeNext()].(string)
-			vm.stack.Push(vm.accessProperty(object, property))
+			lookup := f.program.Lookups[f.ip]
+			property := f.program.Constants[f.takeNext()].(string)
+			if f.sandbox == nil {
+				f.stack.Push(f.accessProperty(object, property))
+				break
+			}
+
+			result, err := f.sandbox.access(object, property, f.taggedFields)
+			if err != nil {
+				return nil, f.error(err.Error(), lookup.Location())
+			}
+			f.stack.Push(result)
 		case OpOptionalChain:
-			object := vm.stack.Pop()
+			object := f.stack.Pop()
 			if object == nil {
-				vm.stack.Push(nil)
-				vm.ip += vm.nextInstruction()
+				f.stack.Push(nil)
+				f.ip += f.nextInstruction()
 			} else {
-				vm.stack.Push(object)
-				vm.ip++
+				f.stack.Push(object)
+				f.ip++
 			}
 		case OpElvis:
-			left := vm.stack.Pop()
+			left := f.stack.Pop()
 			if left != nil {
-				vm.stack.Push(left)
-				vm.ip += vm.nextInstruction()
+				f.stack.Push(left)
+				f.ip += f.nextInstruction()
 			} else {
-				vm.ip++
+				f.ip++
 			}
 		case OpTernary:
-			condition := vm.stack.Pop()
+			condition := f.stack.Pop()
 			if CastToBool(condition) {
-				vm.ip++
+				f.ip++
 			} else {
-				vm.ip += vm.nextInstruction()
+				f.ip += f.nextInstruction()
 			}
 		case OpPop:
-			vm.stack.Pop()
+			f.stack.Pop()
 		case OpJmp:
-			vm.ip += vm.nextInstruction()
+			f.ip += f.nextInstruction()
 		case OpPropertyAccess:
-			_index := vm.stack.Pop()
-			_value := vm.stack.Pop()
+			_index := f.stack.Pop()
+			_value := f.stack.Pop()
 			value := reflect.ValueOf(_value)
-			lookup := vm.program.Lookups[vm.ip].(*FieldAccess)
+			lookup := f.program.Lookups[f.ip].(*FieldAccess)
+			if value.Kind() == reflect.Pointer && value.Type().Elem().Kind() == reflect.Struct {
+				if value.IsNil() {
+					f.stack.Push(nil)
+					break
+				}
+				value = value.Elem()
+			}
+
 			switch value.Kind() {
 			case reflect.Array, reflect.Slice:
 				result := castInt(_index)
 				if err, ok := result.(error); ok {
-					return nil, vm.error("forbidden array index access, "+err.Error(), lookup.Index.Location())
+					return nil, f.error("forbidden array index access, "+err.Error(), lookup.Index.Location())
+				}
+				index := result.(int)
+				if index < 0 || index >= value.Len() {
+					return nil, f.error(fmt.Sprintf("index %d out of range with length %d", index, value.Len()), lookup.Index.Location())
 				}
-				vm.stack.Push(value.Index(result.(int)).Interface())
+				f.stack.Push(value.Index(index).Interface())
 			case reflect.Map:
-				vm.stack.Push(value.MapIndex(reflect.ValueOf(_index)).Interface())
+				f.stack.Push(mapIndex(value, _index))
 			case reflect.Struct:
 				index, ok := _index.(string)
 				if !ok {
-					return nil, vm.error(fmt.Sprintf("struct field accessor must be of type string, got %T", _index), lookup.Index.Location())
+					return nil, f.error(fmt.Sprintf("struct field accessor must be of type string, got %T", _index), lookup.Index.Location())
+				}
+				if f.sandbox == nil {
+					field, _ := f.structField(value, index)
+					f.stack.Push(field)
+					break
 				}
-				vm.stack.Push(value.FieldByName(index).Interface())
+
+				result, err := f.sandbox.access(_value, index, f.taggedFields)
+				if err != nil {
+					return nil, f.error(err.Error(), lookup.Index.Location())
+				}
+				f.stack.Push(result)
 			default:
-				return nil, vm.error(fmt.Sprintf("forbidden access of properties of %T", _value), lookup.Location())
+				return nil, f.error(fmt.Sprintf("forbidden access of properties of %T", _value), lookup.Location())
 			}
 		case OpArray:
-			count := vm.program.Instructions[vm.ip+1]
+			count := f.program.Instructions[f.ip+1]
 			items := make([]any, count)
 			for j := 0; j < count; j++ {
-				items[count-j-1] = vm.stack.Pop()
+				items[count-j-1] = f.stack.Pop()
+			}
+			f.stack.Push(items)
+			f.ip++
+		case OpMap:
+			count := f.takeNext()
+			entries := make(map[string]any, count)
+			for j := 0; j < count; j++ {
+				value := f.stack.Pop()
+				entries[f.stack.Pop().(string)] = value
 			}
-			vm.stack.Push(items)
-			vm.ip++
+			f.stack.Push(entries)
 
 		case OpCall:
-			argumentCount := vm.takeNext()
+			argumentCount := f.takeNext()
 
-			args := make([]reflect.Value, argumentCount)
+			args := make([]any, argumentCount)
 			for j := argumentCount - 1; j >= 0; j-- {
-				args[j] = reflect.ValueOf(vm.stack.Pop())
+				args[j] = f.stack.Pop()
 			}
 
-			fn := vm.stack.Pop()
-			reflectedFunction := reflect.ValueOf(fn)
-			if !reflectedFunction.IsValid() || reflectedFunction.Kind() != reflect.Func {
-				vm.currentError = vm.error(fmt.Sprintf("can't call %T", fn), vm.program.Lookups[vm.ip-1].(*FunctionCall).Location())
+			result, err := f.call(f.stack.Pop(), args)
+			if err != nil {
+				// the error returned by the function is kept, e.g. so that a cancelled context can be recognized
+				f.currentError = errors2.Wrap(err, f.program.Lookups[f.ip-1].(*FunctionCall).Location())
 				break
 			}
-			results := reflectedFunction.Call(args)
-			if len(results) == 1 {
-				result := results[0].Interface()
-				switch result := result.(type) {
-				case *castError:
-					vm.currentError = vm.error(result.Error(), vm.program.Lookups[vm.ip-1].(*FunctionCall).Location())
-				default:
-					vm.stack.Push(result)
-				}
-			} else if len(results) > 1 {
-				vm.stack.Push(reflectedSliceToInterfaceSlice(results))
-			}
+			f.stack.Push(result)
 		case OpGet:
-			ident := vm.program.Constants[vm.takeNext()].(string)
-			if env[ident] != nil {
-				vm.stack.Push(env[ident])
-			} else if f, ok := builtinsOne[ident]; ok {
-				vm.stack.Push(f)
+			f.stack.Push(env[f.program.Constants[f.takeNext()].(string)])
+		case OpGetFunction:
+			ident := f.program.Constants[f.takeNext()].(string)
+			if value, ok := env[ident]; ok {
+				f.stack.Push(value)
 			} else {
-				vm.stack.Push(nil)
+				// nil is pushed for unknown functions, so that the call reports it can't call <nil>
+				f.stack.Push(builtinsOne[ident])
 			}
 		case OpConstant:
-			vm.stack.Push(vm.program.Constants[vm.takeNext()])
+			f.stack.Push(f.program.Constants[f.takeNext()])
 		case OpIn:
-			right := vm.stack.Pop()
-			left := vm.stack.Pop()
+			right := f.stack.Pop()
+			left := f.stack.Pop()
 
-			for i := 0; i < reflect.ValueOf(right).Len(); i++ {
-				if reflect.ValueOf(right).Index(i).Interface() == left {
-					vm.stack.Push(true)
+			container := reflect.ValueOf(right)
+			switch container.Kind() {
+			case reflect.String:
+				// strings are checked for the substring, other values are never in them
+				needle, ok := left.(string)
+				f.stack.Push(ok && strings.Contains(container.String(), needle))
+				continue outerLoop
+			case reflect.Map:
+				// maps are checked for the key, keys of other types can't be in them
+				key, ok := convertArgument(left, container.Type().Key())
+				f.stack.Push(ok && container.MapIndex(key).IsValid())
+				continue outerLoop
+			case reflect.Slice, reflect.Array:
+			default:
+				return nil, f.error(fmt.Sprintf("can't check membership in %T", right), f.location())
+			}
+
+			for i := 0; i < container.Len(); i++ {
+				if container.Index(i).Interface() == left {
+					f.stack.Push(true)
 					continue outerLoop
 				}
 			}
-			vm.stack.Push(false)
+			f.stack.Push(false)
 		case OpNil:
-			vm.stack.Push(nil)
+			f.stack.Push(nil)
 		case OpEq:
-			left := vm.stack.Pop()
-			right := vm.stack.Pop()
-			vm.stack.Push(left == right)
+			left := f.stack.Pop()
+			right := f.stack.Pop()
+			f.stack.Push(left == right)
 		case OpNegate:
-			vm.stack.Push(negate(vm.stack.Pop()))
+			result := negate(f.stack.Pop())
+			if err, ok := result.(error); ok {
+				return nil, f.error(err.Error(), f.location())
+			}
+			f.stack.Push(result)
 		case OpNeq:
-			right := vm.stack.Pop()
-			left := vm.stack.Pop()
-			vm.stack.Push(left != right)
+			right := f.stack.Pop()
+			left := f.stack.Pop()
+			f.stack.Push(left != right)
 		case OpNot:
-			vm.stack.Push(!CastToBool(vm.stack.Pop()))
+			f.stack.Push(!CastToBool(f.stack.Pop()))
 		case OpAdd:
-			vm.executeInfixExpression(operationAddition)
+			f.executeInfixExpression(operationAddition)
 		case OpLt:
-			vm.executeInfixExpression(operationLess)
+			f.executeInfixExpression(operationLess)
 		case OpGt:
-			vm.executeInfixExpression(operationGreater)
+			f.executeInfixExpression(operationGreater)
 		case OpGte:
-			vm.executeInfixExpression(operationGreaterEqual)
+			f.executeInfixExpression(operationGreaterEqual)
 		case OpLte:
-			vm.executeInfixExpression(operationLessEqual)
+			f.executeInfixExpression(operationLessEqual)
 		case OpSubtract:
-			vm.executeInfixExpression(operationSubtraction)
+			f.executeInfixExpression(operationSubtraction)
 		case OpMultiply:
-			vm.executeInfixExpression(operationMultiplication)
+			f.executeInfixExpression(operationMultiplication)
 		case OpDivide:
-			vm.executeInfixExpression(operationDivision)
+			f.executeInfixExpression(operationDivision)
 		case OpModulo:
-			vm.executeInfixExpression(operationModulus)
+			f.executeInfixExpression(operationModulus)
 		case OpPower:
-			vm.executeInfixExpression(operationExponentiation)
+			f.executeInfixExpression(operationExponentiation)
 		case OpAnd:
-			vm.executeInfixExpression(and)
+			f.executeInfixExpression(and)
 		case OpOr:
-			vm.executeInfixExpression(or)
+			f.executeInfixExpression(or)
 		default:
 			panic("unreachable")
 		}
-		if vm.currentError != nil {
-			return nil, vm.currentError
+		if f.currentError != nil {
+			return nil, f.currentError
 		}
 
 	}
 
-	if len(vm.stack) == 0 {
-		return nil, vm.error("expression does not return a value", vm.program.Lookups[0].Location())
+	if len(f.stack) == 0 {
+		return nil, f.error("expression does not return a value", f.program.Location)
 	}
 
-	if len(vm.stack) != 1 {
-		return nil, vm.error("expression returns multiple values", vm.program.Lookups[0].Location())
+	if len(f.stack) != 1 {
+		return nil, f.error("expression returns multiple values", f.program.Location)
 	}
 
-	return vm.stack.Pop(), nil
+	return f.stack.Pop(), nil
 }
 
-func (vm *VM) executeInfixExpression(fn func(any, any) any) {
-	right := vm.stack.Pop()
-	left := vm.stack.Pop()
+func (f *Frame) executeInfixExpression(fn func(any, any) any) {
+	right := f.stack.Pop()
+	left := f.stack.Pop()
 	res := fn(left, right)
 	if general, ok := res.(error); ok {
-		vm.currentError = vm.error(general.Error(), vm.program.Lookups[vm.ip].Location())
+		f.currentError = f.error(general.Error(), f.program.Lookups[f.ip].Location())
 		return
 	}
-	vm.stack.Push(res)
+	f.stack.Push(res)
 }
 
-func (vm *VM) accessProperty(base any, property string) any {
+func (f *Frame) accessProperty(base any, property string) any {
 	value := reflect.ValueOf(base)
 	if !value.IsValid() {
 		return nil
@@ -223,23 +404,25 @@ func (vm *VM) accessProperty(base any, property string) any {
 	var reflected reflect.Value
 	switch value.Kind() {
 	case reflect.Map:
-		reflected = value.MapIndex(reflect.ValueOf(property))
+		return mapIndex(value, property)
 	case reflect.Struct:
-		reflected = value.FieldByName(property)
-		if !reflected.IsValid() {
-			reflected = value.MethodByName(property)
+		if field, ok := f.structField(value, property); ok {
+			return field
 		}
+		reflected = value.MethodByName(property)
 	case reflect.Pointer:
+		if value.IsNil() {
+			return nil
+		}
 		if value.Elem().Kind() == reflect.Struct {
-			reflected = value.Elem().FieldByName(property)
-			if !reflected.IsValid() {
-				reflected = value.MethodByName(property)
+			if field, ok := f.structField(value.Elem(), property); ok {
+				return field
 			}
-			if reflected.IsValid() {
-				return reflected.Interface()
+			if method := value.MethodByName(property); method.IsValid() {
+				return method.Interface()
 			}
 		}
-		return vm.accessProperty(value.Elem().Interface(), property)
+		return f.accessProperty(value.Elem().Interface(), property)
 	default:
 		reflected = value.MethodByName(property)
 		if reflected.IsValid() {
@@ -259,16 +442,85 @@ func (vm *VM) accessProperty(base any, property string) any {
 	return reflected.Interface()
 }
 
-func (vm *VM) takeNext() int {
-	vm.ip++
-	return vm.program.Instructions[vm.ip]
+// structField returns the field of the struct value named property, by its tags if tagged field names are enabled.
+func (f *Frame) structField(value reflect.Value, property string) (any, bool) {
+	if f.taggedFields {
+		return fieldsOf(value.Type(), true).field(value, property)
+	}
+
+	field := value.FieldByName(property)
+	if !field.IsValid() {
+		return nil, false
+	}
+	return field.Interface(), true
+}
+
+// call calls a registered Function or any other Go function, checking the arguments against its signature.
+func (f *Frame) call(fn any, args []any) (any, error) {
+	ctx := f.callContext()
+
+	if function, ok := fn.(*Function); ok {
+		return function.signature.call(ctx, function.fn, args)
+	}
+
+	reflectedFunction := reflect.ValueOf(fn)
+	if !reflectedFunction.IsValid() || reflectedFunction.Kind() != reflect.Func || reflectedFunction.IsNil() {
+		return nil, fmt.Errorf("can't call %T", fn)
+	}
+
+	return signatureOf(reflectedFunction.Type()).call(ctx, reflectedFunction, args)
+}
+
+// callContext returns the context passed to called functions.
+func (f *Frame) callContext() context.Context {
+	if f.callCtx == nil {
+		f.callCtx = f.ctx
+		if f.callCtx == nil {
+			f.callCtx = context.Background()
+		}
+		if f.lengthLimit > 0 || f.sandbox != nil {
+			settings := callSettings{lengthLimit: f.lengthLimit, sandbox: f.sandbox, taggedFields: f.taggedFields}
+			f.callCtx = context.WithValue(f.callCtx, callSettingsKey{}, settings)
+		}
+	}
+	return f.callCtx
+}
+
+// location returns the location of the expression compiled to the current instruction, or
+// the closest one before it, as not every instruction has one.
+func (f *Frame) location() helpers.Location {
+	for i := min(f.ip, len(f.program.Lookups)-1); i >= 0; i-- {
+		if f.program.Lookups[i] != nil {
+			return f.program.Lookups[i].Location()
+		}
+	}
+	return f.program.Location
+}
+
+// mapIndex returns the value stored under key, or nil if there's none or key can't be a key of the map.
+func mapIndex(m reflect.Value, key any) any {
+	k, ok := convertArgument(key, m.Type().Key())
+	if !ok {
+		return nil
+	}
+
+	value := m.MapIndex(k)
+	if !value.IsValid() {
+		return nil
+	}
+	return value.Interface()
+}
+
+func (f *Frame) takeNext() int {
+	f.ip++
+	return f.program.Instructions[f.ip]
 }
 
-func (vm *VM) nextInstruction() int {
-	return vm.program.Instructions[vm.ip+1]
+func (f *Frame) nextInstruction() int {
+	return f.program.Instructions[f.ip+1]
 }
 
-func (vm *VM) error(message string, location helpers.Location) error {
+func (f *Frame) error(message string, location helpers.Location) error {
 	return errors2.New(message, location)
 }
 
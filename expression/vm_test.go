@@ -3,6 +3,7 @@ package expression
 import (
 	"fmt"
 	"github.com/terawatthour/socks/internal/helpers"
+	"slices"
 	"testing"
 )
 
@@ -43,6 +44,21 @@ func TestVM_Run(t *testing.T) {
 		}, {
 			`not "str" in [false]`,
 			true,
+		}, {
+			`"a" in { a: nil }`,
+			true,
+		}, {
+			`"b" in { a: 1 }`,
+			false,
+		}, {
+			`1 in { a: 1 }`,
+			false,
+		}, {
+			`"ock" in "socks"`,
+			true,
+		}, {
+			`1 in "123"`,
+			false,
 		}, {
 			`base.structure.Method(123.4) + base.structure.ReceiverMethod() + someInt.Method()`,
 			`the ratio is 123.4 non-pointer method value of SomeInt is 123`,
@@ -55,6 +71,39 @@ func TestVM_Run(t *testing.T) {
 		}, {
 			"range(1, 2, 1)[0]",
 			1,
+		}, {
+			"length(range(0, 10, 3)) + range(5, 0, -2)[2]",
+			5,
+		}, {
+			`{ name: "socks", "version": 1 + 1 }.version`,
+			2,
+		}, {
+			`{ nested: { value: ordinals[1] } }["nested"].value`,
+			"2nd",
+		}, {
+			"length({ a: 1, b: [2, 3] }) + length([])",
+			2,
+		}, {
+			`"%d of %s" | sprintf(1 + 1, ordinals | length)`,
+			"2 of %!s(int=2)",
+		}, {
+			`(ordinals[0] | sprintf | length) == 3 ? "short" : "long"`,
+			"short",
+		}, {
+			`base["missing"] ?: base.missing ?: "none"`,
+			"none",
+		}, {
+			"title",
+			nil,
+		}, {
+			`title ?: first ?: "none"`,
+			"none",
+		}, {
+			"not first",
+			true,
+		}, {
+			`"socks" | upper`,
+			"SOCKS",
 		}}
 
 	for i, set := range sets {
@@ -84,6 +133,7 @@ func TestVM_Run(t *testing.T) {
 			},
 			"someInt": SomeInt(123),
 			"sprintf": fmt.Sprintf,
+			"title":   nil,
 		})
 		if err != nil {
 			t.Errorf("unexpected error for set %d: %v", i, err)
@@ -97,6 +147,60 @@ func TestVM_Run(t *testing.T) {
 	}
 }
 
+func TestPipeErrors(t *testing.T) {
+	tokens, err := Tokenize(`ordinals | length | missing(1)`, helpers.Location{File: "debug.html", Line: 1, Column: 1})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expr, err := Parse(tokens)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	program, err := NewCompiler(expr.Expr).Compile()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	_, err = NewVM(program).Run(map[string]any{"ordinals": []string{"1st"}})
+	if err == nil || err.Error() != "debug.html:1:21: can't call <nil>" {
+		t.Errorf("expected error located at the failing filter, got %v", err)
+	}
+
+	if !slices.Equal(expr.Dependencies, []string{"ordinals", "missing"}) {
+		t.Errorf("expected filters to be dependencies, got %v", expr.Dependencies)
+	}
+}
+
+func TestArgumentOverflow(t *testing.T) {
+	env := map[string]any{
+		"small": func(n int8) int8 { return n },
+		"count": func(n uint) uint { return n },
+		"ratio": func(f float32) float32 { return f },
+		"big":   1e300,
+	}
+
+	result, err := runExpression(`small(-128) + small(127)`, env)
+	if err != nil || result != int8(-1) {
+		t.Errorf("expected arguments in range to be converted, got %v (%v)", result, err)
+	}
+
+	sets := []struct {
+		expr string
+		err  string
+	}{
+		{`small(300)`, "debug.html:1:6: argument 1: 300 overflows int8"},
+		{`count(-1)`, "debug.html:1:6: argument 1: -1 overflows uint"},
+		{`ratio(big)`, "debug.html:1:6: argument 1: 1e+300 overflows float32"},
+	}
+
+	for i, set := range sets {
+		_, err := runExpression(set.expr, env)
+		if err == nil || err.Error() != set.err {
+			t.Errorf("set %d: expected error %q, got %v", i, set.err, err)
+		}
+	}
+}
+
 //func TestVM_Errors(t *testing.T) {
 //	sets := []struct {
 //		expr string
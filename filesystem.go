@@ -1,87 +1,574 @@
 package socks
 
 import (
+	stderrors "errors"
 	"fmt"
+	"github.com/terawatthour/socks/internal/helpers"
 	"github.com/terawatthour/socks/runtime"
 	"io"
+	"io/fs"
+	"maps"
 	"os"
+	"path"
 	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
 )
 
 type fileSystem struct {
-	options     *Options
-	templates   map[string]*runtime.Evaluator
+	options *Options
+
+	// mu guards templates, which is read by every execution and swapped on reload, contents, rejected and preprocessor
+	mu        sync.RWMutex
+	templates map[string]*runtime.Evaluator
+	contents  map[string]string
+
+	// rejected are the contents of files whose last compilation failed, which aren't being served
+	rejected map[string]string
+
 	files       map[string]io.Reader
-	fileHandles map[string]*os.File
+	fileHandles map[string]io.Closer
+
+	// state kept after compilation so that changed files can be recompiled
+	preprocessor *Preprocessor
+	sources      map[string]*templateSource
+	patterns     []templatePattern
+
+	// pending are the files whose changes failed to reload, they're compiled again with the next changed files
+	pending map[string]bool
+}
+
+// templateSource describes where a template was loaded from. Templates loaded
+// from a reader have no source and can't be reloaded.
+type templateSource struct {
+	fsys    fs.FS
+	path    string
+	modTime time.Time
+}
+
+// templatePattern is a glob passed to one of the loading methods. fsys is nil for the host filesystem.
+type templatePattern struct {
+	fsys    fs.FS
+	pattern string
+}
+
+// hostFS opens paths on the host filesystem as they are, including absolute ones.
+type hostFS struct{}
+
+func (hostFS) Open(name string) (fs.File, error) {
+	return os.Open(name)
 }
 
 func newFileSystem(options *Options) *fileSystem {
 	return &fileSystem{
 		options:     options,
 		templates:   make(map[string]*runtime.Evaluator),
+		contents:    make(map[string]string),
+		rejected:    make(map[string]string),
 		files:       make(map[string]io.Reader),
-		fileHandles: make(map[string]*os.File),
+		fileHandles: make(map[string]io.Closer),
+		sources:     make(map[string]*templateSource),
+		pending:     make(map[string]bool),
 	}
 }
 
+func (fs *fileSystem) template(name string) (*runtime.Evaluator, bool) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	eval, ok := fs.templates[name]
+	return eval, ok
+}
+
+func (fs *fileSystem) allTemplates() map[string]*runtime.Evaluator {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	return fs.templates
+}
+
+// sourceContents returns the contents of the compiled template files, used for error reports. Errors of
+// compilations are reported with the contents that failed to compile instead of the ones being served.
+func (fs *fileSystem) sourceContents(compilation bool) map[string]string {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	if !compilation || len(fs.rejected) == 0 {
+		return fs.contents
+	}
+
+	contents := maps.Clone(fs.contents)
+	maps.Copy(contents, fs.rejected)
+	return contents
+}
+
 func (fs *fileSystem) preprocessTemplates(ctx runtime.Context) error {
-	preprocessed, err := Preprocess(fs.files, ctx, fs.options.Sanitizer)
+	defer fs.closeFiles()
+
+	contents, err := readFiles(fs.files)
+	if err != nil {
+		return err
+	}
+
+	// the static context may have changed, so only the parsed files and the dependency graph are carried over
+	p := newPreprocessor(make(map[string][]runtime.Statement), ctx, fs.options.Sanitizer)
+	if fs.options.Limits != nil {
+		// compilation isn't bounded in time, the other limits keep the static evaluation in check
+		p.limits = *fs.options.Limits
+		p.limits.Timeout = 0
+	}
+	p.sandbox = fs.options.Sandbox
+	p.taggedFields = fs.options.TaggedFields
+	if fs.preprocessor != nil {
+		p.files = maps.Clone(fs.preprocessor.files)
+		p.graph = fs.preprocessor.graph.clone()
+	}
+
+	return fs.compileContents(p, contents)
+}
+
+// reload checks all loaded sources and patterns for changes and recompiles the changed files
+// together with the templates depending on them. It returns the list of recompiled files. Files that
+// fail to load or compile are reported in the returned error without keeping the other files from
+// reloading, and sources that were removed are dropped.
+func (fs *fileSystem) reload() ([]string, error) {
+	var errs []error
+	for _, pattern := range fs.patterns {
+		if err := fs.loadPattern(pattern, true); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	for filename, source := range fs.sources {
+		if _, ok := fs.files[filename]; ok {
+			continue
+		}
+
+		st, err := statSource(source)
+		if stderrors.Is(err, os.ErrNotExist) {
+			// the compiled template is kept, a file created at the same path is picked up by its pattern
+			delete(fs.sources, filename)
+			continue
+		} else if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if st.ModTime().Equal(source.modTime) {
+			continue
+		}
+
+		if err := fs.openSource(filename, source); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if len(fs.files) == 0 {
+		return nil, stderrors.Join(errs...)
+	}
+
+	// files that failed to compile before are compiled again with the changed ones, which may fix them
+	for filename := range fs.pending {
+		source, ok := fs.sources[filename]
+		if !ok {
+			delete(fs.pending, filename)
+			continue
+		}
+		if _, ok := fs.files[filename]; ok {
+			continue
+		}
+		if err := fs.openSource(filename, source); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	reloaded, err := fs.reloadFiles()
+	if err != nil {
+		errs = append(errs, err)
+	}
+	return reloaded, stderrors.Join(errs...)
+}
+
+// reloadFiles recompiles the opened files and returns the reloaded ones. If they fail to compile together,
+// they're compiled one by one for as long as any of them succeeds, so that a broken file doesn't keep
+// the other ones from reloading. The files that still fail are kept pending and their errors returned.
+func (fs *fileSystem) reloadFiles() ([]string, error) {
+	defer fs.closeFiles()
+
+	if fs.preprocessor == nil {
+		return nil, fmt.Errorf("templates not compiled")
+	}
+
+	contents, err := readFiles(fs.files)
+	if err != nil {
+		return nil, err
+	}
+
+	remaining := helpers.Keys(contents)
+	slices.Sort(remaining)
+
+	var reloaded []string
+	err = fs.compileContents(fs.preprocessor.clone(), contents)
+	if err == nil {
+		reloaded, remaining = remaining, nil
+	} else if len(remaining) > 1 {
+		for {
+			var failed []string
+			var errs []error
+			for _, filename := range remaining {
+				if err := fs.compileContents(fs.preprocessor.clone(), map[string]string{filename: contents[filename]}); err != nil {
+					failed = append(failed, filename)
+					errs = append(errs, err)
+					continue
+				}
+				reloaded = append(reloaded, filename)
+			}
+
+			err = stderrors.Join(errs...)
+			if len(failed) == len(remaining) {
+				break
+			}
+			remaining = failed
+		}
+	}
+
+	for _, filename := range reloaded {
+		delete(fs.pending, filename)
+	}
+	for _, filename := range remaining {
+		fs.pending[filename] = true
+	}
+	return reloaded, err
+}
+
+// recompilePaths reads the provided files again from their sources and recompiles them
+// together with the templates depending on them.
+func (fs *fileSystem) recompilePaths(paths ...string) error {
+	for _, filename := range paths {
+		source, ok := fs.sources[filename]
+		if !ok {
+			fs.closeFiles()
+			return fmt.Errorf("template `%s` can't be recompiled, as it wasn't loaded from a file", filename)
+		}
+
+		if err := fs.openSource(filename, source); err != nil {
+			fs.closeFiles()
+			return err
+		}
+	}
+
+	return fs.recompileFiles()
+}
+
+// recompileFiles parses the opened files and recompiles them using the preprocessor of the last compilation.
+func (fs *fileSystem) recompileFiles() error {
+	defer fs.closeFiles()
+
+	if fs.preprocessor == nil {
+		return fmt.Errorf("templates not compiled")
+	}
+
+	contents, err := readFiles(fs.files)
+	if err != nil {
+		return err
+	}
+
+	return fs.compileContents(fs.preprocessor.clone(), contents)
+}
+
+// compileContents parses the contents of files and recompiles them with p. The contents are stored as
+// the served ones only once the results are swapped in, otherwise they're kept for error reports.
+func (fs *fileSystem) compileContents(p *Preprocessor, contents map[string]string) error {
+	parsed, err := parseFiles(contents)
+	if err == nil {
+		err = fs.recompile(p, parsed)
+	}
+	fs.storeContents(contents, err == nil)
+
+	return err
+}
+
+// recompile updates p with the freshly parsed files, preprocesses them together with the templates
+// including them and swaps the results in. Nothing is swapped if any of them fails.
+func (fs *fileSystem) recompile(p *Preprocessor, parsed map[string][]runtime.Statement) error {
+	templates := p.update(parsed)
+	for _, filename := range templates {
+		if err := p.preprocess(filename); err != nil {
+			return err
+		}
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.preprocessor = p
+
+	compiled := maps.Clone(fs.templates)
+	for _, filename := range templates {
+		compiled[filename] = fs.newEvaluator(p.preprocessed[filename])
+	}
+	fs.templates = compiled
+
+	return nil
+}
+
+func (fs *fileSystem) newEvaluator(statements []runtime.Statement) *runtime.Evaluator {
+	eval := runtime.NewEvaluator(statements, fs.options.Sanitizer)
+	eval.Repanic = fs.options.Repanic
+	eval.FlushThreshold = fs.options.FlushThreshold
+	eval.Sandbox = fs.options.Sandbox
+	eval.TaggedFields = fs.options.TaggedFields
+	eval.Components = fs.component
+	if fs.options.Limits != nil {
+		eval.Limits = *fs.options.Limits
+	}
+	return eval
+}
+
+// component returns the statements of the compiled template included by a dynamic component under the provided
+// name, which is resolved same as the names of executed templates. The template must match Options.DynamicComponents.
+func (fs *fileSystem) component(name string) ([]runtime.Statement, error) {
+	templates := fs.allTemplates()
+	key := name
+	if _, ok := templates[name]; !ok {
+		var err error
+		if key, err = resolveName(name, helpers.Keys(templates)); err != nil {
+			return nil, err
+		}
+	}
+
+	if pattern := fs.options.DynamicComponents; pattern != "" && !matchSegments(strings.Split(pattern, "/"), strings.Split(key, "/")) {
+		return nil, fmt.Errorf("component `%s` isn't allowed to be included dynamically", key)
+	}
+
+	return templates[key].Statements(), nil
+}
+
+// componentChain returns the chain of components through which template includes file, starting
+// with template and ending with file, or nil if it doesn't include it.
+func (fs *fileSystem) componentChain(template, file string) []string {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	if fs.preprocessor == nil {
+		return nil
+	}
+
+	return fs.preprocessor.graph.path(template, file)
+}
+
+// storeContents keeps the contents of the read files, so that errors, including compilation ones, can be
+// reported with excerpts. Contents that aren't served replace the rejected ones only.
+func (fs *fileSystem) storeContents(contents map[string]string, served bool) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	rejected := maps.Clone(fs.rejected)
+	if served {
+		stored := maps.Clone(fs.contents)
+		maps.Copy(stored, contents)
+		fs.contents = stored
+		maps.DeleteFunc(rejected, func(filename string, _ string) bool {
+			_, ok := contents[filename]
+			return ok
+		})
+	} else {
+		maps.Copy(rejected, contents)
+	}
+	fs.rejected = rejected
+}
+
+// restore replaces all templates with already compiled ones, dropping the state needed for recompilation.
+func (fs *fileSystem) restore(templates map[string]*runtime.Evaluator) {
+	fs.sources = make(map[string]*templateSource)
+	fs.patterns = nil
+	fs.pending = make(map[string]bool)
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.preprocessor = nil
+
+	fs.templates = templates
+	fs.contents = make(map[string]string)
+	fs.rejected = make(map[string]string)
+}
+
+func (fs *fileSystem) openSource(filename string, source *templateSource) error {
+	st, err := statSource(source)
 	if err != nil {
 		return err
 	}
 
-	for path, programs := range preprocessed {
-		fs.templates[path] = runtime.NewEvaluator(programs, fs.options.Sanitizer)
+	file, err := source.fsys.Open(source.path)
+	if err != nil {
+		return err
 	}
 
+	fs.fileHandles[filename] = file
+	fs.files[filename] = file
+	source.modTime = st.ModTime()
+
+	return nil
+}
+
+func (fs *fileSystem) closeFiles() {
 	for _, file := range fs.fileHandles {
 		_ = file.Close()
 	}
 
 	fs.files = make(map[string]io.Reader)
-	fs.fileHandles = make(map[string]*os.File)
+	fs.fileHandles = make(map[string]io.Closer)
+}
 
-	return nil
+func statSource(source *templateSource) (fs.FileInfo, error) {
+	if _, ok := source.fsys.(hostFS); ok {
+		return os.Stat(source.path)
+	}
+	return fs.Stat(source.fsys, source.path)
 }
 
 // loadTemplates opens all files matching the provided globs.
 func (fs *fileSystem) loadTemplates(globs ...string) error {
 	for _, glob := range globs {
-		matchedFiles, err := filepath.Glob(glob)
-		if err != nil {
+		pattern := templatePattern{pattern: glob}
+		if err := fs.loadPattern(pattern, false); err != nil {
 			return err
 		}
+		fs.patterns = append(fs.patterns, pattern)
+	}
+
+	return nil
+}
 
-		if len(matchedFiles) == 0 {
-			return fmt.Errorf("no files found")
+// loadTemplatesFS opens all files of fsys matching the provided patterns. Files are keyed
+// by their slash-separated path inside fsys.
+func (fs *fileSystem) loadTemplatesFS(fsys fs.FS, patterns ...string) error {
+	for _, glob := range patterns {
+		pattern := templatePattern{fsys: fsys, pattern: glob}
+		if err := fs.loadPattern(pattern, false); err != nil {
+			return err
 		}
+		fs.patterns = append(fs.patterns, pattern)
+	}
 
-		for _, path := range matchedFiles {
-			if _, ok := fs.files[path]; ok {
-				continue
-			}
+	return nil
+}
 
-			st, err := os.Stat(path)
-			if err != nil {
-				return err
-			}
-			if st.IsDir() {
-				continue
-			}
+// loadPattern opens all files matching the pattern. With onlyNew set, files that were
+// loaded before are skipped, which is how reload discovers newly created files, and the
+// pattern may match no files. Files failing to open are reported together, after the other ones are opened.
+func (fs *fileSystem) loadPattern(pattern templatePattern, onlyNew bool) error {
+	fsys := pattern.fsys
 
-			file, err := os.OpenFile(path, os.O_RDONLY, 0)
-			if err != nil {
-				return err
-			}
+	var matchedFiles []string
+	var err error
+	if fsys == nil {
+		fsys = hostFS{}
+		matchedFiles, err = filepath.Glob(pattern.pattern)
+	} else {
+		matchedFiles, err = globFS(fsys, pattern.pattern)
+	}
+	if err != nil {
+		return err
+	}
+
+	if len(matchedFiles) == 0 && !onlyNew {
+		return fmt.Errorf("no files found")
+	}
 
-			fs.fileHandles[path] = file
-			fs.files[path] = file
+	var errs []error
+	for _, path := range matchedFiles {
+		key := filepath.ToSlash(path)
+		if _, ok := fs.files[key]; ok {
+			continue
 		}
+		if _, ok := fs.sources[key]; ok && onlyNew {
+			continue
+		}
+
+		file, err := fsys.Open(path)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		st, err := file.Stat()
+		if err != nil {
+			_ = file.Close()
+			errs = append(errs, err)
+			continue
+		}
+		if st.IsDir() {
+			_ = file.Close()
+			continue
+		}
+
+		fs.fileHandles[key] = file
+		fs.files[key] = file
+		fs.sources[key] = &templateSource{fsys: fsys, path: path, modTime: st.ModTime()}
 	}
 
-	return nil
+	return stderrors.Join(errs...)
 }
 
 func (fs *fileSystem) loadTemplate(filename string, content io.ReadCloser) {
 	fs.files[filename] = content
 }
+
+// globFS works like fs.Glob, except that a `**` path segment matches any number of directories.
+func globFS(fsys fs.FS, pattern string) ([]string, error) {
+	if !strings.Contains(pattern, "**") {
+		return fs.Glob(fsys, pattern)
+	}
+
+	if _, err := path.Match(strings.ReplaceAll(pattern, "**", "*"), ""); err != nil {
+		return nil, err
+	}
+
+	segments := strings.Split(pattern, "/")
+	var matches []string
+	err := fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || name == "." {
+			return nil
+		}
+		if matchSegments(segments, strings.Split(name, "/")) {
+			matches = append(matches, name)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return matches, nil
+}
+
+func matchSegments(pattern, name []string) bool {
+	if len(pattern) == 0 {
+		return len(name) == 0
+	}
+
+	if pattern[0] == "**" {
+		for i := 0; i <= len(name); i++ {
+			if matchSegments(pattern[1:], name[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if len(name) == 0 {
+		return false
+	}
+
+	if ok, _ := path.Match(pattern[0], name[0]); !ok {
+		return false
+	}
+
+	return matchSegments(pattern[1:], name[1:])
+}
@@ -2,4 +2,4 @@ module github.com/terawatthour/socks
 
 go 1.21
 
-require golang.org/x/net v0.27.0 // indirect
+require golang.org/x/net v0.27.0
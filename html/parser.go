@@ -2,7 +2,9 @@ package html
 
 import (
 	"fmt"
+	"github.com/terawatthour/socks/errors"
 	"github.com/terawatthour/socks/expression"
+	"github.com/terawatthour/socks/internal/helpers"
 	"github.com/terawatthour/socks/runtime"
 	"io"
 	"regexp"
@@ -10,22 +12,52 @@ import (
 	"strings"
 )
 
-func Parse(file io.Reader) ([]runtime.Statement, error) {
-	elements, err := Tokenize(file)
+// Parse parses the template into statements. The filename is only used for locations.
+func Parse(filename string, file io.Reader) ([]runtime.Statement, error) {
+	elements, err := Tokenize(filename, file)
 	if err != nil {
 		return nil, err
 	}
 
-	return parseBlock(elements)
+	statements, err := parseBlock(elements, true)
+	if err != nil {
+		return nil, err
+	}
+
+	// a template extending a layout consists of the overridden blocks only
+	var extends []runtime.Statement
+	content := 0
+	for _, statement := range statements {
+		if _, ok := statement.(*runtime.Extends); ok {
+			extends = append(extends, statement)
+		} else if isContent(statement) {
+			content++
+		}
+	}
+	if len(extends) > 0 && (len(extends) > 1 || content > 0) {
+		return nil, errors.New("`v-extends` must be the only element of the template", extends[0].Location())
+	}
+
+	return statements, nil
+}
+
+// isContent reports whether the statement is more than whitespace or a comment.
+func isContent(statement runtime.Statement) bool {
+	if t, ok := statement.(*runtime.Text); ok {
+		trimmed := strings.TrimSpace(t.Content)
+		return trimmed != "" && !(strings.HasPrefix(trimmed, "<!--") && strings.HasSuffix(trimmed, "-->"))
+	}
+	return true
 }
 
-func parseBlock(block []Node) ([]runtime.Statement, error) {
+// parseBlock parses the nodes into statements, root is set for the top level of the template.
+func parseBlock(block []Node, root bool) ([]runtime.Statement, error) {
 	var output []runtime.Statement
 	for _, e := range block {
 		switch t := e.(type) {
 		case *Text:
 			if t.IsComment {
-				output = append(output, &runtime.Text{t.Content})
+				output = append(output, &runtime.Text{Content: t.Content, Position: t.Location})
 				continue
 			}
 
@@ -40,7 +72,7 @@ func parseBlock(block []Node) ([]runtime.Statement, error) {
 
 			// conditions are always evaluated first
 			if value, ok := t.Attributes[":if"]; ok {
-				vm, deps, err := expression.Create(value, t.Location)
+				vm, deps, err := expression.Create(value, t.AttributeLocations[":if"])
 				if err != nil {
 					return nil, err
 				}
@@ -49,13 +81,13 @@ func parseBlock(block []Node) ([]runtime.Statement, error) {
 				*outlet = append(*outlet, _if)
 				outlet = &_if.Consequence
 			} else if value, ok := t.Attributes[":elif"]; ok {
-				vm, deps, err := expression.Create(value, t.Location)
+				vm, deps, err := expression.Create(value, t.AttributeLocations[":elif"])
 				if err != nil {
 					return nil, err
 				}
 				_if := placeElse(&output)
 				if _if == nil {
-					return nil, fmt.Errorf("unexpected `:elif` outside if statement")
+					return nil, errors.New("unexpected `:elif` outside if statement", t.Location)
 				}
 				_if.Deps.Combine(deps)
 				_elif := &runtime.ElifBranch{Condition: vm}
@@ -64,7 +96,7 @@ func parseBlock(block []Node) ([]runtime.Statement, error) {
 			} else if _, ok := t.Attributes[":else"]; ok {
 				_if := placeElse(&output)
 				if _if == nil {
-					return nil, fmt.Errorf("unexpected `:else` outside if statement")
+					return nil, errors.New("unexpected `:else` outside if statement", t.Location)
 				}
 				outlet = &_if.Divergent
 			}
@@ -72,20 +104,23 @@ func parseBlock(block []Node) ([]runtime.Statement, error) {
 				pattern := `(?P<value>\w+)(,\s*(?P<key>\w+))?\s+in\s+(?P<iterable>.+)$`
 
 				re := regexp.MustCompile(pattern)
-				match := re.FindStringSubmatch(value)
+				match := re.FindStringSubmatchIndex(value)
 				groupNames := re.SubexpNames()
 				groupMap := make(map[string]string)
+				groupStart := make(map[string]int)
 				for i, name := range groupNames {
-					if i > 0 && name != "" {
-						groupMap[name] = match[i]
+					if i > 0 && name != "" && match != nil && match[2*i] != -1 {
+						groupMap[name] = value[match[2*i]:match[2*i+1]]
+						groupStart[name] = match[2*i]
 					}
 				}
 
 				if groupMap["value"] == "" || groupMap["iterable"] == "" {
-					return nil, fmt.Errorf("invalid `:for` syntax")
+					return nil, errors.New("invalid `:for` syntax", t.AttributeLocations[":for"])
 				}
 
-				vm, deps, err := expression.Create(groupMap["iterable"], t.Location)
+				iterableLocation := t.AttributeLocations[":for"].Advance(value[:groupStart["iterable"]])
+				vm, deps, err := expression.Create(groupMap["iterable"], iterableLocation)
 				if err != nil {
 					return nil, err
 				}
@@ -96,13 +131,35 @@ func parseBlock(block []Node) ([]runtime.Statement, error) {
 			}
 
 			if value, ok := t.Attributes[":slot"]; ok {
-				slot := &runtime.Slot{Name: value}
+				slot := &runtime.Slot{Name: value, Position: t.Location}
+				if let, ok := t.Attributes[":let"]; ok {
+					names, err := parseNames(":let", let, t.AttributeLocations[":let"])
+					if err != nil {
+						return nil, err
+					}
+					slot.Let = names
+				}
+
 				*outlet = append(*outlet, slot)
 				outlet = &slot.Children
+			} else if _, ok := t.Attributes[":let"]; ok {
+				return nil, errors.New("unexpected `:let` outside slot content", t.AttributeLocations[":let"])
+			}
+
+			if t.Name == "v-flush" || t.Name == "v-super" {
+				if len(t.Children) > 0 {
+					return nil, errors.New(fmt.Sprintf("`%s` can't have children", t.Name), t.Location)
+				}
+				if t.Name == "v-super" {
+					*outlet = append(*outlet, &runtime.Super{Position: t.Location})
+				} else {
+					*outlet = append(*outlet, &runtime.Flush{Position: t.Location})
+				}
+				continue
 			}
 
 			// void and self-closing (for interoperability with svg) elements can't have children
-			if slices.Contains(voidElements, t.Name) || t.IsSelfClosing && t.Name != "v-slot" && t.Name != "v-component" {
+			if slices.Contains(voidElements, t.Name) || t.IsSelfClosing && !slices.Contains(containerElements, t.Name) {
 				if err := renderStartTag(t, outlet); err != nil {
 					return nil, err
 				}
@@ -110,7 +167,46 @@ func parseBlock(block []Node) ([]runtime.Statement, error) {
 				continue
 			}
 
-			block, err := parseBlock(t.Children)
+			if t.Name == "v-prop" {
+				return nil, errors.New("`v-prop` must be placed inside `v-props`", t.Location)
+			}
+
+			if (t.Name == "v-define" || t.Name == "v-import") && (!root || outlet != &output) {
+				return nil, errors.New(fmt.Sprintf("`%s` must be placed at the top level of the template", t.Name), t.Location)
+			}
+
+			if t.Name == "v-import" || t.Name == "v-use" {
+				if len(t.Children) > 0 {
+					return nil, errors.New(fmt.Sprintf("`%s` can't have children", t.Name), t.Location)
+				}
+
+				statement, err := parseMacroReference(t)
+				if err != nil {
+					return nil, err
+				}
+
+				*outlet = append(*outlet, statement)
+				continue
+			}
+
+			if t.Name == "v-props" {
+				if !root || outlet != &output {
+					return nil, errors.New("`v-props` must be placed at the top level of the template", t.Location)
+				}
+				if slices.ContainsFunc(output, func(s runtime.Statement) bool { _, ok := s.(*runtime.Props); return ok }) {
+					return nil, errors.New("props are already declared", t.Location)
+				}
+
+				props, err := parseProps(t)
+				if err != nil {
+					return nil, err
+				}
+
+				*outlet = append(*outlet, props)
+				continue
+			}
+
+			block, err := parseBlock(t.Children, false)
 			if err != nil {
 				return nil, err
 			}
@@ -119,45 +215,172 @@ func parseBlock(block []Node) ([]runtime.Statement, error) {
 				slot := &runtime.Slot{
 					Name:     t.Attributes["name"],
 					Children: block,
+					Position: t.Location,
 				}
 
 				if slot.Name == "" {
-					return nil, fmt.Errorf("slot name is required")
+					return nil, errors.New("slot name is required", t.Location)
+				}
+
+				// remaining attributes are exposed to the content of the slot
+				keys := helpers.Keys(t.Attributes)
+				slices.Sort(keys)
+				for _, key := range keys {
+					if key == "name" || slices.Contains(voidAttributes, key) {
+						continue
+					}
+
+					name := strings.TrimPrefix(key, ":")
+					prop, err := parseProp(name, t.Attributes[key], key != name, t.AttributeLocations[key])
+					if err != nil {
+						return nil, err
+					}
+					slot.Props = append(slot.Props, prop)
 				}
 
 				*outlet = append(*outlet, slot)
 				continue
 			}
 
+			if t.Name == "v-define" {
+				macro := &runtime.Macro{
+					Name:     t.Attributes["name"],
+					Children: block,
+					Position: t.Location,
+				}
+
+				if macro.Name == "" {
+					return nil, errors.New("macro name is required", t.Location)
+				}
+				if slices.ContainsFunc(output, func(s runtime.Statement) bool { m, ok := s.(*runtime.Macro); return ok && m.Name == macro.Name }) {
+					return nil, errors.New(fmt.Sprintf("macro `%s` is already defined", macro.Name), t.Location)
+				}
+
+				if params, ok := t.Attributes["params"]; ok && strings.TrimSpace(params) != "" {
+					if macro.Params, err = parseNames("params", params, t.AttributeLocations["params"]); err != nil {
+						return nil, err
+					}
+				}
+
+				*outlet = append(*outlet, macro)
+				continue
+			}
+
+			if t.Name == "v-block" {
+				b := &runtime.Block{
+					Name:     t.Attributes["name"],
+					Children: block,
+					Position: t.Location,
+				}
+
+				if b.Name == "" {
+					return nil, errors.New("block name is required", t.Location)
+				}
+
+				*outlet = append(*outlet, b)
+				continue
+			}
+
+			if t.Name == "v-extends" {
+				extends := &runtime.Extends{
+					Name:     t.Attributes["name"],
+					Position: t.Location,
+				}
+
+				if extends.Name == "" {
+					return nil, errors.New("layout name is required", t.Location)
+				}
+
+				for _, c := range block {
+					b, ok := c.(*runtime.Block)
+					if !ok {
+						if !isContent(c) {
+							continue
+						}
+						return nil, errors.New("unexpected element in `v-extends`, only blocks are allowed", c.Location())
+					}
+					if slices.ContainsFunc(extends.Blocks, func(other *runtime.Block) bool { return other.Name == b.Name }) {
+						return nil, errors.New(fmt.Sprintf("block `%s` is already defined", b.Name), b.Position)
+					}
+					extends.Blocks = append(extends.Blocks, b)
+				}
+
+				*outlet = append(*outlet, extends)
+				continue
+			}
+
 			if t.Name == "v-component" {
 				component := &runtime.Component{
-					Name:    t.Attributes["name"],
-					Defines: make(map[string][]runtime.Statement),
+					Name:     t.Attributes["name"],
+					Defines:  make(map[string][]runtime.Statement),
+					Lets:     make(map[string][]string),
+					Position: t.Location,
 				}
 
-				if component.Name == "" {
-					return nil, fmt.Errorf("component name is required")
+				is, dynamic := t.Attributes[":is"]
+				if component.Name == "" && !dynamic {
+					return nil, errors.New("component name is required", t.Location)
+				} else if component.Name != "" && dynamic {
+					return nil, errors.New("component can't have both `name` and `:is`", t.Location)
+				}
+
+				// remaining attributes are props, in sorted order to keep the output stable
+				keys := helpers.Keys(t.Attributes)
+				slices.Sort(keys)
+				for _, key := range keys {
+					if key == "name" || key == ":is" || slices.Contains(voidAttributes, key) {
+						continue
+					}
+
+					name := strings.TrimPrefix(key, ":")
+					prop, err := parseProp(name, t.Attributes[key], key != name, t.AttributeLocations[key])
+					if err != nil {
+						return nil, err
+					}
+					component.Props = append(component.Props, prop)
 				}
 
 				for _, c := range block {
 					switch c := c.(type) {
 					case *runtime.Slot:
 						if _, ok := component.Defines[c.Name]; ok {
-							return nil, fmt.Errorf("slot `%s` is already defined", c.Name)
+							return nil, errors.New(fmt.Sprintf("slot `%s` is already defined", c.Name), c.Position)
 						}
 						component.Defines[c.Name] = c.Children
+						if len(c.Let) > 0 {
+							component.Lets[c.Name] = c.Let
+						}
 					default:
-						if t, ok := c.(*runtime.Text); ok {
-							trimmed := strings.TrimSpace(t.Content)
-							if trimmed == "" || (strings.HasPrefix(trimmed, "<!--") && strings.HasSuffix(trimmed, "-->")) {
-								continue
-							}
+						if !isContent(c) {
+							continue
 						}
-						return nil, fmt.Errorf("unexpected element in component, only slots are allowed")
+						return nil, errors.New("unexpected element in component, only slots are allowed", c.Location())
 					}
 				}
 
-				*outlet = append(*outlet, component)
+				if !dynamic {
+					*outlet = append(*outlet, component)
+					continue
+				}
+
+				vm, _, err := expression.Create(is, t.AttributeLocations[":is"])
+				if err != nil {
+					return nil, err
+				}
+
+				*outlet = append(*outlet, &runtime.DynamicComponent{
+					Is:       vm,
+					Props:    component.Props,
+					Defines:  component.Defines,
+					Lets:     component.Lets,
+					Position: t.Location,
+				})
+				continue
+			}
+
+			// templates only wrap the content of slots
+			if _, ok := t.Attributes[":slot"]; ok && t.Name == "template" {
+				*outlet = append(*outlet, block...)
 				continue
 			}
 
@@ -166,28 +389,155 @@ func parseBlock(block []Node) ([]runtime.Statement, error) {
 			}
 
 			*outlet = append(*outlet, block...)
-			*outlet = append(*outlet, &runtime.Text{Content: fmt.Sprintf("</%s>", t.Name)})
+			*outlet = append(*outlet, &runtime.Text{Content: fmt.Sprintf("</%s>", t.Name), Position: t.Location})
 		}
 	}
 
 	return output, nil
 }
 
+// propName matches names of props, which become variables of the component
+var propName = regexp.MustCompile(`^[a-zA-Z_]\w*$`)
+
+// parseProp parses the value of a prop, which is an expression if dynamic is set, or plain text otherwise.
+func parseProp(name, value string, dynamic bool, location helpers.Location) (*runtime.Prop, error) {
+	if !propName.MatchString(name) {
+		return nil, errors.New(fmt.Sprintf("invalid prop name `%s`", name), location)
+	}
+
+	if !dynamic {
+		return &runtime.Prop{Name: name, Text: value, Position: location}, nil
+	}
+
+	vm, deps, err := expression.Create(value, location)
+	if err != nil {
+		return nil, err
+	}
+
+	return &runtime.Prop{Name: name, Value: vm, Deps: deps, Position: location}, nil
+}
+
+// parseNames parses the comma separated names of the attribute, e.g. the ones bound by `:let`.
+func parseNames(attribute, value string, location helpers.Location) ([]string, error) {
+	var names []string
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		if !propName.MatchString(name) {
+			return nil, errors.New(fmt.Sprintf("invalid `%s` syntax, expected names separated by commas, got `%s`", attribute, value), location)
+		}
+		if slices.Contains(names, name) {
+			return nil, errors.New(fmt.Sprintf("`%s` is already listed", name), location)
+		}
+		names = append(names, name)
+	}
+
+	return names, nil
+}
+
+// parseMacroReference parses `v-import` and `v-use` elements. Attributes of `v-use` other than the name are arguments.
+func parseMacroReference(tag *Tag) (runtime.Statement, error) {
+	if tag.Name == "v-import" {
+		if tag.Attributes["from"] == "" {
+			return nil, errors.New("imported file is required", tag.Location)
+		}
+		return &runtime.Import{From: tag.Attributes["from"], Position: tag.Location}, nil
+	}
+
+	use := &runtime.Use{Name: tag.Attributes["name"], Position: tag.Location}
+	if use.Name == "" {
+		return nil, errors.New("macro name is required", tag.Location)
+	}
+
+	keys := helpers.Keys(tag.Attributes)
+	slices.Sort(keys)
+	for _, key := range keys {
+		if key == "name" || slices.Contains(voidAttributes, key) {
+			continue
+		}
+
+		name := strings.TrimPrefix(key, ":")
+		arg, err := parseProp(name, tag.Attributes[key], key != name, tag.AttributeLocations[key])
+		if err != nil {
+			return nil, err
+		}
+		use.Args = append(use.Args, arg)
+	}
+
+	return use, nil
+}
+
+// parseProps parses the `v-prop` declarations of a `v-props` element.
+func parseProps(tag *Tag) (*runtime.Props, error) {
+	props := &runtime.Props{Position: tag.Location}
+	for _, child := range tag.Children {
+		if text, ok := child.(*Text); ok {
+			if text.IsComment || strings.TrimSpace(text.Content) == "" {
+				continue
+			}
+			return nil, errors.New("unexpected text in `v-props`, only `v-prop` elements are allowed", text.Location)
+		}
+
+		t := child.(*Tag)
+		if t.Name != "v-prop" {
+			return nil, errors.New("unexpected element in `v-props`, only `v-prop` elements are allowed", t.Location)
+		}
+		if len(t.Children) > 0 {
+			return nil, errors.New("`v-prop` can't have children", t.Location)
+		}
+
+		name := t.Attributes["name"]
+		if name == "" {
+			return nil, errors.New("prop name is required", t.Location)
+		}
+		if !propName.MatchString(name) {
+			return nil, errors.New(fmt.Sprintf("invalid prop name `%s`", name), t.AttributeLocations["name"])
+		}
+		if slices.ContainsFunc(props.Declarations, func(d *runtime.PropDeclaration) bool { return d.Name == name }) {
+			return nil, errors.New(fmt.Sprintf("prop `%s` is already declared", name), t.Location)
+		}
+
+		declaration := &runtime.PropDeclaration{Name: name, Position: t.Location}
+		_, declaration.Required = t.Attributes["required"]
+
+		for _, key := range []string{"default", ":default"} {
+			value, ok := t.Attributes[key]
+			if !ok {
+				continue
+			}
+
+			if declaration.Required || declaration.Default != nil {
+				return nil, errors.New(fmt.Sprintf("prop `%s` can have either a single default or be required", name), t.AttributeLocations[key])
+			}
+
+			var err error
+			if declaration.Default, err = parseProp(name, value, key == ":default", t.AttributeLocations[key]); err != nil {
+				return nil, err
+			}
+		}
+
+		props.Declarations = append(props.Declarations, declaration)
+	}
+
+	return props, nil
+}
+
 func parseText(text *Text) (output []runtime.Statement, err error) {
 	lastClosed := 0
 
 outer:
 	for i := 0; i < len(text.Content)-1; i++ {
 		if text.Content[i] == '{' && text.Content[i+1] == '{' && (i == 0 || text.Content[i-1] != '\\') {
-			if i > 0 {
-				content := text.Content[:i]
+			if i > lastClosed {
+				content := text.Content[lastClosed:i]
 				if !text.IsRaw {
 					content = escape(content)
 				}
-				output = append(output, &runtime.Text{Content: content})
+				output = append(output, &runtime.Text{Content: content, Position: text.Location.Advance(text.Content[:lastClosed])})
 			}
 
 			start := i + 2
+			// braces of map literals inside the expression mustn't be mistaken for its end
+			depth := 0
 			for i = start; i < len(text.Content)-1; i++ {
 				var stringCharacter uint8 = 0
 				if text.Content[i] == '"' && (i == 0 || text.Content[i-1] != '\\') {
@@ -203,27 +553,39 @@ outer:
 					}
 
 					if i == len(text.Content) {
-						return nil, fmt.Errorf("unclosed string literal")
+						return nil, errors.New("unclosed string literal", text.Location.Advance(text.Content[:start]))
 					}
 				}
 
+				if text.Content[i] == '{' {
+					depth++
+					continue
+				} else if text.Content[i] == '}' && depth > 0 {
+					depth--
+					continue
+				}
+
 				if i < len(text.Content)-1 && text.Content[i] == '}' && text.Content[i+1] == '}' {
-					vm, deps, err := expression.Create(text.Content[start:i], text.Location)
+					vm, deps, err := expression.Create(text.Content[start:i], text.Location.Advance(text.Content[:start]))
 					if err != nil {
 						return nil, err
 					}
 
-					output = append(output, &runtime.Expression{Program: vm, Deps: deps})
+					output = append(output, &runtime.Expression{Program: vm, Deps: deps, Escape: textEscaping(text)})
 					lastClosed = i + 2
 					continue outer
 				}
 			}
 
-			return nil, fmt.Errorf("unclosed expression")
+			return nil, errors.New("unclosed expression", text.Location.Advance(text.Content[:start-2]))
 		}
 	}
 
-	output = append(output, &runtime.Text{Content: text.Content[lastClosed:]})
+	content := text.Content[lastClosed:]
+	if !text.IsRaw {
+		content = escape(content)
+	}
+	output = append(output, &runtime.Text{Content: content, Position: text.Location.Advance(text.Content[:lastClosed])})
 	return
 }
 
@@ -259,6 +621,7 @@ func placeElse(s *[]runtime.Statement) *runtime.IfStatement {
 // voidAttributes are attributes that aren't outputted when rendered
 var voidAttributes = []string{
 	":slot",
+	":let",
 	":if",
 	":elif",
 	":else",
@@ -266,24 +629,28 @@ var voidAttributes = []string{
 }
 
 func renderStartTag(tag *Tag, output *[]runtime.Statement) (err error) {
-	*output = append(*output, &runtime.Text{fmt.Sprintf("<%s ", tag.Name)})
-	for key, value := range tag.Attributes {
+	*output = append(*output, &runtime.Text{Content: fmt.Sprintf("<%s ", tag.Name), Position: tag.Location})
+	// attributes are kept in a map, so they're rendered in sorted order to keep the output stable
+	keys := helpers.Keys(tag.Attributes)
+	slices.Sort(keys)
+	for _, key := range keys {
+		value := tag.Attributes[key]
 		if strings.HasPrefix(key, ":") && !strings.HasPrefix(key, "::") {
 			if slices.Contains(voidAttributes, key) {
 				continue
 			}
 
-			vm, deps, err := expression.Create(value, tag.Location)
+			vm, deps, err := expression.Create(value, tag.AttributeLocations[key])
 			if err != nil {
 				return err
 			}
 
-			*output = append(*output, &runtime.Attribute{key[1:], vm, deps})
+			*output = append(*output, &runtime.Attribute{Name: key[1:], Value: vm, Deps: deps, Escape: attributeEscaping(key[1:])})
 		} else {
 			if strings.HasPrefix(key, "::") {
 				key = key[1:]
 			}
-			*output = append(*output, &runtime.Text{fmt.Sprintf(`%s="%s" `, key, value)})
+			*output = append(*output, &runtime.Text{Content: fmt.Sprintf(`%s="%s" `, key, escape(value)), Position: tag.AttributeLocations[key]})
 		}
 	}
 
@@ -292,7 +659,52 @@ func renderStartTag(tag *Tag, output *[]runtime.Statement) (err error) {
 		closingBracket = "/>"
 	}
 
-	*output = append(*output, &runtime.Text{closingBracket})
+	*output = append(*output, &runtime.Text{Content: closingBracket, Position: tag.Location})
 
 	return nil
 }
+
+// urlAttributes are attributes whose values are URLs
+var urlAttributes = []string{
+	"action",
+	"background",
+	"cite",
+	"codebase",
+	"data",
+	"formaction",
+	"href",
+	"icon",
+	"longdesc",
+	"manifest",
+	"poster",
+	"src",
+	"usemap",
+	"xlink:href",
+}
+
+func attributeEscaping(name string) runtime.EscapeContext {
+	name = strings.ToLower(name)
+	switch {
+	case slices.Contains(urlAttributes, name):
+		return runtime.EscapeURL
+	case name == "srcset":
+		return runtime.EscapeSrcset
+	case strings.HasPrefix(name, "on"):
+		return runtime.EscapeScript
+	case name == "style":
+		return runtime.EscapeStyle
+	default:
+		return runtime.EscapeAttribute
+	}
+}
+
+func textEscaping(text *Text) runtime.EscapeContext {
+	switch text.Parent {
+	case "script":
+		return runtime.EscapeScript
+	case "style":
+		return runtime.EscapeStyle
+	default:
+		return runtime.EscapeText
+	}
+}
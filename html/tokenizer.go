@@ -2,6 +2,7 @@ package html
 
 import (
 	"fmt"
+	"github.com/terawatthour/socks/errors"
 	"github.com/terawatthour/socks/internal/helpers"
 	"golang.org/x/net/html"
 	"io"
@@ -19,6 +20,9 @@ type Tag struct {
 	Attributes    map[string]string
 	Children      []Node
 	Location      helpers.Location
+
+	// AttributeLocations holds where the values of the attributes start.
+	AttributeLocations map[string]helpers.Location
 }
 
 func (t *Tag) Kind() string {
@@ -30,6 +34,9 @@ type Text struct {
 	IsComment bool
 	Content   string
 	Location  helpers.Location
+
+	// Parent is the name of the enclosing element, empty at the top level.
+	Parent string
 }
 
 func (t *Text) Kind() string {
@@ -48,6 +55,7 @@ type Tokenizer struct {
 	unclosedTags helpers.Stack[string]
 	location     helpers.Location
 	lastLocation helpers.Location
+	raw          string
 }
 
 type Token struct {
@@ -58,16 +66,9 @@ type Token struct {
 
 func (t *Tokenizer) Next() html.TokenType {
 	tokenType := t.Tokenizer.Next()
-	raw := t.Raw()
+	t.raw = string(t.Raw())
 	t.lastLocation = t.location
-	for _, r := range string(raw) {
-		if r == '\n' {
-			t.location.Line++
-			t.location.Column = 1
-		} else {
-			t.location.Column++
-		}
-	}
+	t.location = t.location.Advance(t.raw)
 	return tokenType
 }
 
@@ -83,11 +84,12 @@ func (t *Tokenizer) CurrentColumn() int {
 	return t.lastLocation.Column
 }
 
-func Tokenize(r io.Reader) ([]Node, error) {
+// Tokenize splits the template into a tree of nodes. The filename is only used for locations.
+func Tokenize(filename string, r io.Reader) ([]Node, error) {
 	t := &Tokenizer{
 		Tokenizer:    html.NewTokenizer(r),
 		unclosedTags: make(helpers.Stack[string], 0),
-		location:     helpers.Location{Line: 1, Column: 1},
+		location:     helpers.Location{File: filename, Line: 1, Column: 1},
 	}
 
 	elements, err := t.tokenizeBlock()
@@ -96,7 +98,7 @@ func Tokenize(r io.Reader) ([]Node, error) {
 	}
 
 	if len(t.unclosedTags) > 0 {
-		return nil, fmt.Errorf("unclosed tags: %s", strings.Join(t.unclosedTags, ", "))
+		return nil, errors.New(fmt.Sprintf("unclosed tags: %s", strings.Join(t.unclosedTags, ", ")), t.location)
 	}
 
 	return elements, nil
@@ -131,23 +133,15 @@ func (t *Tokenizer) tokenize() (Node, error) {
 	case html.ErrorToken:
 		return nil, t.Err()
 	case html.TextToken:
-		if len(t.unclosedTags) > 0 && childTextNodesAreLiteral(t.unclosedTags[len(t.unclosedTags)-1]) {
-			return &Text{Content: token.Data, IsRaw: true, Location: t.location}, nil
-		} else {
-			return &Text{Content: token.Data, IsRaw: false, Location: t.location}, nil
+		parent := ""
+		if len(t.unclosedTags) > 0 {
+			parent = t.unclosedTags.Peek()
 		}
+		return &Text{Content: token.Data, IsRaw: childTextNodesAreLiteral(parent), Location: token.Location, Parent: parent}, nil
 	case html.StartTagToken:
-		tag := &Tag{
-			Name:       token.Data,
-			Attributes: make(map[string]string),
-			Location:   t.location,
-		}
-
-		for _, a := range token.Attr {
-			if _, ok := tag.Attributes[a.Key]; ok {
-				return nil, fmt.Errorf("duplicate attribute: %s", a.Key)
-			}
-			tag.Attributes[a.Key] = a.Val
+		tag, err := t.tag(token, false)
+		if err != nil {
+			return nil, err
 		}
 
 		if slices.Contains(voidElements, tag.Name) {
@@ -156,7 +150,6 @@ func (t *Tokenizer) tokenize() (Node, error) {
 
 		t.unclosedTags.Push(tag.Name)
 
-		var err error
 		tag.Children, err = t.tokenizeBlock()
 		if err != nil {
 			return nil, err
@@ -165,32 +158,18 @@ func (t *Tokenizer) tokenize() (Node, error) {
 		return tag, nil
 	case html.EndTagToken:
 		if len(t.unclosedTags) == 0 {
-			return nil, fmt.Errorf("unexpected end tag: </%s> has nothing to close", token.Data)
+			return nil, errors.New(fmt.Sprintf("unexpected end tag: </%s> has nothing to close", token.Data), token.Location)
 		}
 		closed := t.unclosedTags.Pop()
 		if closed != token.Data {
-			return nil, fmt.Errorf("unexpected end tag: <%s> is closed by </%s>", closed, token.Data)
+			return nil, errors.New(fmt.Sprintf("unexpected end tag: <%s> is closed by </%s>", closed, token.Data), token.Location)
 		}
 
 		return nil, nil
 	case html.SelfClosingTagToken:
-		tag := &Tag{
-			Name:          token.Data,
-			IsSelfClosing: true,
-			Attributes:    make(map[string]string),
-			Location:      t.location,
-		}
-
-		for _, a := range token.Attr {
-			if _, ok := tag.Attributes[a.Key]; ok {
-				return nil, fmt.Errorf("duplicate attribute: %s", a.Key)
-			}
-			tag.Attributes[a.Key] = a.Val
-		}
-
-		return tag, nil
+		return t.tag(token, true)
 	case html.CommentToken:
-		return &Text{IsRaw: true, IsComment: true, Content: fmt.Sprintf("<!--%s-->", escapeComment(token.Data)), Location: t.location}, nil
+		return &Text{IsRaw: true, IsComment: true, Content: fmt.Sprintf("<!--%s-->", escapeComment(token.Data)), Location: token.Location}, nil
 	case html.DoctypeToken:
 		content := fmt.Sprintf("<!DOCTYPE %s", escape(token.Data))
 
@@ -218,12 +197,84 @@ func (t *Tokenizer) tokenize() (Node, error) {
 
 		content += ">"
 
-		return &Text{IsRaw: true, Content: content, Location: t.location}, nil
+		return &Text{IsRaw: true, Content: content, Location: token.Location}, nil
 	}
 
 	return nil, nil
 }
 
+func (t *Tokenizer) tag(token Token, isSelfClosing bool) (*Tag, error) {
+	tag := &Tag{
+		Name:               token.Data,
+		IsSelfClosing:      isSelfClosing,
+		Attributes:         make(map[string]string),
+		Location:           token.Location,
+		AttributeLocations: attributeLocations(t.raw, token.Location, token.Attr),
+	}
+
+	for _, a := range token.Attr {
+		if _, ok := tag.Attributes[a.Key]; ok {
+			return nil, errors.New(fmt.Sprintf("duplicate attribute: %s", a.Key), tag.AttributeLocations[a.Key])
+		}
+		tag.Attributes[a.Key] = a.Val
+	}
+
+	return tag, nil
+}
+
+// attributeLocations finds where the values of the attributes start in the raw tag, which starts at location.
+// Attributes without a value are located at their name.
+func attributeLocations(raw string, location helpers.Location, attributes []html.Attribute) map[string]helpers.Location {
+	result := make(map[string]helpers.Location, len(attributes))
+	lower := strings.ToLower(raw)
+
+	// attributes follow the tag name
+	cursor := strings.IndexAny(lower, " \t\n\r\f/>")
+	if cursor == -1 {
+		return result
+	}
+
+	skipSpace := func(i int) int {
+		for i < len(raw) && strings.IndexByte(" \t\n\r\f", raw[i]) != -1 {
+			i++
+		}
+		return i
+	}
+
+	for _, a := range attributes {
+		i := strings.Index(lower[cursor:], a.Key)
+		if i == -1 {
+			break
+		}
+
+		start := cursor + i
+		cursor = skipSpace(start + len(a.Key))
+		if cursor < len(raw) && raw[cursor] == '=' {
+			cursor = skipSpace(cursor + 1)
+			var end int
+			if cursor < len(raw) && (raw[cursor] == '"' || raw[cursor] == '\'') {
+				cursor++
+				end = strings.IndexByte(raw[cursor:], raw[cursor-1])
+			} else {
+				end = strings.IndexAny(raw[cursor:], " \t\n\r\f>")
+			}
+
+			start = cursor
+			if end != -1 {
+				cursor += end
+			} else {
+				cursor = len(raw)
+			}
+		}
+
+		if _, ok := result[a.Key]; !ok {
+			result[a.Key] = location.Advance(raw[:start])
+		}
+	}
+
+	return result
+}
+
 func childTextNodesAreLiteral(tagName string) bool {
 	switch tagName {
 	case "iframe", "noembed", "noframes", "noscript", "plaintext", "script", "style", "xmp":
@@ -329,3 +380,16 @@ var voidElements = []string{
 	"track",
 	"wbr",
 }
+
+// containerElements are the preprocessor elements whose self-closing form is empty, instead of being rendered.
+var containerElements = []string{
+	"v-slot",
+	"v-component",
+	"v-block",
+	"v-extends",
+	"v-props",
+	"v-prop",
+	"v-define",
+	"v-use",
+	"v-import",
+}
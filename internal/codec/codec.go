@@ -0,0 +1,200 @@
+// Package codec implements the primitives of the binary format used to cache compiled templates.
+// Both Writer and Reader keep the first error they encounter and turn all subsequent calls into
+// no-ops, so that callers only have to check Err once they are done.
+package codec
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/terawatthour/socks/internal/helpers"
+	"io"
+	"math"
+)
+
+type Writer struct {
+	w   *bufio.Writer
+	buf [binary.MaxVarintLen64]byte
+	err error
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: bufio.NewWriter(w)}
+}
+
+func (w *Writer) write(p []byte) {
+	if w.err != nil {
+		return
+	}
+	_, w.err = w.w.Write(p)
+}
+
+func (w *Writer) Raw(p []byte) {
+	w.write(p)
+}
+
+func (w *Writer) Byte(b byte) {
+	w.write([]byte{b})
+}
+
+func (w *Writer) Uint(u uint64) {
+	n := binary.PutUvarint(w.buf[:], u)
+	w.write(w.buf[:n])
+}
+
+func (w *Writer) Int(i int) {
+	n := binary.PutVarint(w.buf[:], int64(i))
+	w.write(w.buf[:n])
+}
+
+func (w *Writer) Bool(b bool) {
+	if b {
+		w.Byte(1)
+	} else {
+		w.Byte(0)
+	}
+}
+
+func (w *Writer) Float(f float64) {
+	w.Uint(math.Float64bits(f))
+}
+
+func (w *Writer) String(s string) {
+	w.Uint(uint64(len(s)))
+	w.write([]byte(s))
+}
+
+func (w *Writer) Strings(s []string) {
+	w.Uint(uint64(len(s)))
+	for _, str := range s {
+		w.String(str)
+	}
+}
+
+func (w *Writer) Location(l helpers.Location) {
+	w.String(l.File)
+	w.Int(l.Line)
+	w.Int(l.Column)
+	w.Int(l.Length)
+}
+
+// Fail records err as the error of the writer, unless it already failed.
+func (w *Writer) Fail(err error) {
+	if w.err == nil {
+		w.err = err
+	}
+}
+
+// Flush writes any buffered data to the underlying writer and returns the first error encountered.
+func (w *Writer) Flush() error {
+	if w.err != nil {
+		return w.err
+	}
+	return w.w.Flush()
+}
+
+// Reader reads the input from memory, so that lengths can be checked against its remaining size.
+type Reader struct {
+	r   *bytes.Reader
+	err error
+}
+
+func NewReader(data []byte) *Reader {
+	return &Reader{r: bytes.NewReader(data)}
+}
+
+func (r *Reader) Raw(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	p := make([]byte, n)
+	_, r.err = io.ReadFull(r.r, p)
+	return p
+}
+
+func (r *Reader) Byte() byte {
+	if r.err != nil {
+		return 0
+	}
+	b, err := r.r.ReadByte()
+	r.err = err
+	return b
+}
+
+func (r *Reader) Uint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	u, err := binary.ReadUvarint(r.r)
+	r.err = err
+	return u
+}
+
+func (r *Reader) Int() int {
+	if r.err != nil {
+		return 0
+	}
+	i, err := binary.ReadVarint(r.r)
+	r.err = err
+	return int(i)
+}
+
+func (r *Reader) Bool() bool {
+	return r.Byte() != 0
+}
+
+func (r *Reader) Float() float64 {
+	return math.Float64frombits(r.Uint())
+}
+
+// Length reads a length prefix, failing on values that can't possibly be valid. Every byte, element
+// and item is encoded with at least one byte, so a length can't exceed the size of the remaining input,
+// which guards against allocating huge buffers when reading corrupted input.
+func (r *Reader) Length() int {
+	n := r.Uint()
+	if n > uint64(r.r.Len()) {
+		r.Fail(fmt.Errorf("invalid length %d", n))
+		return 0
+	}
+	return int(n)
+}
+
+func (r *Reader) String() string {
+	return string(r.Raw(r.Length()))
+}
+
+func (r *Reader) Strings() []string {
+	n := r.Length()
+	if n == 0 {
+		return nil
+	}
+	result := make([]string, n)
+	for i := range result {
+		result[i] = r.String()
+	}
+	return result
+}
+
+func (r *Reader) Location() helpers.Location {
+	return helpers.Location{
+		File:   r.String(),
+		Line:   r.Int(),
+		Column: r.Int(),
+		Length: r.Int(),
+	}
+}
+
+// Fail records err as the error of the reader, unless it already failed.
+func (r *Reader) Fail(err error) {
+	if r.err == nil {
+		r.err = err
+	}
+}
+
+func (r *Reader) Err() error {
+	if r.err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return r.err
+}
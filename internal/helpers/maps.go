@@ -10,3 +10,11 @@ func Combine[T comparable, B any](a, b map[T]B) map[T]B {
 	}
 	return result
 }
+
+func Keys[T comparable, B any](m map[T]B) []T {
+	result := make([]T, 0, len(m))
+	for k := range m {
+		result = append(result, k)
+	}
+	return result
+}
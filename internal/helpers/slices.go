@@ -1,36 +1,53 @@
 package helpers
 
 import (
+	"cmp"
+	"fmt"
 	"reflect"
 	"slices"
+	"strings"
 )
 
-type Key any
-type Value any
-
-type KeyValuePair struct {
-	Key
-	Value
-}
-
-type tuple = KeyValuePair
-
-func ExtractValues(result chan tuple, obj any) {
-	sliceValue := reflect.ValueOf(obj)
+// Iterate calls fn with every index and item of a slice or array, or every key and value of a map
+// in the order of SortedMapKeys. It stops at the first error returned by fn.
+func Iterate(obj any, fn func(key, value any) error) error {
+	value := reflect.ValueOf(obj)
 
-	switch sliceValue.Kind() {
+	switch value.Kind() {
 	case reflect.Slice, reflect.Array:
-		for i := 0; i < sliceValue.Len(); i++ {
-			result <- tuple{i, sliceValue.Index(i).Interface()}
+		for i := 0; i < value.Len(); i++ {
+			if err := fn(i, value.Index(i).Interface()); err != nil {
+				return err
+			}
 		}
 	case reflect.Map:
-		for _, key := range sliceValue.MapKeys() {
-			result <- tuple{key, sliceValue.MapIndex(key).Interface()}
+		for _, key := range SortedMapKeys(value) {
+			if err := fn(key.Interface(), value.MapIndex(key).Interface()); err != nil {
+				return err
+			}
 		}
 	default:
-		panic("unreachable")
+		return fmt.Errorf("expected <slice | array | map>, got <%T>", obj)
 	}
 
+	return nil
+}
+
+// SortedMapKeys returns the keys of the map value, sorted if they are strings, integers or floats,
+// so that iterating over a map gives the same output on every render.
+func SortedMapKeys(value reflect.Value) []reflect.Value {
+	keys := value.MapKeys()
+	switch value.Type().Key().Kind() {
+	case reflect.String:
+		slices.SortFunc(keys, func(a, b reflect.Value) int { return strings.Compare(a.String(), b.String()) })
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		slices.SortFunc(keys, func(a, b reflect.Value) int { return cmp.Compare(a.Int(), b.Int()) })
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		slices.SortFunc(keys, func(a, b reflect.Value) int { return cmp.Compare(a.Uint(), b.Uint()) })
+	case reflect.Float32, reflect.Float64:
+		slices.SortFunc(keys, func(a, b reflect.Value) int { return cmp.Compare(a.Float(), b.Float()) })
+	}
+	return keys
 }
 
 func IsIterable(obj any) bool {
@@ -4,7 +4,7 @@ import (
 	"path/filepath"
 )
 
-// Location represents a location in a file. Line starts at 1, Column - at 0.
+// Location represents a location in a file. Line and Column start at 1.
 type Location struct {
 	File   string
 	Line   int
@@ -17,12 +17,27 @@ func (l Location) SetLength(length int) Location {
 	return l
 }
 
+// WithBase converts l, a location relative to a fragment of a file, e.g. an expression, into
+// a location in the file, given the location of the first character of the fragment.
 func (l Location) WithBase(base Location) Location {
-	if base.Line == l.Line {
-		l.Column += base.Column
-		return l
+	if l.Line == 1 {
+		l.Column += base.Column - 1
+	}
+	l.Line += base.Line - 1
+	l.File = base.File
+	return l
+}
+
+// Advance returns the location right after content, assuming content starts at l.
+func (l Location) Advance(content string) Location {
+	for _, r := range content {
+		if r == '\n' {
+			l.Line++
+			l.Column = 1
+		} else {
+			l.Column++
+		}
 	}
-	l.Line += base.Line
 	return l
 }
 
@@ -2,114 +2,297 @@ package socks
 
 import (
 	"fmt"
+	"github.com/terawatthour/socks/errors"
+	"github.com/terawatthour/socks/expression"
 	"github.com/terawatthour/socks/html"
 	"github.com/terawatthour/socks/internal/helpers"
 	"github.com/terawatthour/socks/runtime"
 	"io"
-	"path/filepath"
+	"maps"
+	"path"
 	"slices"
 	"strings"
 )
 
 type Preprocessor struct {
-	files                 map[string][]runtime.Statement
-	preprocessed          map[string][]runtime.Statement
-	preprocessedWithSlots map[string][]runtime.Statement
+	files map[string][]runtime.Statement
+
+	// preprocessed are the files with their components included. Slots are kept, so that files can be
+	// included as components, and render their fallback content otherwise.
+	preprocessed map[string][]runtime.Statement
+
+	// inherited are files with their layouts resolved and their blocks kept, so that they can be extended
+	inherited map[string][]runtime.Statement
+
+	graph dependencyGraph
 
 	ctx       runtime.Context
 	sanitizer func(string) string
+
+	// limits bound the static evaluation same as the executions, and the depth of nested components
+	limits runtime.Limits
+
+	// sandbox and taggedFields configure the static evaluation same as the executions
+	sandbox      *expression.Sandbox
+	taggedFields bool
+
+	// expanding are the macros being inlined, innermost last
+	expanding []*runtime.Macro
 }
 
 // Preprocess reads and preprocesses all files from the provided map. It takes ownership of the files and closes them.
 func Preprocess(files map[string]io.Reader, staticContext runtime.Context, sanitizer func(string) string) (preprocessed map[string][]runtime.Statement, err error) {
-	parsedFiles := make(map[string][]runtime.Statement)
+	contents, err := readFiles(files)
+	if err != nil {
+		return nil, err
+	}
 
-	for filename, file := range files {
-		if parsedFiles[filename], err = html.Parse(file); err != nil {
+	parsedFiles, err := parseFiles(contents)
+	if err != nil {
+		return nil, err
+	}
+
+	p := newPreprocessor(parsedFiles, staticContext, sanitizer)
+	for filename := range files {
+		if err = p.preprocess(filename); err != nil {
 			return nil, err
 		}
 	}
 
-	p := &Preprocessor{
-		files:                 parsedFiles,
-		preprocessed:          make(map[string][]runtime.Statement),
-		preprocessedWithSlots: make(map[string][]runtime.Statement),
-		ctx:                   staticContext,
-		sanitizer:             sanitizer,
+	return p.preprocessed, nil
+}
+
+func newPreprocessor(files map[string][]runtime.Statement, staticContext runtime.Context, sanitizer func(string) string) *Preprocessor {
+	return &Preprocessor{
+		files:        files,
+		preprocessed: make(map[string][]runtime.Statement),
+		inherited:    make(map[string][]runtime.Statement),
+		graph:        make(dependencyGraph),
+		ctx:          staticContext,
+		sanitizer:    sanitizer,
 	}
-	for filename := range files {
-		if err = p.preprocess(filename, false); err != nil {
+}
+
+// update replaces the provided files and invalidates everything preprocessed from them, including
+// the files that include them. It returns the invalidated files, which have to be preprocessed again.
+// Preprocessed output of all other files is kept and reused.
+func (p *Preprocessor) update(files map[string][]runtime.Statement) []string {
+	invalidated := p.graph.dependents(helpers.Keys(files)...)
+	for _, filename := range invalidated {
+		delete(p.preprocessed, filename)
+		delete(p.inherited, filename)
+		delete(p.graph, filename)
+	}
+
+	maps.Copy(p.files, files)
+
+	return invalidated
+}
+
+// clone returns a preprocessor sharing the preprocessed statements with p, so that the clone
+// can be updated without affecting p.
+func (p *Preprocessor) clone() *Preprocessor {
+	return &Preprocessor{
+		files:        maps.Clone(p.files),
+		preprocessed: maps.Clone(p.preprocessed),
+		inherited:    maps.Clone(p.inherited),
+		graph:        p.graph.clone(),
+		ctx:          p.ctx,
+		sanitizer:    p.sanitizer,
+		limits:       p.limits,
+		sandbox:      p.sandbox,
+		taggedFields: p.taggedFields,
+	}
+}
+
+// readFiles reads the contents of all files, which are kept for error reports.
+func readFiles(files map[string]io.Reader) (map[string]string, error) {
+	contents := make(map[string]string, len(files))
+	for filename, file := range files {
+		content, err := io.ReadAll(file)
+		if err != nil {
 			return nil, err
 		}
+		contents[filename] = string(content)
 	}
 
-	return p.preprocessed, nil
+	return contents, nil
 }
 
-func (p *Preprocessor) preprocess(filename string, keepSlots bool, cycle ...string) error {
-	if slices.Contains(cycle, filename) {
-		return fmt.Errorf("cyclic import detected: %v", strings.Join(append(cycle, filename), "->"))
+func parseFiles(contents map[string]string) (parsed map[string][]runtime.Statement, err error) {
+	parsed = make(map[string][]runtime.Statement)
+	for filename, content := range contents {
+		if parsed[filename], err = html.Parse(filename, strings.NewReader(content)); err != nil {
+			return nil, err
+		}
 	}
 
-	// if file was already preprocessed in selected mode, return it immediately
-	if _, ok := p.preprocessedFile(filename, keepSlots); ok {
+	return parsed, nil
+}
+
+func (p *Preprocessor) preprocess(filename string, cycle ...string) error {
+	// if file was already preprocessed, return it immediately
+	if _, ok := p.preprocessed[filename]; ok {
 		return nil
 	}
 
-	output, err := p.preprocessBlock(filename, p.files[filename], keepSlots, cycle...)
+	output, err := p.preprocessBlock(filename, p.files[filename], cycle...)
 	if err != nil {
 		return err
 	}
+	output = scopeProps(output)
 
 	var precompiled helpers.Queue[runtime.Statement]
-	if err := runtime.NewStaticEvaluator(&precompiled, output, p.sanitizer).Evaluate(nil, p.ctx); err != nil {
+	static := runtime.NewStaticEvaluator(&precompiled, output, p.sanitizer)
+	static.Limits = p.limits
+	static.Sandbox = p.sandbox
+	static.TaggedFields = p.taggedFields
+	if err := static.Evaluate(nil, p.ctx); err != nil {
 		return err
-	} else if precompiled == nil {
-		return fmt.Errorf("error precompiling template")
+	} else if precompiled == nil && len(output) > 0 {
+		return errors.New("error precompiling template", helpers.Location{File: filename})
 	}
 
-	output = foldTexts(precompiled)
-
-	if keepSlots {
-		p.preprocessedWithSlots[filename] = output
-	} else {
-		p.preprocessed[filename] = output
-	}
+	p.preprocessed[filename] = foldTexts(precompiled)
 
 	return nil
 }
 
-func (p *Preprocessor) preprocessBlock(filename string, block []runtime.Statement, keepSlots bool, cycle ...string) (output []runtime.Statement, err error) {
+func (p *Preprocessor) preprocessBlock(filename string, block []runtime.Statement, cycle ...string) (output []runtime.Statement, err error) {
 	for _, program := range block {
 		switch program := program.(type) {
+		case *runtime.Extends:
+			layout, err := p.extend(filename, program, cycle...)
+			if err != nil {
+				return nil, err
+			}
+
+			block, err := p.preprocessBlock(filename, layout, cycle...)
+			if err != nil {
+				return nil, err
+			}
+			output = append(output, block...)
+		case *runtime.Block:
+			block, err := p.preprocessBlock(filename, program.Children, cycle...)
+			if err != nil {
+				return nil, err
+			}
+			output = append(output, block...)
+		case *runtime.Super:
+			return nil, errors.New("`v-super` must be placed directly inside a block overriding another one", program.Position)
 		case *runtime.Component:
-			componentPath := filepath.Join(filename, "..", program.Name)
+			// statements inherited from a layout refer to components relative to the layout
+			componentPath := path.Join(relativeTo(filename, program.Position), "..", program.Name)
 
 			if _, ok := p.files[componentPath]; !ok {
-				return nil, fmt.Errorf("component `%s` not found", program.Name)
+				return nil, errors.New(fmt.Sprintf("component `%s` not found", program.Name), program.Position)
+			}
+
+			if chain := append(cycle, filename); slices.Contains(chain, componentPath) {
+				return nil, errors.New(fmt.Sprintf("cyclic import detected: %v", strings.Join(append(chain, componentPath), "->")), program.Position)
 			}
 
-			if err := p.preprocess(componentPath, true, append(cycle, filename)...); err != nil {
+			p.graph.include(filename, componentPath)
+
+			if err := p.preprocess(componentPath, append(cycle, filename)...); err != nil {
 				return nil, err
 			}
 
+			if p.limits.ComponentDepth > 0 && 1+p.graph.depth(componentPath) > p.limits.ComponentDepth {
+				return nil, errors.LimitExceeded(fmt.Sprintf("%d nested components", p.limits.ComponentDepth), program.Position)
+			}
+
+			props, err := p.props(componentPath, append(cycle, filename)...)
+			if err != nil {
+				return nil, err
+			}
+
+			component := p.preprocessed[componentPath]
+			var declarations []*runtime.PropDeclaration
+			if props != nil {
+				// the component is wrapped in the scope of its declarations, see scopeProps
+				declarations = props.Declarations
+				component = component[0].(*runtime.Scope).Children
+			}
+
+			for _, declaration := range declarations {
+				passed := slices.ContainsFunc(program.Props, func(prop *runtime.Prop) bool { return prop.Name == declaration.Name })
+				if declaration.Required && !passed {
+					return nil, errors.New(fmt.Sprintf("missing required prop `%s` of component `%s`", declaration.Name, program.Name), program.Position)
+				}
+			}
+
+			// parsed files are kept around for recompilation, so the component itself must stay untouched
+			contents := &slotContents{
+				component: program.Name,
+				defines:   make(map[string][]runtime.Statement, len(program.Defines)),
+				lets:      program.Lets,
+				scoped:    len(declarations) > 0 || len(program.Props) > 0 || len(program.Lets) > 0,
+				position:  program.Position,
+			}
 			for k, pr := range program.Defines {
-				program.Defines[k], err = p.preprocessBlock(filename, pr, true, cycle...)
+				contents.defines[k], err = p.preprocessBlock(filename, pr, cycle...)
 				if err != nil {
 					return nil, err
 				}
 			}
 
-			output = append(output, replaceSlots(p.preprocessedWithSlots[componentPath], program.Defines)...)
-		default:
-			if slot, ok := program.(*runtime.Slot); ok && !keepSlots {
-				block, err := p.preprocessBlock(filename, slot.Children, false, cycle...)
-				if err != nil {
+			children, err := replaceSlots(component, contents)
+			if err != nil {
+				return nil, err
+			}
+
+			if !contents.scoped {
+				output = append(output, children...)
+				continue
+			}
+
+			output = append(output, &runtime.Scope{
+				Props:        program.Props,
+				Declarations: declarations,
+				Children:     children,
+				Position:     program.Position,
+			})
+		case *runtime.Macro:
+			// definitions are inlined where they're used
+		case *runtime.Import:
+			// imported files are checked, even if none of their macros are used
+			if _, err := p.macros(relativeTo(filename, program.Position)); err != nil {
+				return nil, err
+			}
+		case *runtime.Use:
+			statements, err := p.use(filename, program, cycle...)
+			if err != nil {
+				return nil, err
+			}
+			output = append(output, statements...)
+		case *runtime.Slot:
+			children, err := p.preprocessBlock(filename, program.Children, cycle...)
+			if err != nil {
+				return nil, err
+			}
+			slot := *program
+			slot.Children = children
+			output = append(output, &slot)
+		case *runtime.DynamicComponent:
+			// the component is included at runtime, while the content of its slots may include components statically
+			component := *program
+			component.Defines = make(map[string][]runtime.Statement, len(program.Defines))
+			for k, pr := range program.Defines {
+				if component.Defines[k], err = p.preprocessBlock(filename, pr, cycle...); err != nil {
 					return nil, err
 				}
-				output = append(output, block...)
-				continue
 			}
+			output = append(output, &component)
+		case *runtime.ForStatement, *runtime.IfStatement:
+			statement, err := mapBranches(program, func(branch []runtime.Statement) ([]runtime.Statement, error) {
+				return p.preprocessBlock(filename, branch, cycle...)
+			})
+			if err != nil {
+				return nil, err
+			}
+			output = append(output, statement)
+		default:
 			output = append(output, program)
 		}
 	}
@@ -117,38 +300,461 @@ func (p *Preprocessor) preprocessBlock(filename string, block []runtime.Statemen
 	return output, nil
 }
 
-func (p *Preprocessor) preprocessedFile(filename string, keepSlots bool) ([]runtime.Statement, bool) {
-	if keepSlots {
-		if preprocessed, ok := p.preprocessedWithSlots[filename]; ok {
-			return preprocessed, true
+// extend returns the statements of the layout extended by filename, with its blocks overridden.
+func (p *Preprocessor) extend(filename string, extends *runtime.Extends, cycle ...string) ([]runtime.Statement, error) {
+	layoutPath := path.Join(filename, "..", extends.Name)
+	if _, ok := p.files[layoutPath]; !ok {
+		return nil, errors.New(fmt.Sprintf("layout `%s` not found", extends.Name), extends.Position)
+	}
+
+	if chain := append(cycle, filename); slices.Contains(chain, layoutPath) {
+		return nil, errors.New(fmt.Sprintf("cyclic import detected: %v", strings.Join(append(chain, layoutPath), "->")), extends.Position)
+	}
+
+	p.graph.include(filename, layoutPath)
+
+	layout, err := p.inheritable(layoutPath, append(cycle, filename)...)
+	if err != nil {
+		return nil, err
+	}
+
+	names, err := blockNames(layout)
+	if err != nil {
+		return nil, err
+	}
+	for _, block := range extends.Blocks {
+		if !names.Contains(block.Name) {
+			return nil, errors.New(fmt.Sprintf("block `%s` is not defined in `%s`", block.Name, layoutPath), block.Position)
+		}
+	}
+
+	overrides := make(map[string]*runtime.Block, len(extends.Blocks))
+	for _, block := range extends.Blocks {
+		overrides[block.Name] = block
+	}
+
+	return overrideBlocks(layout, overrides), nil
+}
+
+// use returns the body of the macro called by use, in the scope of its arguments. Missing arguments are nil.
+func (p *Preprocessor) use(filename string, use *runtime.Use, cycle ...string) ([]runtime.Statement, error) {
+	// statements inherited from a layout use the macros available in the layout
+	macros, err := p.macros(relativeTo(filename, use.Position))
+	if err != nil {
+		return nil, err
+	}
+
+	macro, ok := macros[use.Name]
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("macro `%s` is not defined", use.Name), use.Position)
+	}
+	if slices.Contains(p.expanding, macro) {
+		return nil, errors.New(fmt.Sprintf("macro `%s` uses itself", use.Name), use.Position)
+	}
+
+	args := slices.Clone(use.Args)
+	for _, arg := range use.Args {
+		if !slices.Contains(macro.Params, arg.Name) {
+			return nil, errors.New(fmt.Sprintf("macro `%s` has no parameter `%s`", use.Name, arg.Name), arg.Position)
+		}
+	}
+	for _, param := range macro.Params {
+		if slices.ContainsFunc(use.Args, func(arg *runtime.Prop) bool { return arg.Name == param }) {
+			continue
+		}
+
+		vm, _, err := expression.Create("nil", use.Position)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, &runtime.Prop{Name: param, Value: vm, Position: use.Position})
+	}
+
+	p.expanding = append(p.expanding, macro)
+	body, err := p.preprocessBlock(filename, macro.Children, cycle...)
+	p.expanding = p.expanding[:len(p.expanding)-1]
+	if err != nil {
+		return nil, err
+	}
+
+	if len(args) == 0 {
+		return body, nil
+	}
+
+	// the scope is inlined during the static evaluation if the arguments are static
+	return []runtime.Statement{&runtime.Scope{Props: args, Children: body, Position: use.Position, Macro: true}}, nil
+}
+
+// macros returns the macros available in the file, the ones it defines and the ones defined in the files
+// it imports. Macros defined in the file take precedence over the imported ones.
+func (p *Preprocessor) macros(filename string) (map[string]*runtime.Macro, error) {
+	macros := make(map[string]*runtime.Macro)
+	for _, statement := range p.files[filename] {
+		switch statement := statement.(type) {
+		case *runtime.Macro:
+			macros[statement.Name] = statement
+		case *runtime.Import:
+			importPath := path.Join(filename, "..", statement.From)
+			if _, ok := p.files[importPath]; !ok {
+				return nil, errors.New(fmt.Sprintf("imported file `%s` not found", statement.From), statement.Position)
+			}
+
+			p.graph.include(filename, importPath)
+
+			for _, imported := range p.files[importPath] {
+				if macro, ok := imported.(*runtime.Macro); ok {
+					if _, ok := macros[macro.Name]; !ok {
+						macros[macro.Name] = macro
+					}
+				}
+			}
+		}
+	}
+
+	return macros, nil
+}
+
+// props returns the props declared by the file, nil if it declares none.
+func (p *Preprocessor) props(filename string, cycle ...string) (*runtime.Props, error) {
+	statements, err := p.inheritable(filename, cycle...)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, statement := range statements {
+		if props, ok := statement.(*runtime.Props); ok {
+			return props, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// inheritable returns the statements of the file with its own layout resolved and its blocks kept.
+func (p *Preprocessor) inheritable(filename string, cycle ...string) ([]runtime.Statement, error) {
+	if statements, ok := p.inherited[filename]; ok {
+		return statements, nil
+	}
+
+	statements := p.files[filename]
+	for _, statement := range statements {
+		if extends, ok := statement.(*runtime.Extends); ok {
+			var err error
+			if statements, err = p.extend(filename, extends, cycle...); err != nil {
+				return nil, err
+			}
+			break
+		}
+	}
+
+	p.inherited[filename] = statements
+	return statements, nil
+}
+
+// dependencyGraph maps every file to the components it includes directly.
+type dependencyGraph map[string]helpers.Set[string]
+
+func (g dependencyGraph) include(filename string, component string) {
+	includes := g[filename]
+	includes.Add(component)
+	g[filename] = includes
+}
+
+// dependents returns the provided files together with all files that include any of them, directly or transitively.
+func (g dependencyGraph) dependents(files ...string) []string {
+	result := helpers.Set[string](slices.Clone(files))
+	for i := 0; i < len(result); i++ {
+		for filename, includes := range g {
+			if includes.Contains(result[i]) {
+				result.Add(filename)
+			}
+		}
+	}
+
+	return result
+}
+
+// path returns the shortest chain of inclusions leading from one file to another, including both of them.
+func (g dependencyGraph) path(from, to string) []string {
+	previous := map[string]string{from: ""}
+	queue := []string{from}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+
+		if current == to {
+			var path []string
+			for ; current != ""; current = previous[current] {
+				path = append(path, current)
+			}
+			slices.Reverse(path)
+			return path
+		}
+
+		includes := slices.Clone(g[current])
+		slices.Sort(includes)
+		for _, component := range includes {
+			if _, ok := previous[component]; !ok {
+				previous[component] = current
+				queue = append(queue, component)
+			}
 		}
-	} else {
-		if preprocessed, ok := p.preprocessed[filename]; ok {
-			return preprocessed, true
+	}
+
+	return nil
+}
+
+// depth returns the depth of the components nested in the file, zero if it includes none.
+func (g dependencyGraph) depth(filename string) int {
+	return g.memoizedDepth(filename, make(map[string]int))
+}
+
+func (g dependencyGraph) memoizedDepth(filename string, depths map[string]int) int {
+	if depth, ok := depths[filename]; ok {
+		return depth
+	}
+
+	depth := 0
+	for _, component := range g[filename] {
+		depth = max(depth, 1+g.memoizedDepth(component, depths))
+	}
+	depths[filename] = depth
+
+	return depth
+}
+
+func (g dependencyGraph) clone() dependencyGraph {
+	result := make(dependencyGraph, len(g))
+	for filename, includes := range g {
+		result[filename] = slices.Clone(includes)
+	}
+
+	return result
+}
+
+// slotContents are the contents passed to the slots of an included component.
+type slotContents struct {
+	component string
+	defines   map[string][]runtime.Statement
+	lets      map[string][]string
+
+	// scoped wraps the contents into caller scopes, as the component is evaluated in a scope of its own
+	scoped   bool
+	position helpers.Location
+}
+
+// bindings returns the props exposed by the slot which are bound by the content passed to it.
+func (c *slotContents) bindings(slot *runtime.Slot) ([]*runtime.Prop, error) {
+	var bindings []*runtime.Prop
+	for _, name := range c.lets[slot.Name] {
+		index := slices.IndexFunc(slot.Props, func(prop *runtime.Prop) bool { return prop.Name == name })
+		if index == -1 {
+			return nil, errors.New(fmt.Sprintf("slot `%s` of component `%s` doesn't expose `%s`", slot.Name, c.component, name), c.position)
 		}
+		bindings = append(bindings, slot.Props[index])
 	}
 
-	return nil, false
+	return bindings, nil
 }
 
-func replaceSlots(component []runtime.Statement, defines map[string][]runtime.Statement) []runtime.Statement {
+// replaceSlots replaces the slots of the component with the contents passed to them, or with their fallback content.
+// Slots nested in conditions, loops and other components are replaced as well.
+func replaceSlots(component []runtime.Statement, contents *slotContents) ([]runtime.Statement, error) {
 	var result []runtime.Statement
 	for _, program := range component {
 		switch program := program.(type) {
 		case *runtime.Slot:
-			if definedPrograms, ok := defines[program.Name]; ok {
-				result = append(result, definedPrograms...)
+			children, ok := contents.defines[program.Name]
+			if !ok {
+				fallback, err := replaceSlots(program.Children, contents)
+				if err != nil {
+					return nil, err
+				}
+				result = append(result, fallback...)
 				continue
 			}
-			result = append(result, program.Children...)
+
+			if !contents.scoped {
+				result = append(result, children...)
+				continue
+			}
+
+			// the content of slots belongs to the caller, so it can't see the props of the component
+			bindings, err := contents.bindings(program)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, &runtime.CallerScope{Bindings: bindings, Children: children, Position: program.Position})
+		case *runtime.Scope:
+			// slots passed through to nested components
+			children, err := replaceSlots(program.Children, contents)
+			if err != nil {
+				return nil, err
+			}
+			scope := *program
+			scope.Children = children
+			result = append(result, &scope)
+		case *runtime.CallerScope:
+			children, err := replaceSlots(program.Children, contents)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, &runtime.CallerScope{Bindings: program.Bindings, Children: children, Position: program.Position})
+		case *runtime.DynamicComponent:
+			component := *program
+			component.Defines = make(map[string][]runtime.Statement, len(program.Defines))
+			for k, define := range program.Defines {
+				var err error
+				if component.Defines[k], err = replaceSlots(define, contents); err != nil {
+					return nil, err
+				}
+			}
+			result = append(result, &component)
+		case *runtime.ForStatement, *runtime.IfStatement:
+			statement, err := mapBranches(program, func(branch []runtime.Statement) ([]runtime.Statement, error) {
+				return replaceSlots(branch, contents)
+			})
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, statement)
 		default:
 			result = append(result, program)
 		}
 	}
 
+	return result, nil
+}
+
+// scopeProps wraps the statements of a file declaring props into a scope setting their defaults, for when
+// the file is executed on its own. Components included from the file get scopes of their own.
+func scopeProps(statements []runtime.Statement) []runtime.Statement {
+	index := slices.IndexFunc(statements, func(statement runtime.Statement) bool {
+		_, ok := statement.(*runtime.Props)
+		return ok
+	})
+	if index == -1 {
+		return statements
+	}
+
+	props := statements[index].(*runtime.Props)
+	children := slices.Delete(slices.Clone(statements), index, index+1)
+	return []runtime.Statement{&runtime.Scope{Declarations: props.Declarations, Children: children, Position: props.Position, Root: true}}
+}
+
+// overrideBlocks replaces the content of the blocks of the layout with the overriding blocks of the same name,
+// with `v-super` elements inside them replaced by the content they override. Blocks are kept, so that
+// the result can be extended again. Blocks nested in conditions and loops are overridden as well.
+func overrideBlocks(layout []runtime.Statement, overrides map[string]*runtime.Block) []runtime.Statement {
+	result := make([]runtime.Statement, 0, len(layout))
+	for _, statement := range layout {
+		block, ok := statement.(*runtime.Block)
+		if !ok {
+			statement, _ = mapBranches(statement, func(branch []runtime.Statement) ([]runtime.Statement, error) {
+				return overrideBlocks(branch, overrides), nil
+			})
+			result = append(result, statement)
+			continue
+		}
+
+		override, ok := overrides[block.Name]
+		if !ok {
+			result = append(result, &runtime.Block{Name: block.Name, Children: overrideBlocks(block.Children, overrides), Position: block.Position})
+			continue
+		}
+
+		var children []runtime.Statement
+		for _, child := range override.Children {
+			if _, ok := child.(*runtime.Super); ok {
+				children = append(children, block.Children...)
+				continue
+			}
+			children = append(children, child)
+		}
+
+		// blocks nested in the overridden content may be overridden as well
+		rest := maps.Clone(overrides)
+		delete(rest, block.Name)
+		result = append(result, &runtime.Block{Name: block.Name, Children: overrideBlocks(children, rest), Position: override.Position})
+	}
+
 	return result
 }
 
+// blockNames returns the names of all blocks of the statements, including the nested ones. Names must be unique,
+// as it wouldn't be clear which of the blocks an override replaces.
+func blockNames(statements []runtime.Statement) (helpers.Set[string], error) {
+	var names helpers.Set[string]
+	var collect func(statements []runtime.Statement) ([]runtime.Statement, error)
+	collect = func(statements []runtime.Statement) ([]runtime.Statement, error) {
+		for _, statement := range statements {
+			block, ok := statement.(*runtime.Block)
+			if !ok {
+				if _, err := mapBranches(statement, collect); err != nil {
+					return nil, err
+				}
+				continue
+			}
+
+			if names.Contains(block.Name) {
+				return nil, errors.New(fmt.Sprintf("block `%s` is defined more than once", block.Name), block.Position)
+			}
+			names.Add(block.Name)
+			if _, err := collect(block.Children); err != nil {
+				return nil, err
+			}
+		}
+		return statements, nil
+	}
+
+	_, err := collect(statements)
+	return names, err
+}
+
+// mapBranches returns a copy of the condition or the loop with fn applied to each of its branches,
+// or the statement itself if it's neither. Parsed files are kept for recompilation, so they're left untouched.
+func mapBranches(statement runtime.Statement, fn func([]runtime.Statement) ([]runtime.Statement, error)) (runtime.Statement, error) {
+	switch statement := statement.(type) {
+	case *runtime.ForStatement:
+		body, err := fn(statement.Body)
+		if err != nil {
+			return nil, err
+		}
+		loop := *statement
+		loop.Body = body
+		return &loop, nil
+	case *runtime.IfStatement:
+		condition := *statement
+		var err error
+		if condition.Consequence, err = fn(statement.Consequence); err != nil {
+			return nil, err
+		}
+		if condition.Divergent, err = fn(statement.Divergent); err != nil {
+			return nil, err
+		}
+
+		condition.Alternatives = make([]*runtime.ElifBranch, len(statement.Alternatives))
+		for i, branch := range statement.Alternatives {
+			consequence, err := fn(branch.Consequence)
+			if err != nil {
+				return nil, err
+			}
+			condition.Alternatives[i] = &runtime.ElifBranch{Condition: branch.Condition, Consequence: consequence}
+		}
+		return &condition, nil
+	}
+
+	return statement, nil
+}
+
+// relativeTo returns the file of the location, which names of components are relative to, or filename if it's unknown.
+func relativeTo(filename string, location helpers.Location) string {
+	if location.File != "" {
+		return location.File
+	}
+	return filename
+}
+
 func foldTexts(statements []runtime.Statement) []runtime.Statement {
 	var result []runtime.Statement
 	for i, statement := range statements {
@@ -159,7 +765,7 @@ func foldTexts(statements []runtime.Statement) []runtime.Statement {
 
 		if text, ok := statement.(*runtime.Text); ok {
 			if lastText, ok := result[len(result)-1].(*runtime.Text); ok {
-				result[len(result)-1] = &runtime.Text{Content: lastText.Content + text.Content}
+				result[len(result)-1] = &runtime.Text{Content: lastText.Content + text.Content, Position: lastText.Position}
 				continue
 			}
 		}
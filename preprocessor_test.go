@@ -5,9 +5,19 @@ import (
 	"fmt"
 	"github.com/terawatthour/socks/runtime"
 	"io"
+	"strings"
 	"testing"
 )
 
+// preprocessFiles preprocesses the files given by their contents.
+func preprocessFiles(files map[string]string, staticContext runtime.Context) (map[string][]runtime.Statement, error) {
+	readers := make(map[string]io.Reader, len(files))
+	for name, content := range files {
+		readers[name] = bytes.NewBufferString(content)
+	}
+	return Preprocess(readers, staticContext, nil)
+}
+
 func TestPreprocessor(t *testing.T) {
 	layout := `<html><head><title>Abc</title></head><body><v-slot name="content"><v-component name="clock.html"></v-component></v-slot></body></html>`
 	index := `<v-component name="layout.html">
@@ -30,3 +40,378 @@ func TestPreprocessor(t *testing.T) {
 
 	fmt.Println(output.String())
 }
+
+func TestInheritance(t *testing.T) {
+	files := map[string]string{
+		"superbase.html": `<html><head><v-block name="head"><link rel="stylesheet" href="/base.css"></v-block></head><body><v-block name="body"><main><v-block name="content">empty</v-block></main></v-block></body></html>`,
+		"layouts/base.html": `<v-extends name="../superbase.html">
+	<v-block name="head"><v-super/><link rel="stylesheet" href="/app.css"></v-block>
+	<v-block name="content"><nav><v-component name="nav.html"></v-component></nav><v-block name="page">no page</v-block></v-block>
+</v-extends>`,
+		"layouts/nav.html": `<a href="/">Home</a>`,
+		"page.html": `<v-extends name="layouts/base.html">
+	<v-block name="head"><v-super/><title>{{ title }}</title></v-block>
+	<v-block name="page"><h1>{{ title }}</h1></v-block>
+</v-extends>`,
+	}
+
+	preprocessed, err := preprocessFiles(files, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	output := bytes.NewBufferString("")
+	if err := runtime.NewEvaluator(preprocessed["page.html"], nil).Evaluate(output, map[string]any{"title": "Hello"}); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `<html ><head ><link href="/base.css" rel="stylesheet" ><link href="/app.css" rel="stylesheet" ><title >Hello</title></head><body ><main ><nav ><a href="/" >Home</a></nav><h1 >Hello</h1></main></body></html>`
+	if output.String() != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, output.String())
+	}
+
+	// blocks nested in conditions and loops can be overridden as well
+	files = map[string]string{
+		"base.html": `<main><div :if="x"><v-block name="a">A</v-block></div><p :for="i in items"><v-block name="b">B</v-block></p></main>`,
+		"page.html": `<v-extends name="base.html"><v-block name="a">[<v-super/>]</v-block><v-block name="b">{{ i }}</v-block></v-extends>`,
+	}
+	if preprocessed, err = preprocessFiles(files, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	output.Reset()
+	if err := runtime.NewEvaluator(preprocessed["page.html"], nil).Evaluate(output, map[string]any{"x": true, "items": []int{1, 2}}); err != nil {
+		t.Fatal(err)
+	}
+	if expected := `<main ><div >[A]</div><p >1</p><p >2</p></main>`; output.String() != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, output.String())
+	}
+}
+
+func TestBranches(t *testing.T) {
+	files := map[string]string{
+		"item.html": `<b>{{ item ?: "none" }}</b>`,
+		"card.html": `<div><v-slot name="body">empty</v-slot></div>`,
+		"page.html": `<v-define name="tag" params="t"><i>{{ t }}</i></v-define><p :if="show"><v-component name="item.html"></v-component></p><p :else><v-use name="tag" t="hidden"/></p>
+<ul><li :for="item in items"><v-component name="item.html"></v-component><v-use name="tag" :t="item"/><v-component name="card.html"><template :slot="body">{{ item }}</template></v-component></li></ul>`,
+	}
+
+	// components, macros and slots are resolved inside conditions and loops as well
+	preprocessed, err := preprocessFiles(files, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sets := []struct {
+		context  map[string]any
+		expected string
+	}{
+		{map[string]any{"show": true, "items": []string{"a", "b"}}, "<p ><b >none</b></p>\n<ul ><li ><b >a</b><i >a</i><div >a</div></li><li ><b >b</b><i >b</i><div >b</div></li></ul>"},
+		{map[string]any{"show": false, "items": []string{}}, "<p ><i >hidden</i></p>\n<ul ></ul>"},
+	}
+
+	for _, set := range sets {
+		output := bytes.NewBufferString("")
+		if err := runtime.NewEvaluator(preprocessed["page.html"], nil).Evaluate(output, set.context); err != nil {
+			t.Fatal(err)
+		}
+		if output.String() != set.expected {
+			t.Errorf("expected\n%s\ngot\n%s", set.expected, output.String())
+		}
+	}
+}
+
+func TestInheritanceErrors(t *testing.T) {
+	sets := []struct {
+		files map[string]string
+		err   string
+	}{
+		{
+			map[string]string{"page.html": `<v-extends name="missing.html"></v-extends>`},
+			"page.html:1:1: layout `missing.html` not found",
+		},
+		{
+			map[string]string{"a.html": `<v-extends name="b.html"></v-extends>`, "b.html": `<v-extends name="a.html"></v-extends>`},
+			"cyclic import detected",
+		},
+		{
+			map[string]string{"base.html": `<v-block name="content">base</v-block>`, "page.html": `<v-extends name="base.html"><v-block name="other"></v-block></v-extends>`},
+			"page.html:1:29: block `other` is not defined in `base.html`",
+		},
+		{
+			map[string]string{"base.html": `<v-block name="content">base</v-block><p :if="x"><v-block name="content"></v-block></p>`, "page.html": `<v-extends name="base.html"></v-extends>`},
+			"base.html:1:50: block `content` is defined more than once",
+		},
+		{
+			map[string]string{"page.html": `<v-block name="content"><v-super/></v-block>`},
+			"page.html:1:25: `v-super` must be placed directly inside a block overriding another one",
+		},
+		{
+			map[string]string{"base.html": `<v-block name="content">base</v-block>`, "page.html": `<p></p><v-extends name="base.html"></v-extends>`},
+			"page.html:1:8: `v-extends` must be the only element of the template",
+		},
+		{
+			map[string]string{"base.html": `<v-block name="content">base</v-block>`, "page.html": `<v-extends name="base.html"><p></p></v-extends>`},
+			"page.html:1:29: unexpected element in `v-extends`, only blocks are allowed",
+		},
+	}
+
+	for _, set := range sets {
+		_, err := preprocessFiles(set.files, nil)
+		if err == nil || !strings.Contains(err.Error(), set.err) {
+			t.Errorf("expected error %q, got %v", set.err, err)
+		}
+	}
+}
+
+func TestProps(t *testing.T) {
+	files := map[string]string{
+		"button.html": `<v-props>
+	<v-prop name="label" required/>
+	<v-prop name="variant" default="secondary"/>
+	<v-prop name="size" :default="1 + 1"/>
+</v-props><button :class="variant">{{ label }} {{ size }}<v-slot name="icon"></v-slot></button>`,
+		"page.html": `<v-component name="button.html" :label="title + '!'" variant="primary"><v-slot name="icon">{{ label }}</v-slot></v-component><v-component name="button.html" label="Cancel"></v-component>{{ variant }}`,
+		"list.html": `<li :for="t in titles"><v-component :if="t" name="button.html" :label="t" :size="1"></v-component></li>`,
+	}
+
+	// props shadow the static context inside the component only
+	preprocessed, err := preprocessFiles(files, map[string]any{"variant": "static"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sets := []struct {
+		template string
+		context  map[string]any
+		expected string
+		err      string
+	}{
+		{"page.html", map[string]any{"title": "Save", "label": "outer", "size": 5}, `<button class="primary" >Save! 2outer</button><button class="secondary" >Cancel 2</button>static`, ""},
+		{"button.html", map[string]any{"label": "Alone", "variant": "primary"}, `<button class="primary" >Alone 2</button>`, ""},
+		{"list.html", map[string]any{"titles": []string{"A", "", "B"}}, `<li ><button class="secondary" >A 1</button></li><li ></li><li ><button class="secondary" >B 1</button></li>`, ""},
+		{"button.html", map[string]any{}, "", "button.html:2:2: missing required prop `label`"},
+	}
+
+	for _, set := range sets {
+		output := bytes.NewBufferString("")
+		err := runtime.NewEvaluator(preprocessed[set.template], nil).Evaluate(output, set.context)
+		if set.err != "" {
+			if err == nil || err.Error() != set.err {
+				t.Errorf("expected error %q, got %v", set.err, err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+		if output.String() != set.expected {
+			t.Errorf("expected\n%s\ngot\n%s", set.expected, output.String())
+		}
+	}
+}
+
+func TestPropsErrors(t *testing.T) {
+	sets := []struct {
+		files map[string]string
+		err   string
+	}{
+		{
+			map[string]string{"button.html": `<v-props><v-prop name="label" required/></v-props>{{ label }}`, "page.html": `<p>page</p>
+<v-component name="button.html"></v-component>`},
+			"page.html:2:1: missing required prop `label` of component `button.html`",
+		},
+		{
+			map[string]string{"page.html": `<div><v-props></v-props></div>`},
+			"page.html:1:6: `v-props` must be placed at the top level of the template",
+		},
+		{
+			map[string]string{"page.html": `<v-props><v-prop name="a" required default="1"/></v-props>`},
+			"page.html:1:45: prop `a` can have either a single default or be required",
+		},
+		{
+			map[string]string{"page.html": `<v-props><v-prop name="a"/><v-prop name="a"/></v-props>`},
+			"page.html:1:28: prop `a` is already declared",
+		},
+		{
+			map[string]string{"page.html": `<v-props><p></p></v-props>`},
+			"page.html:1:10: unexpected element in `v-props`, only `v-prop` elements are allowed",
+		},
+		{
+			map[string]string{"button.html": `button`, "page.html": `<v-component name="button.html" data-id="1"></v-component>`},
+			"page.html:1:42: invalid prop name `data-id`",
+		},
+		{
+			map[string]string{"list.html": `<v-slot name="row" :item="1">row</v-slot>`, "page.html": `<v-component name="list.html"><template :slot="row" :let="other"></template></v-component>`},
+			"page.html:1:1: slot `row` of component `list.html` doesn't expose `other`",
+		},
+		{
+			map[string]string{"page.html": `<p :let="item"></p>`},
+			"page.html:1:10: unexpected `:let` outside slot content",
+		},
+	}
+
+	for _, set := range sets {
+		_, err := preprocessFiles(set.files, nil)
+		if err == nil || !strings.Contains(err.Error(), set.err) {
+			t.Errorf("expected error %q, got %v", set.err, err)
+		}
+	}
+}
+
+func TestScopedSlots(t *testing.T) {
+	files := map[string]string{
+		"list.html":    `<v-props><v-prop name="items" required/></v-props><ul><li :for="item, i in items"><v-slot name="row" :item="item" :index="i">{{ item.Name }}</v-slot></li></ul>`,
+		"numbers.html": `<p :for="n in [1, 2]"><v-slot name="number" :n="n"></v-slot></p>`,
+		"page.html": `<v-component name="list.html" :items="users"><template :slot="row" :let="item, index">{{ index }}: {{ item.Name }}{{ suffix }}</template></v-component>
+<v-component name="numbers.html"><template :slot="number" :let="n">{{ n * 10 }}</template></v-component>`,
+	}
+
+	// bindings shadow the static context
+	preprocessed, err := preprocessFiles(files, map[string]any{"n": 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type User struct{ Name string }
+	users := []User{{"Ann"}, {"Bob"}}
+
+	sets := []struct {
+		template string
+		expected string
+	}{
+		{"page.html", "<ul ><li >0: Ann!</li><li >1: Bob!</li></ul>\n<p >10</p><p >20</p>"},
+		{"list.html", "<ul ><li >Ann</li><li >Bob</li></ul>"},
+	}
+
+	for _, set := range sets {
+		output := bytes.NewBufferString("")
+		if err := runtime.NewEvaluator(preprocessed[set.template], nil).Evaluate(output, map[string]any{"users": users, "items": users, "suffix": "!"}); err != nil {
+			t.Fatal(err)
+		}
+		if output.String() != set.expected {
+			t.Errorf("expected\n%s\ngot\n%s", set.expected, output.String())
+		}
+	}
+}
+
+func TestMacros(t *testing.T) {
+	files := map[string]string{
+		"macros.html": `<v-define name="badge" params="text, color"><span :class="color">{{ text }}</span></v-define>`,
+		"page.html": `<v-import from="macros.html"/><v-define name="icon" params="name"><i :class="'icon-' + name"></i></v-define>
+<v-use name="badge" text="New" color="green"/><v-use name="badge" :text="user" color="blue"/><v-use name="icon" :name="kind"/>`,
+	}
+
+	preprocessed, err := preprocessFiles(files, map[string]any{"kind": "star"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// calls with static arguments are inlined, the other ones are evaluated at runtime
+	scopes := 0
+	for _, statement := range preprocessed["page.html"] {
+		if _, ok := statement.(*runtime.Scope); ok {
+			scopes++
+		}
+	}
+	if scopes != 1 {
+		t.Errorf("expected a single call evaluated at runtime, got %d", scopes)
+	}
+
+	output := bytes.NewBufferString("")
+	if err := runtime.NewEvaluator(preprocessed["page.html"], nil).Evaluate(output, map[string]any{"user": "Ann"}); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "\n" + `<span class="green" >New</span><span class="blue" >Ann</span><i class="icon-star" ></i>`
+	if output.String() != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, output.String())
+	}
+
+	// nested calls are folded once each, the compilation would take ages otherwise
+	source := `<v-define name="m0" params="a">{{ a }}{{ user }}</v-define>`
+	for i := 1; i < 40; i++ {
+		source += fmt.Sprintf(`<v-define name="m%d" params="a">{{ a }}<v-use name="m%d" :a="a + 1"/></v-define>`, i, i-1)
+	}
+	preprocessed, err = preprocessFiles(map[string]string{"nested.html": source + `<v-use name="m39" :a="1"/>`}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	output.Reset()
+	if err := runtime.NewEvaluator(preprocessed["nested.html"], nil).Evaluate(output, map[string]any{"user": "Ann"}); err != nil {
+		t.Fatal(err)
+	}
+	if expected := "12345678910111213141516171819202122232425262728293031323334353637383940Ann"; output.String() != expected {
+		t.Errorf("expected %s, got %s", expected, output.String())
+	}
+
+	// calls aren't components, so slot content inside them is still evaluated in the context of the caller
+	files = map[string]string{
+		"card.html":  `<v-props><v-prop name="p"/></v-props><v-define name="m" params="a">{{ a }}<v-slot name="s">F</v-slot></v-define><v-use name="m" :a="x"/>`,
+		"slots.html": `<v-component name="card.html" p="P"><template :slot="s">[{{ p }}]</template></v-component>`,
+	}
+	if preprocessed, err = preprocessFiles(files, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	output.Reset()
+	if err := runtime.NewEvaluator(preprocessed["slots.html"], nil).Evaluate(output, map[string]any{"x": "X", "p": "outer"}); err != nil {
+		t.Fatal(err)
+	}
+	if expected := "X[outer]"; output.String() != expected {
+		t.Errorf("expected %s, got %s", expected, output.String())
+	}
+
+	// calls inside loops over the static context take the loop variables at runtime
+	files = map[string]string{
+		"loop.html": `<v-define name="badge" params="text"><span>{{ text }}{{ suffix }}</span></v-define><p :for="x in List"><v-use name="badge" :text="x"/></p>`,
+	}
+	if preprocessed, err = preprocessFiles(files, map[string]any{"List": []string{"a", "b"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	output.Reset()
+	if err := runtime.NewEvaluator(preprocessed["loop.html"], nil).Evaluate(output, map[string]any{"suffix": "!"}); err != nil {
+		t.Fatal(err)
+	}
+	if expected := "<p ><span >a!</span></p><p ><span >b!</span></p>"; output.String() != expected {
+		t.Errorf("expected %s, got %s", expected, output.String())
+	}
+}
+
+func TestMacrosErrors(t *testing.T) {
+	sets := []struct {
+		files map[string]string
+		err   string
+	}{
+		{
+			map[string]string{"page.html": `<v-use name="badge"/>`},
+			"page.html:1:1: macro `badge` is not defined",
+		},
+		{
+			map[string]string{"page.html": `<v-define name="badge" params="text">{{ text }}</v-define><v-use name="badge" color="red"/>`},
+			"page.html:1:86: macro `badge` has no parameter `color`",
+		},
+		{
+			map[string]string{"page.html": `<v-define name="a"><v-use name="b"/></v-define><v-define name="b"><v-use name="a"/></v-define><v-use name="a"/>`},
+			"page.html:1:67: macro `a` uses itself",
+		},
+		{
+			map[string]string{"page.html": `<v-import from="missing.html"/>`},
+			"page.html:1:1: imported file `missing.html` not found",
+		},
+		{
+			map[string]string{"page.html": `<div><v-define name="badge"></v-define></div>`},
+			"page.html:1:6: `v-define` must be placed at the top level of the template",
+		},
+	}
+
+	for _, set := range sets {
+		_, err := preprocessFiles(set.files, nil)
+		if err == nil || !strings.Contains(err.Error(), set.err) {
+			t.Errorf("expected error %q, got %v", set.err, err)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package socks
+
+import (
+	"bytes"
+	stderrors "errors"
+	"github.com/terawatthour/socks/internal/helpers"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"sync"
+)
+
+var bufferPool = sync.Pool{
+	New: func() any {
+		return new(bytes.Buffer)
+	},
+}
+
+// Render executes template and responds with its output and the provided status. The output is
+// buffered, so that a failed execution doesn't send a part of the page; in that case nothing is
+// written and the error is returned. The execution stops when the request is cancelled. Values
+// returned by Options.RequestGlobals for r are available to the template, with ctx taking
+// precedence. Responses to HEAD requests have no body.
+//
+// Content-Type is left as it is if already set, otherwise it's derived from the extension of
+// template and defaults to HTML.
+func (s *Socks) Render(w http.ResponseWriter, r *http.Request, status int, template string, ctx map[string]any) error {
+	buffer := bufferPool.Get().(*bytes.Buffer)
+	defer func() {
+		buffer.Reset()
+		bufferPool.Put(buffer)
+	}()
+
+	if s.options.RequestGlobals != nil {
+		ctx = helpers.Combine(s.options.RequestGlobals(r), ctx)
+	}
+
+	if err := s.ExecuteContext(r.Context(), buffer, template, ctx); err != nil {
+		return err
+	}
+
+	header := w.Header()
+	if header.Get("Content-Type") == "" {
+		header.Set("Content-Type", contentType(template))
+	}
+	header.Set("Content-Length", strconv.Itoa(buffer.Len()))
+	w.WriteHeader(status)
+
+	if r.Method == http.MethodHead {
+		return nil
+	}
+
+	_, err := buffer.WriteTo(w)
+	return err
+}
+
+// contentType returns the media type of the template based on its extension.
+func contentType(template string) string {
+	if typ := mime.TypeByExtension(path.Ext(template)); typ != "" {
+		return typ
+	}
+	return "text/html; charset=utf-8"
+}
+
+// Stream executes template like Render, but sends the output to the client whenever the template asks
+// for it, at `<v-flush/>` elements or after Options.FlushThreshold bytes, e.g. so that the browser
+// can load the stylesheets of the page while its body is still being rendered. Until the first flush
+// the output is buffered, and a failure returns the error without writing anything. Errors after
+// the first flush are passed to Options.OnStreamError instead, or returned if it's nil.
+func (s *Socks) Stream(w http.ResponseWriter, r *http.Request, status int, template string, ctx map[string]any) error {
+	if r.Method == http.MethodHead {
+		return s.Render(w, r, status, template, ctx)
+	}
+
+	if s.options.RequestGlobals != nil {
+		ctx = helpers.Combine(s.options.RequestGlobals(r), ctx)
+	}
+
+	stream := &streamWriter{
+		w:           w,
+		controller:  http.NewResponseController(w),
+		status:      status,
+		contentType: contentType(template),
+		buffer:      bufferPool.Get().(*bytes.Buffer),
+	}
+	defer func() {
+		stream.buffer.Reset()
+		bufferPool.Put(stream.buffer)
+	}()
+
+	if err := s.ExecuteContext(r.Context(), stream, template, ctx); err != nil {
+		if !stream.flushed || s.options.OnStreamError == nil {
+			return err
+		}
+		s.options.OnStreamError(r, err)
+		return nil
+	}
+
+	return stream.send()
+}
+
+// streamWriter buffers the output between flushes. The headers are sent with the first flush.
+type streamWriter struct {
+	w           http.ResponseWriter
+	controller  *http.ResponseController
+	status      int
+	contentType string
+	buffer      *bytes.Buffer
+	flushed     bool
+}
+
+func (sw *streamWriter) Write(p []byte) (int, error) {
+	return sw.buffer.Write(p)
+}
+
+// Flush sends the buffered output to the client.
+func (sw *streamWriter) Flush() error {
+	if err := sw.send(); err != nil {
+		return err
+	}
+
+	if err := sw.controller.Flush(); err != nil && !stderrors.Is(err, http.ErrNotSupported) {
+		return err
+	}
+	return nil
+}
+
+// send writes the headers, unless already sent, and the buffered output.
+func (sw *streamWriter) send() error {
+	if !sw.flushed {
+		if sw.w.Header().Get("Content-Type") == "" {
+			sw.w.Header().Set("Content-Type", sw.contentType)
+		}
+		sw.w.WriteHeader(sw.status)
+		sw.flushed = true
+	}
+
+	_, err := sw.buffer.WriteTo(sw.w)
+	return err
+}
@@ -0,0 +1,175 @@
+package socks
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"testing/fstest"
+)
+
+func TestRender(t *testing.T) {
+	s := New(&Options{
+		RequestGlobals: func(r *http.Request) map[string]any {
+			return map[string]any{"path": r.URL.Path, "locale": "en"}
+		},
+	})
+	if err := s.LoadTemplatesFS(fstest.MapFS{
+		"page.html":    {Data: []byte(`<p>{{ path }} {{ locale }}</p>`)},
+		"broken.html":  {Data: []byte(`<p>before</p>{{ missing.field }}`)},
+		"style.css":    {Data: []byte(`:root { --locale: {{ locale }}; }`)},
+		"override.css": {Data: []byte(`{{ locale }}`)},
+	}, "*"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Compile(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	sets := []struct {
+		name        string
+		method      string
+		template    string
+		context     map[string]any
+		contentType string
+		body        string
+	}{
+		{"html", http.MethodGet, "page.html", nil, "text/html; charset=utf-8", "<p >/index en</p>"},
+		{"context precedence", http.MethodGet, "page.html", map[string]any{"locale": "pl"}, "text/html; charset=utf-8", "<p >/index pl</p>"},
+		{"css", http.MethodGet, "style.css", nil, "text/css; charset=utf-8", `:root { --locale: en; }`},
+		{"head", http.MethodHead, "page.html", nil, "text/html; charset=utf-8", ""},
+	}
+
+	for _, set := range sets {
+		t.Run(set.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			if err := s.Render(recorder, httptest.NewRequest(set.method, "/index", nil), http.StatusCreated, set.template, set.context); err != nil {
+				t.Fatal(err)
+			}
+
+			if recorder.Code != http.StatusCreated {
+				t.Errorf("expected status %d, got %d", http.StatusCreated, recorder.Code)
+			}
+			if contentType := recorder.Header().Get("Content-Type"); contentType != set.contentType {
+				t.Errorf("expected content type %s, got %s", set.contentType, contentType)
+			}
+			if body := recorder.Body.String(); body != set.body {
+				t.Errorf("expected body `%s`, got `%s`", set.body, body)
+			}
+		})
+	}
+
+	t.Run("content type set by caller", func(t *testing.T) {
+		recorder := httptest.NewRecorder()
+		recorder.Header().Set("Content-Type", "application/json")
+		if err := s.Render(recorder, httptest.NewRequest(http.MethodGet, "/", nil), http.StatusOK, "override.css", nil); err != nil {
+			t.Fatal(err)
+		}
+		if contentType := recorder.Header().Get("Content-Type"); contentType != "application/json" {
+			t.Errorf("expected content type to be kept, got %s", contentType)
+		}
+	})
+
+	t.Run("failure", func(t *testing.T) {
+		recorder := httptest.NewRecorder()
+		if err := s.Render(recorder, httptest.NewRequest(http.MethodGet, "/", nil), http.StatusOK, "broken.html", nil); err == nil {
+			t.Fatal("expected an error")
+		}
+		if recorder.Body.Len() != 0 || recorder.Header().Get("Content-Type") != "" {
+			t.Errorf("expected nothing to be written, got `%s`", recorder.Body.String())
+		}
+	})
+}
+
+func TestStream(t *testing.T) {
+	var streamErr error
+	s := New(&Options{
+		OnStreamError: func(r *http.Request, err error) {
+			streamErr = err
+		},
+	})
+	if err := s.LoadTemplatesFS(fstest.MapFS{
+		"page.html":   {Data: []byte(`<head>{{ title }}</head><v-flush/><body>{{ body() }}</body>`)},
+		"late.html":   {Data: []byte(`<head></head><v-flush/>{{ missing.field }}`)},
+		"early.html":  {Data: []byte(`{{ missing.field }}<v-flush/>`)},
+		"inline.html": {Data: []byte(`<p :for="i in items">{{ i }}<v-flush :if="i == 1"/></p>`)},
+	}, "*"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Compile(map[string]any{"title": "Title"}); err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := httptest.NewRecorder()
+	var sent string
+	err := s.Stream(recorder, httptest.NewRequest(http.MethodGet, "/", nil), http.StatusOK, "page.html", map[string]any{
+		"body": func() string {
+			if recorder.Flushed {
+				sent = recorder.Body.String()
+			}
+			return "Body"
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "<head >Title</head>"; sent != expected {
+		t.Errorf("expected `%s` to be flushed before rendering the body, got `%s`", expected, sent)
+	}
+	if expected := "<head >Title</head><body >Body</body>"; recorder.Body.String() != expected {
+		t.Errorf("expected `%s`, got `%s`", expected, recorder.Body.String())
+	}
+
+	recorder = httptest.NewRecorder()
+	if err := s.Stream(recorder, httptest.NewRequest(http.MethodGet, "/", nil), http.StatusOK, "inline.html", map[string]any{"items": []int{1, 2}}); err != nil {
+		t.Fatal(err)
+	}
+	if expected := "<p >1</p><p >2</p>"; !recorder.Flushed || recorder.Body.String() != expected {
+		t.Errorf("expected `%s` with a flush, got `%s`", expected, recorder.Body.String())
+	}
+
+	recorder = httptest.NewRecorder()
+	if err := s.Stream(recorder, httptest.NewRequest(http.MethodGet, "/", nil), http.StatusOK, "late.html", nil); err != nil {
+		t.Errorf("expected errors after the first flush to be reported to the hook, got %v", err)
+	}
+	if streamErr == nil || recorder.Code != http.StatusOK || recorder.Body.String() != "<head ></head>" {
+		t.Errorf("expected the flushed part to be sent and the error reported, got `%s` and %v", recorder.Body.String(), streamErr)
+	}
+
+	streamErr = nil
+	recorder = httptest.NewRecorder()
+	if err := s.Stream(recorder, httptest.NewRequest(http.MethodGet, "/", nil), http.StatusOK, "early.html", nil); err == nil {
+		t.Error("expected errors before the first flush to be returned")
+	}
+	if streamErr != nil || recorder.Body.Len() != 0 || recorder.Flushed {
+		t.Errorf("expected nothing to be sent, got `%s`", recorder.Body.String())
+	}
+}
+
+func TestStreamThreshold(t *testing.T) {
+	s := New(&Options{FlushThreshold: 10})
+	if err := s.LoadTemplatesFS(fstest.MapFS{
+		"page.html": {Data: []byte(`{{ a }}{{ check() }}{{ b }}`)},
+	}, "*"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Compile(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := httptest.NewRecorder()
+	var sent string
+	err := s.Stream(recorder, httptest.NewRequest(http.MethodGet, "/", nil), http.StatusOK, "page.html", map[string]any{
+		"a": "0123456789",
+		"b": "short",
+		"check": func() string {
+			sent = recorder.Body.String()
+			return ""
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent != "0123456789" || recorder.Body.String() != "0123456789short" {
+		t.Errorf("expected the output to be flushed after the threshold, got `%s` then `%s`", sent, recorder.Body.String())
+	}
+}
@@ -0,0 +1,370 @@
+package runtime
+
+import (
+	"fmt"
+	"github.com/terawatthour/socks/expression"
+	"github.com/terawatthour/socks/internal/codec"
+	"github.com/terawatthour/socks/internal/helpers"
+	"math"
+	"reflect"
+	"slices"
+)
+
+// statement tags of the binary format
+const (
+	tagText byte = iota
+	tagAttribute
+	tagExpression
+	tagIf
+	tagFor
+	tagSlot
+	tagComponent
+	tagFlush
+	tagScope
+	tagCallerScope
+	tagDynamicComponent
+)
+
+// value tags of the binary format, for values known at compile time only
+const (
+	valueNil byte = iota
+	valueString
+	valueInt
+	valueFloat
+	valueBool
+	valueList
+	valueMap
+)
+
+// EncodeStatements writes the statement trees in the binary format used by the compiled templates cache.
+func EncodeStatements(w *codec.Writer, statements []Statement) {
+	w.Uint(uint64(len(statements)))
+	for _, statement := range statements {
+		encodeStatement(w, statement)
+	}
+}
+
+// DecodeStatements reads statement trees written by EncodeStatements.
+func DecodeStatements(r *codec.Reader) []Statement {
+	n := r.Length()
+	if n == 0 {
+		return nil
+	}
+
+	statements := make([]Statement, 0, n)
+	for i := 0; i < n; i++ {
+		statement := decodeStatement(r)
+		if statement == nil {
+			break
+		}
+		statements = append(statements, statement)
+	}
+
+	return statements
+}
+
+func encodeStatement(w *codec.Writer, statement Statement) {
+	switch st := statement.(type) {
+	case *Text:
+		w.Byte(tagText)
+		w.String(st.Content)
+		w.Location(st.Position)
+	case *Attribute:
+		w.Byte(tagAttribute)
+		w.String(st.Name)
+		expression.EncodeVM(w, st.Value)
+		w.Strings(st.Deps)
+		w.Int(int(st.Escape))
+	case *Expression:
+		w.Byte(tagExpression)
+		expression.EncodeVM(w, st.Program)
+		w.Strings(st.Deps)
+		w.Int(int(st.Escape))
+	case *IfStatement:
+		w.Byte(tagIf)
+		expression.EncodeVM(w, st.Program)
+		w.Strings(st.Deps)
+		EncodeStatements(w, st.Consequence)
+		w.Uint(uint64(len(st.Alternatives)))
+		for _, branch := range st.Alternatives {
+			expression.EncodeVM(w, branch.Condition)
+			EncodeStatements(w, branch.Consequence)
+		}
+		EncodeStatements(w, st.Divergent)
+	case *ForStatement:
+		w.Byte(tagFor)
+		expression.EncodeVM(w, st.Iterable)
+		w.String(st.KeyName)
+		w.String(st.ValueName)
+		EncodeStatements(w, st.Body)
+		w.Strings(st.Deps)
+		encodeValue(w, st.Values)
+	case *Slot:
+		w.Byte(tagSlot)
+		w.String(st.Name)
+		encodeProps(w, st.Props)
+		w.Strings(st.Let)
+		EncodeStatements(w, st.Children)
+		w.Location(st.Position)
+	case *Component:
+		w.Byte(tagComponent)
+		w.String(st.Name)
+		w.Location(st.Position)
+		encodeDefines(w, st.Defines, st.Lets)
+		encodeProps(w, st.Props)
+	case *DynamicComponent:
+		w.Byte(tagDynamicComponent)
+		expression.EncodeVM(w, st.Is)
+		encodeProps(w, st.Props)
+		encodeDefines(w, st.Defines, st.Lets)
+		w.Location(st.Position)
+	case *Flush:
+		w.Byte(tagFlush)
+		w.Location(st.Position)
+	case *Scope:
+		w.Byte(tagScope)
+		encodeProps(w, st.Props)
+		w.Uint(uint64(len(st.Declarations)))
+		for _, declaration := range st.Declarations {
+			w.String(declaration.Name)
+			w.Bool(declaration.Required)
+			w.Bool(declaration.Default != nil)
+			if declaration.Default != nil {
+				encodeProp(w, declaration.Default)
+			}
+			w.Location(declaration.Position)
+		}
+		w.Bool(st.Macro)
+		w.Bool(st.Root)
+		EncodeStatements(w, st.Children)
+		w.Location(st.Position)
+	case *CallerScope:
+		w.Byte(tagCallerScope)
+		encodeProps(w, st.Bindings)
+		EncodeStatements(w, st.Children)
+		w.Location(st.Position)
+	default:
+		w.Fail(fmt.Errorf("can't encode %s statement", statement.Kind()))
+	}
+}
+
+func decodeStatement(r *codec.Reader) Statement {
+	switch tag := r.Byte(); tag {
+	case tagText:
+		return &Text{Content: r.String(), Position: r.Location()}
+	case tagAttribute:
+		return &Attribute{Name: r.String(), Value: expression.DecodeVM(r), Deps: r.Strings(), Escape: EscapeContext(r.Int())}
+	case tagExpression:
+		return &Expression{Program: expression.DecodeVM(r), Deps: r.Strings(), Escape: EscapeContext(r.Int())}
+	case tagIf:
+		st := &IfStatement{Program: expression.DecodeVM(r), Deps: r.Strings()}
+		st.Consequence = DecodeStatements(r)
+		st.Alternatives = make([]*ElifBranch, r.Length())
+		for i := range st.Alternatives {
+			st.Alternatives[i] = &ElifBranch{Condition: expression.DecodeVM(r), Consequence: DecodeStatements(r)}
+		}
+		st.Divergent = DecodeStatements(r)
+		return st
+	case tagFor:
+		return &ForStatement{
+			Iterable:  expression.DecodeVM(r),
+			KeyName:   r.String(),
+			ValueName: r.String(),
+			Body:      DecodeStatements(r),
+			Deps:      r.Strings(),
+			Values:    decodeValue(r),
+		}
+	case tagSlot:
+		return &Slot{Name: r.String(), Props: decodeProps(r), Let: r.Strings(), Children: DecodeStatements(r), Position: r.Location()}
+	case tagComponent:
+		st := &Component{Name: r.String(), Position: r.Location()}
+		st.Defines, st.Lets = decodeDefines(r)
+		st.Props = decodeProps(r)
+		return st
+	case tagDynamicComponent:
+		st := &DynamicComponent{Is: expression.DecodeVM(r), Props: decodeProps(r)}
+		st.Defines, st.Lets = decodeDefines(r)
+		st.Position = r.Location()
+		return st
+	case tagFlush:
+		return &Flush{Position: r.Location()}
+	case tagScope:
+		st := &Scope{Props: decodeProps(r), Declarations: make([]*PropDeclaration, r.Length())}
+		for i := range st.Declarations {
+			declaration := &PropDeclaration{Name: r.String(), Required: r.Bool()}
+			if r.Bool() {
+				declaration.Default = decodeProp(r)
+			}
+			declaration.Position = r.Location()
+			st.Declarations[i] = declaration
+		}
+		st.Macro = r.Bool()
+		st.Root = r.Bool()
+		st.Children = DecodeStatements(r)
+		st.Position = r.Location()
+		return st
+	case tagCallerScope:
+		return &CallerScope{Bindings: decodeProps(r), Children: DecodeStatements(r), Position: r.Location()}
+	default:
+		r.Fail(fmt.Errorf("unknown statement tag %d", tag))
+		return nil
+	}
+}
+
+func encodeProps(w *codec.Writer, props []*Prop) {
+	w.Uint(uint64(len(props)))
+	for _, prop := range props {
+		encodeProp(w, prop)
+	}
+}
+
+func decodeProps(r *codec.Reader) []*Prop {
+	n := r.Length()
+	if n == 0 {
+		return nil
+	}
+
+	props := make([]*Prop, n)
+	for i := range props {
+		props[i] = decodeProp(r)
+	}
+	return props
+}
+
+// encodeProp writes the prop, whose value is either an expression or plain text.
+func encodeProp(w *codec.Writer, prop *Prop) {
+	w.String(prop.Name)
+	w.Bool(prop.Value != nil)
+	if prop.Value != nil {
+		expression.EncodeVM(w, prop.Value)
+		w.Strings(prop.Deps)
+	} else {
+		w.String(prop.Text)
+	}
+	w.Location(prop.Position)
+}
+
+func decodeProp(r *codec.Reader) *Prop {
+	prop := &Prop{Name: r.String()}
+	if r.Bool() {
+		prop.Value = expression.DecodeVM(r)
+		prop.Deps = r.Strings()
+	} else {
+		prop.Text = r.String()
+	}
+	prop.Position = r.Location()
+	return prop
+}
+
+// encodeDefines writes the contents passed to the slots of a component together with the names they bind.
+func encodeDefines(w *codec.Writer, defines map[string][]Statement, lets map[string][]string) {
+	names := make([]string, 0, len(defines))
+	for name := range defines {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	w.Strings(names)
+	for _, name := range names {
+		EncodeStatements(w, defines[name])
+		w.Strings(lets[name])
+	}
+}
+
+func decodeDefines(r *codec.Reader) (map[string][]Statement, map[string][]string) {
+	defines, lets := make(map[string][]Statement), make(map[string][]string)
+	for _, name := range r.Strings() {
+		defines[name] = DecodeStatements(r)
+		if let := r.Strings(); len(let) > 0 {
+			lets[name] = let
+		}
+	}
+	return defines, lets
+}
+
+// encodeValue writes a value of the static context. Only values of basic types without methods,
+// and slices, arrays and maps with string keys of them can be written, as the other ones couldn't be
+// restored as they were. Slices and arrays are read as []any and maps as map[string]any.
+func encodeValue(w *codec.Writer, value any) {
+	v := reflect.ValueOf(value)
+	for v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			break
+		}
+		v = v.Elem()
+	}
+
+	if !v.IsValid() || (v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface) && v.IsNil() {
+		w.Byte(valueNil)
+		return
+	}
+	if v.NumMethod() > 0 {
+		w.Fail(fmt.Errorf("can't encode value of type %s", v.Type()))
+		return
+	}
+
+	switch kind := v.Kind(); {
+	case kind == reflect.String:
+		w.Byte(valueString)
+		w.String(v.String())
+	case kind == reflect.Bool:
+		w.Byte(valueBool)
+		w.Bool(v.Bool())
+	case reflect.Int <= kind && kind <= reflect.Int64:
+		w.Byte(valueInt)
+		w.Int(int(v.Int()))
+	case reflect.Uint <= kind && kind <= reflect.Uintptr && v.Uint() <= math.MaxInt:
+		w.Byte(valueInt)
+		w.Int(int(v.Uint()))
+	case kind == reflect.Float32 || kind == reflect.Float64:
+		w.Byte(valueFloat)
+		w.Float(v.Float())
+	case kind == reflect.Slice || kind == reflect.Array:
+		w.Byte(valueList)
+		w.Uint(uint64(v.Len()))
+		for i := 0; i < v.Len(); i++ {
+			encodeValue(w, v.Index(i).Interface())
+		}
+	case kind == reflect.Map && v.Type().Key().Kind() == reflect.String:
+		w.Byte(valueMap)
+		keys := helpers.SortedMapKeys(v)
+		w.Uint(uint64(len(keys)))
+		for _, key := range keys {
+			w.String(key.String())
+			encodeValue(w, v.MapIndex(key).Interface())
+		}
+	default:
+		w.Fail(fmt.Errorf("can't encode value of type %s", v.Type()))
+	}
+}
+
+func decodeValue(r *codec.Reader) any {
+	switch tag := r.Byte(); tag {
+	case valueNil:
+		return nil
+	case valueString:
+		return r.String()
+	case valueInt:
+		return r.Int()
+	case valueFloat:
+		return r.Float()
+	case valueBool:
+		return r.Bool()
+	case valueList:
+		list := make([]any, r.Length())
+		for i := range list {
+			list[i] = decodeValue(r)
+		}
+		return list
+	case valueMap:
+		n := r.Length()
+		entries := make(map[string]any, n)
+		for i := 0; i < n; i++ {
+			key := r.String()
+			entries[key] = decodeValue(r)
+		}
+		return entries
+	default:
+		r.Fail(fmt.Errorf("unknown value tag %d", tag))
+		return nil
+	}
+}
@@ -0,0 +1,158 @@
+package runtime
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/terawatthour/socks/expression"
+	"html"
+	"strings"
+)
+
+// EscapeContext describes where in the document the value of an expression is printed,
+// which determines how it has to be escaped.
+type EscapeContext int
+
+const (
+	// EscapeText is used for expressions in text nodes.
+	EscapeText EscapeContext = iota
+	// EscapeAttribute is used for values of ordinary attributes.
+	EscapeAttribute
+	// EscapeURL is used for values of attributes holding URLs, e.g. href or src.
+	EscapeURL
+	// EscapeScript is used inside <script> elements and event handler attributes.
+	EscapeScript
+	// EscapeStyle is used inside <style> elements and style attributes.
+	EscapeStyle
+	// EscapeSrcset is used for srcset attributes, whose values are lists of URLs.
+	EscapeSrcset
+)
+
+// unsafeValue replaces values that can't be made safe by escaping, same as in html/template.
+const unsafeValue = "ZgotmplZ"
+
+// escape stringifies value for the provided context. Values wrapped with raw() are printed as they are.
+// The sanitizer, if provided, replaces the default escaping of text nodes.
+func escape(value any, context EscapeContext, sanitizer func(string) string) string {
+	if raw, ok := value.(expression.Raw); ok {
+		return raw.String()
+	}
+
+	switch context {
+	case EscapeAttribute:
+		return html.EscapeString(fmt.Sprint(value))
+	case EscapeURL:
+		return html.EscapeString(escapeURL(fmt.Sprint(value)))
+	case EscapeSrcset:
+		return html.EscapeString(escapeSrcset(fmt.Sprint(value)))
+	case EscapeScript:
+		return escapeScript(value)
+	case EscapeStyle:
+		return escapeStyle(fmt.Sprint(value))
+	default:
+		if sanitizer != nil {
+			return sanitizer(fmt.Sprint(value))
+		}
+		return html.EscapeString(fmt.Sprint(value))
+	}
+}
+
+// escapeInAttribute escapes value for the provided context and then for being placed in a quoted attribute value.
+func escapeInAttribute(value any, context EscapeContext) string {
+	if raw, ok := value.(expression.Raw); ok {
+		return raw.String()
+	}
+
+	switch context {
+	case EscapeScript, EscapeStyle:
+		return html.EscapeString(escape(value, context, nil))
+	default:
+		return escape(value, context, nil)
+	}
+}
+
+// escapeURL rejects URLs with schemes other than http, https, mailto and tel, and percent-encodes
+// characters that aren't allowed in URLs, leaving already encoded sequences intact.
+func escapeURL(url string) string {
+	if i := strings.IndexAny(url, ":/?#"); i != -1 && url[i] == ':' {
+		switch strings.ToLower(url[:i]) {
+		case "http", "https", "mailto", "tel":
+		default:
+			return "#" + unsafeValue
+		}
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(url); i++ {
+		c := url[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+			b.WriteByte(c)
+		case strings.IndexByte("-._~:/?#[]@!$&'()*+,;=%", c) != -1:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+
+	return b.String()
+}
+
+// escapeSrcset escapes each candidate of a srcset separately, as a URL followed by an optional
+// descriptor, e.g. `2x` or `480w`. Candidates with other descriptors are rejected.
+func escapeSrcset(srcset string) string {
+	candidates := strings.Split(srcset, ",")
+	for i, candidate := range candidates {
+		fields := strings.Fields(candidate)
+		switch {
+		case len(fields) == 0:
+			candidates[i] = ""
+		case len(fields) > 2 || len(fields) == 2 && !isDescriptor(fields[1]):
+			candidates[i] = "#" + unsafeValue
+		default:
+			fields[0] = escapeURL(fields[0])
+			candidates[i] = strings.Join(fields, " ")
+		}
+	}
+
+	return strings.Join(candidates, ", ")
+}
+
+// isDescriptor reports whether the srcset descriptor is a number followed by a unit.
+func isDescriptor(descriptor string) bool {
+	number := strings.TrimRight(descriptor, "wxh")
+	if number == "" || len(descriptor)-len(number) > 1 {
+		return false
+	}
+
+	for _, c := range number {
+		if (c < '0' || c > '9') && c != '.' {
+			return false
+		}
+	}
+	return true
+}
+
+// escapeScript prints value as a JavaScript value. json.Marshal escapes <, > and &, so the
+// result can't close the surrounding script element.
+func escapeScript(value any) string {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		encoded, _ = json.Marshal(fmt.Sprint(value))
+	}
+
+	return string(encoded)
+}
+
+// escapeStyle allows only CSS values that can't leave the declaration they're placed in.
+func escapeStyle(value string) string {
+	if strings.ContainsAny(value, "\"'()/;@[\\]`{}<>&\n\r") {
+		return unsafeValue
+	}
+
+	lower := strings.ToLower(value)
+	if strings.Contains(lower, "expression") || strings.Contains(lower, "javascript") || strings.Contains(lower, "url") {
+		return unsafeValue
+	}
+
+	return value
+}
@@ -0,0 +1,41 @@
+package runtime
+
+import (
+	"github.com/terawatthour/socks/expression"
+	"testing"
+)
+
+func TestEscape(t *testing.T) {
+	sets := []struct {
+		value    any
+		context  EscapeContext
+		expected string
+	}{
+		{`<b title="x">&</b>`, EscapeText, `&lt;b title=&#34;x&#34;&gt;&amp;&lt;/b&gt;`},
+		{expression.Raw{Value: `<b>`}, EscapeText, `<b>`},
+		{`"onmouseover="alert(1)`, EscapeAttribute, `&#34;onmouseover=&#34;alert(1)`},
+		{`javascript:alert(1)`, EscapeURL, `#ZgotmplZ`},
+		{` JavaScript:alert(1)`, EscapeURL, `#ZgotmplZ`},
+		{`/search?q=a b&lang=en`, EscapeURL, `/search?q=a%20b&amp;lang=en`},
+		{`https://example.com/"><script>`, EscapeURL, `https://example.com/%22%3E%3Cscript%3E`},
+		{`/a.png 1x,/b<c.png 2x`, EscapeSrcset, `/a.png 1x, /b%3Cc.png 2x`},
+		{`/a.png, javascript:alert(1) 2x`, EscapeSrcset, `/a.png, #ZgotmplZ 2x`},
+		{`/a.png 1x onerror=alert(1)`, EscapeSrcset, `#ZgotmplZ`},
+		{`/a.png" 480w`, EscapeSrcset, `/a.png%22 480w`},
+		{`</script><script>alert(1)`, EscapeScript, `"\u003c/script\u003e\u003cscript\u003ealert(1)"`},
+		{map[string]any{"id": 1}, EscapeScript, `{"id":1}`},
+		{`#fff`, EscapeStyle, `#fff`},
+		{`red; background: url(javascript:alert(1))`, EscapeStyle, `ZgotmplZ`},
+		{`</style>`, EscapeStyle, `ZgotmplZ`},
+	}
+
+	for i, set := range sets {
+		if result := escape(set.value, set.context, nil); result != set.expected {
+			t.Errorf("set %d: expected `%s`, got `%s`", i, set.expected, result)
+		}
+	}
+
+	if result := escapeInAttribute(`a" b`, EscapeScript); result != `&#34;a\&#34; b&#34;` {
+		t.Errorf("expected script in attribute to be escaped twice, got `%s`", result)
+	}
+}
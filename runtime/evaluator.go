@@ -1,21 +1,73 @@
 package runtime
 
 import (
+	stdcontext "context"
+	stderrors "errors"
 	"fmt"
 	"github.com/terawatthour/socks/errors"
+	"github.com/terawatthour/socks/expression"
 	"github.com/terawatthour/socks/internal/helpers"
 	"io"
 	"reflect"
+	"sync"
 )
 
+var framePool = sync.Pool{
+	New: func() any {
+		return expression.NewFrame()
+	},
+}
+
+// Evaluator renders a list of statements. The compiled statements are shared, while everything
+// specific to a single render lives in a copy of the evaluator made by Evaluate, which makes
+// it safe to evaluate the same template from multiple goroutines.
 type Evaluator struct {
 	programs []Statement
 
+	// Repanic lets panics raised during Evaluate propagate, instead of returning them as errors.
+	// Their stack trace is kept, which is useful for debugging.
+	Repanic bool
+
+	// FlushThreshold flushes the output automatically once that many bytes were written since the last flush.
+	// Flushing only happens if the writer passed to Evaluate is a Flusher. Zero disables it.
+	FlushThreshold int
+
+	// Limits bound the resources used by a single execution.
+	Limits Limits
+
+	// Sandbox restricts the reflection access of expressions, nil means no restrictions.
+	Sandbox *expression.Sandbox
+
+	// TaggedFields names struct fields by their `socks` tags, falling back to their `json` tags.
+	TaggedFields bool
+
+	// Components resolves the names of dynamic components to their statements.
+	Components func(name string) ([]Statement, error)
+
 	staticOutput *helpers.Queue[Statement]
-	writer       io.Writer
 	staticMode   bool
-	context      map[string]any
 	sanitizer    func(string) string
+
+	// per-execution state
+	ctx       stdcontext.Context
+	writer    io.Writer
+	flusher   Flusher
+	unflushed int
+	written   int
+	frame     *expression.Frame
+	current   Statement
+
+	// callers are the contexts of the callers of the components being evaluated, innermost last
+	callers []Context
+
+	// components are the dynamic components being evaluated, innermost last
+	components []*componentFrame
+}
+
+// Flusher is implemented by writers that can send the output written so far to the client,
+// which they're asked to do at `<v-flush/>` elements and after FlushThreshold bytes.
+type Flusher interface {
+	Flush() error
 }
 
 func NewEvaluator(programs []Statement, sanitizer func(string) string) *Evaluator {
@@ -26,12 +78,51 @@ func NewStaticEvaluator(output *helpers.Queue[Statement], programs []Statement,
 	return &Evaluator{staticOutput: output, programs: programs, staticMode: true, sanitizer: sanitizer}
 }
 
+// Statements returns the statements evaluated by e.
+func (e *Evaluator) Statements() []Statement {
+	return e.programs
+}
+
+// Evaluate writes the output of the statements to writer. A panic during the evaluation, e.g. raised
+// by a function called from a template, is returned as an *errors.Error located at the expression
+// being evaluated, unless Repanic is set.
 func (e *Evaluator) Evaluate(writer io.Writer, context Context) error {
-	e.writer = writer
-	e.context = context
+	return e.EvaluateContext(stdcontext.Background(), writer, context)
+}
+
+// EvaluateContext is like Evaluate, but stops once ctx is done, returning its error located at
+// the statement where the evaluation stopped. ctx is passed to called functions taking a context.Context.
+func (e *Evaluator) EvaluateContext(ctx stdcontext.Context, writer io.Writer, context Context) (err error) {
+	if e.Limits.Timeout > 0 {
+		var cancel stdcontext.CancelFunc
+		ctx, cancel = stdcontext.WithTimeoutCause(ctx, e.Limits.Timeout, errTimeout)
+		defer cancel()
+	}
+
+	execution := *e
+	execution.ctx = ctx
+	execution.writer = writer
+	execution.flusher, _ = writer.(Flusher)
+	execution.frame = framePool.Get().(*expression.Frame)
+	execution.frame.SetContext(ctx)
+	execution.frame.SetInstructionLimit(e.Limits.Instructions)
+	execution.frame.SetLengthLimit(e.Limits.LoopIterations)
+	execution.frame.SetSandbox(e.Sandbox)
+	execution.frame.SetTaggedFields(e.TaggedFields)
+	defer func() {
+		execution.frame.SetContext(nil)
+		execution.frame.SetInstructionLimit(0)
+		execution.frame.SetLengthLimit(0)
+		execution.frame.SetSandbox(nil)
+		execution.frame.SetTaggedFields(false)
+		framePool.Put(execution.frame)
+	}()
+	if !e.Repanic {
+		defer execution.recoverPanic(&err)
+	}
 
-	for _, program := range e.programs {
-		if err := e.evaluateProgram(program, e.context); err != nil {
+	for _, program := range execution.programs {
+		if err := execution.evaluateProgram(program, context); err != nil {
 			return err
 		}
 	}
@@ -39,9 +130,39 @@ func (e *Evaluator) Evaluate(writer io.Writer, context Context) error {
 	return nil
 }
 
+// run executes the program using the frame of the current execution. Errors of the program
+// are annotated with its source.
+func (e *Evaluator) run(program *expression.VM, context Context) (any, error) {
+	result, err := program.RunFrame(e.frame, context)
+	var located *errors.Error
+	if stderrors.As(err, &located) && located.Expression == "" {
+		located.Expression = program.Source()
+	}
+	return result, err
+}
+
+// printable returns an error if the result of the program is a function or the sandbox forbids printing it.
+func (e *Evaluator) printable(program *expression.VM, result any) error {
+	if _, ok := result.(*expression.Function); ok || reflect.ValueOf(result).Kind() == reflect.Func {
+		return &errors.Error{Message: fmt.Sprintf("can't print function <%T>", result), Location: program.Location(), Expression: program.Source()}
+	}
+	if err := e.Sandbox.Printable(result, e.TaggedFields); err != nil {
+		return &errors.Error{Message: err.Error(), Location: program.Location(), Expression: program.Source()}
+	}
+	return nil
+}
+
 func (e *Evaluator) evaluateProgram(program Statement, context Context) error {
-	if text, ok := program.(*Text); ok {
-		return e.write(text.Content)
+	e.current = program
+	switch program := program.(type) {
+	case *Text:
+		return e.write(program.Content)
+	case *Flush:
+		if e.staticMode {
+			e.staticOutput.Push(program)
+			return nil
+		}
+		return e.flush()
 	}
 
 	// Evaluable programs (If, For, Expression) can be evaluated both at compile time and at runtime.
@@ -58,14 +179,77 @@ func (e *Evaluator) evaluateProgram(program Statement, context Context) error {
 	return prog.Evaluate(e, context)
 }
 
+// evaluateBlock evaluates the statements in order, in the provided context.
+func (e *Evaluator) evaluateBlock(statements []Statement, context Context) error {
+	for _, statement := range statements {
+		if err := e.evaluateProgram(statement, context); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// fold evaluates the statements statically in the provided context and returns the resulting statements,
+// instead of adding them to the static output.
+func (e *Evaluator) fold(statements []Statement, context Context) ([]Statement, error) {
+	output := e.staticOutput
+	defer func() {
+		e.staticOutput = output
+	}()
+
+	var folded helpers.Queue[Statement]
+	e.staticOutput = &folded
+	if err := e.evaluateBlock(statements, context); err != nil {
+		return nil, err
+	}
+
+	return folded, nil
+}
+
+// recoverPanic turns a panic into an error located at the instruction of the interrupted expression,
+// or at the statement being evaluated if the panic wasn't raised inside an expression.
+func (e *Evaluator) recoverPanic(err *error) {
+	r := recover()
+	if r == nil {
+		return
+	}
+
+	location, source, ok := e.frame.Interrupted()
+	if !ok && e.current != nil {
+		location = e.current.Location()
+	}
+
+	*err = &errors.Error{Message: fmt.Sprintf("panic: %v", r), Location: location, Expression: source}
+}
+
 func (e *Evaluator) write(data any) error {
 	if !e.staticMode {
-		_, err := fmt.Fprint(e.writer, data)
-		return err
+		output := fmt.Sprint(data)
+		if err := e.checkOutput(len(output)); err != nil {
+			return err
+		}
+
+		n, err := io.WriteString(e.writer, output)
+		if err != nil {
+			return err
+		}
+
+		e.written += n
+		e.unflushed += n
+		if e.FlushThreshold > 0 && e.unflushed >= e.FlushThreshold {
+			return e.flush()
+		}
+		return nil
 	}
 
 	if text, ok := data.(string); ok {
-		e.staticOutput.Push(&Text{Content: text})
+		// folded text is output of every execution, so it's bounded already during the compilation
+		if err := e.checkOutput(len(text)); err != nil {
+			return err
+		}
+		e.written += len(text)
+		e.staticOutput.Push(&Text{Content: text, Position: e.currentLocation()})
 	} else {
 		e.staticOutput.Push(data.(Statement))
 	}
@@ -73,6 +257,52 @@ func (e *Evaluator) write(data any) error {
 	return nil
 }
 
+// errTimeout is the cause of the cancellation of executions exceeding Limits.Timeout.
+var errTimeout = fmt.Errorf("%w: %w", errors.ErrLimitExceeded, stdcontext.DeadlineExceeded)
+
+// currentLocation returns the location of the statement being evaluated, if any.
+func (e *Evaluator) currentLocation() helpers.Location {
+	if e.current == nil {
+		return helpers.Location{}
+	}
+	return e.current.Location()
+}
+
+// checkContext returns the error of the context of the execution located at location, if it's done.
+func (e *Evaluator) checkContext(location helpers.Location) error {
+	if e.ctx == nil {
+		return nil
+	}
+
+	if err := e.ctx.Err(); err != nil {
+		if cause := stdcontext.Cause(e.ctx); cause == errTimeout {
+			located := errors.LimitExceeded(fmt.Sprintf("%s of rendering time", e.Limits.Timeout), location)
+			located.Err = cause
+			return located
+		}
+		return errors.Wrap(err, location)
+	}
+	return nil
+}
+
+// checkOutput returns an error if writing n more bytes would exceed the output limit.
+func (e *Evaluator) checkOutput(n int) error {
+	if e.Limits.OutputBytes > 0 && e.written+n > e.Limits.OutputBytes {
+		return errors.LimitExceeded(fmt.Sprintf("%d bytes of output", e.Limits.OutputBytes), e.currentLocation())
+	}
+	return nil
+}
+
+// flush asks the writer to send the output written so far, if it's a Flusher.
+func (e *Evaluator) flush() error {
+	if e.flusher == nil {
+		return nil
+	}
+
+	e.unflushed = 0
+	return e.flusher.Flush()
+}
+
 func (e *Evaluator) error(message string, location helpers.Location) error {
 	return errors.New(message, location)
 }
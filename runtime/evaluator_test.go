@@ -2,30 +2,43 @@ package runtime
 
 import (
 	"bytes"
+	"github.com/terawatthour/socks/expression"
 	"github.com/terawatthour/socks/internal/helpers"
 	"testing"
 )
 
-func TestLoopsAndIfs(t *testing.T) {
-	template := `@if (1==1) @for (a in A with i) @if (i % 2 == 0) {{ a }} says hello! @endif @endfor @endif`
-	elements, err := tokenizer.Tokenize("debug.txt", template)
+func mustCreate(t *testing.T, source string) (*expression.VM, []string) {
+	t.Helper()
+	vm, deps, err := expression.Create(source, helpers.Location{File: "debug.html", Line: 1, Column: 1})
 	if err != nil {
-		t.Errorf("unexpected error: %s", err)
-		return
+		t.Fatalf("unexpected error: %s", err)
 	}
+	return vm, deps
+}
 
-	programs, err := Parse(helpers.File{"debug.txt", template}, elements)
-	if err != nil {
-		t.Errorf("unexpected error: %s", err)
-		return
+func TestLoopsAndIfs(t *testing.T) {
+	outer, outerDeps := mustCreate(t, "1 == 1")
+	iterable, iterableDeps := mustCreate(t, "A")
+	inner, innerDeps := mustCreate(t, "i % 2 == 0")
+	value, valueDeps := mustCreate(t, "a")
+
+	programs := []Statement{
+		&IfStatement{Program: outer, Deps: outerDeps, Consequence: []Statement{
+			&ForStatement{Iterable: iterable, ValueName: "a", KeyName: "i", Deps: iterableDeps, Body: []Statement{
+				&IfStatement{Program: inner, Deps: innerDeps, Consequence: []Statement{
+					&Expression{Program: value, Deps: valueDeps},
+					&Text{Content: " says hello! "},
+				}},
+			}},
+		}},
 	}
 
 	evaluated := bytes.NewBufferString("")
-	if err := newEvaluator(helpers.File{"debug.txt", template}, programs, nil).evaluate(evaluated, map[string]interface{}{"A": []string{"a", "b", "c"}}); err != nil {
+	if err := NewEvaluator(programs, nil).Evaluate(evaluated, map[string]any{"A": []string{"a", "b", "c"}}); err != nil {
 		t.Errorf("unexpected error: %s", err)
 		return
 	}
-	expected := `   a says hello!      c says hello!   `
+	expected := `a says hello! c says hello! `
 	if expected != evaluated.String() {
 		t.Errorf("expected `%s`, got `%s`", expected, evaluated)
 	}
@@ -0,0 +1,26 @@
+package runtime
+
+import (
+	"time"
+)
+
+// Limits bound the resources a single execution may use, e.g. for templates edited by untrusted users.
+// Exceeding any of them aborts the execution with an *errors.Error naming the limit, located where
+// it was hit, which wraps errors.ErrLimitExceeded. Zero values mean no limit.
+type Limits struct {
+	// Instructions is the number of expression instructions executed in total.
+	Instructions int
+
+	// LoopIterations is the number of iterations of a single `:for` loop, and the length of lists built by range.
+	LoopIterations int
+
+	// OutputBytes is the size of the output.
+	OutputBytes int
+
+	// ComponentDepth is the depth of nested components, it's checked during compilation,
+	// and for dynamic components when they're evaluated.
+	ComponentDepth int
+
+	// Timeout is the wall-clock duration of the execution.
+	Timeout time.Duration
+}
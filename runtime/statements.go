@@ -2,9 +2,11 @@ package runtime
 
 import (
 	"fmt"
+	"github.com/terawatthour/socks/errors"
 	"github.com/terawatthour/socks/expression"
 	"github.com/terawatthour/socks/internal/helpers"
 	"maps"
+	"slices"
 )
 
 type Context = map[string]any
@@ -21,7 +23,8 @@ type Evaluable interface {
 }
 
 type Text struct {
-	Content string
+	Content  string
+	Position helpers.Location
 }
 
 func (t *Text) Kind() string {
@@ -29,13 +32,27 @@ func (t *Text) Kind() string {
 }
 
 func (t *Text) Location() helpers.Location {
-	panic("unreachable")
+	return t.Position
+}
+
+// Flush marks a point of the template at which the output written so far is flushed to the client.
+type Flush struct {
+	Position helpers.Location
+}
+
+func (f *Flush) Kind() string {
+	return "flush"
+}
+
+func (f *Flush) Location() helpers.Location {
+	return f.Position
 }
 
 type Attribute struct {
-	Name  string
-	Value *expression.VM
-	Deps  helpers.Set[string]
+	Name   string
+	Value  *expression.VM
+	Deps   helpers.Set[string]
+	Escape EscapeContext
 }
 
 func (a *Attribute) Kind() string {
@@ -43,20 +60,23 @@ func (a *Attribute) Kind() string {
 }
 
 func (a *Attribute) Dependencies() []string {
-	return nil
+	return a.Deps
 }
 
 func (a *Attribute) Evaluate(e *Evaluator, context Context) error {
-	res, err := a.Value.Run(context)
+	res, err := e.run(a.Value, context)
 	if err != nil {
 		return err
 	}
+	if err := e.printable(a.Value, res); err != nil {
+		return err
+	}
 
-	return e.write(fmt.Sprintf(`%s="%s" `, a.Name, res))
+	return e.write(fmt.Sprintf(`%s="%s" `, a.Name, escapeInAttribute(res, a.Escape)))
 }
 
 func (a *Attribute) Location() helpers.Location {
-	panic("unreachable")
+	return a.Value.Location()
 }
 
 // ---------------------- Expression Statement ----------------------
@@ -64,23 +84,20 @@ func (a *Attribute) Location() helpers.Location {
 type Expression struct {
 	Program *expression.VM
 	//tag          *tokenizer.Mustache
-	Deps []string
+	Deps   []string
+	Escape EscapeContext
 }
 
 func (expr *Expression) Evaluate(e *Evaluator, context Context) (err error) {
-	result, err := expr.Program.Run(context)
+	result, err := e.run(expr.Program, context)
 	if err != nil {
 		return err
 	}
-
-	stringified := fmt.Sprintf("%v", result)
-	if e.sanitizer != nil {
-		if _, ok := result.(expression.Raw); !ok {
-			stringified = e.sanitizer(fmt.Sprintf("%v", result))
-		}
+	if err := e.printable(expr.Program, result); err != nil {
+		return err
 	}
 
-	return e.write(stringified)
+	return e.write(escape(result, expr.Escape, e.sanitizer))
 }
 
 func (expr *Expression) Dependencies() []string {
@@ -88,8 +105,7 @@ func (expr *Expression) Dependencies() []string {
 }
 
 func (expr *Expression) Location() helpers.Location {
-	panic("unreacahble")
-	//return expr.tag.Location
+	return expr.Program.Location()
 }
 
 func (expr *Expression) Kind() string {
@@ -99,9 +115,8 @@ func (expr *Expression) Kind() string {
 // ---------------------- If Statement ----------------------
 
 type IfStatement struct {
-	Program  *expression.VM
-	location helpers.Location
-	Deps     helpers.Set[string]
+	Program *expression.VM
+	Deps    helpers.Set[string]
 
 	Consequence  []Statement
 	Alternatives []*ElifBranch
@@ -113,7 +128,7 @@ func (st *IfStatement) Dependencies() []string {
 }
 
 func (st *IfStatement) Location() helpers.Location {
-	return st.location
+	return st.Program.Location()
 }
 
 func (st *IfStatement) Kind() string {
@@ -131,7 +146,11 @@ func (st *IfStatement) Evaluate(e *Evaluator, context Context) error {
 		return nil
 	}
 
-	result, err := st.Program.Run(context)
+	if err := e.checkContext(st.Location()); err != nil {
+		return err
+	}
+
+	result, err := e.run(st.Program, context)
 	if err != nil {
 		return err
 	}
@@ -141,7 +160,7 @@ func (st *IfStatement) Evaluate(e *Evaluator, context Context) error {
 	}
 
 	for _, branch := range st.Alternatives {
-		result, err := branch.Condition.Run(context)
+		result, err := e.run(branch.Condition, context)
 		if err != nil {
 			return err
 		}
@@ -165,9 +184,12 @@ type ForStatement struct {
 	Iterable  *expression.VM
 	KeyName   string
 	ValueName string
-	location  helpers.Location
 	Body      []Statement
 	Deps      helpers.Set[string]
+
+	// Values is the value of Iterable evaluated at compile time, for loops over the static context
+	// which are left for the runtime, as their bodies bind the loop variables at runtime
+	Values any
 }
 
 func (st *ForStatement) Dependencies() []string {
@@ -175,7 +197,7 @@ func (st *ForStatement) Dependencies() []string {
 }
 
 func (st *ForStatement) Location() helpers.Location {
-	return st.location
+	return st.Iterable.Location()
 }
 
 func (st *ForStatement) Kind() string {
@@ -183,41 +205,69 @@ func (st *ForStatement) Kind() string {
 }
 
 func (st *ForStatement) Evaluate(e *Evaluator, context Context) error {
-	obj, err := st.Iterable.Run(context)
-	if err != nil {
-		return err
+	obj := st.Values
+	if obj == nil {
+		var err error
+		if obj, err = e.run(st.Iterable, context); err != nil {
+			return err
+		}
 	}
 
 	if !helpers.IsIterable(obj) {
-		return e.error(fmt.Sprintf("expected <slice | array | map>, got <%T>", obj), st.location)
+		return e.error(fmt.Sprintf("expected <slice | array | map>, got <%T>", obj), st.Location())
 	}
 
-	channel := make(chan helpers.KeyValuePair)
-	go func() {
-		helpers.ExtractValues(channel, obj)
-		close(channel)
-	}()
+	// the values of the iterations are lost once the loop is unrolled, so the loop is kept
+	// together with the value of the iterable, which may be known at compile time only
+	if e.staticMode && hasBindings(st.Body) {
+		ctx := make(Context, len(context))
+		maps.Copy(ctx, context)
+		delete(ctx, st.KeyName)
+		delete(ctx, st.ValueName)
+
+		body, err := e.fold(st.Body, ctx)
+		if err != nil {
+			return err
+		}
+		e.staticOutput.Push(&ForStatement{Iterable: st.Iterable, KeyName: st.KeyName, ValueName: st.ValueName, Body: body, Deps: st.Deps, Values: obj})
+		return nil
+	}
 
 	ctx := make(Context)
 	maps.Copy(ctx, context)
 
-	for v := range channel {
-		helpers.ApplyVariable(ctx, st.ValueName, v.Value)
-		helpers.ApplyVariable(ctx, st.KeyName, v.Key)
+	iterations := 0
+	return helpers.Iterate(obj, func(key, value any) error {
+		if iterations++; e.Limits.LoopIterations > 0 && iterations > e.Limits.LoopIterations {
+			return errors.LimitExceeded(fmt.Sprintf("%d loop iterations", e.Limits.LoopIterations), st.Location())
+		}
+
+		// long loops are where a cancelled execution would keep most of its work
+		if err := e.checkContext(st.Location()); err != nil {
+			return err
+		}
+
+		helpers.ApplyVariable(ctx, st.ValueName, value)
+		helpers.ApplyVariable(ctx, st.KeyName, key)
 
 		for _, p := range st.Body {
 			if err := e.evaluateProgram(p, ctx); err != nil {
 				return err
 			}
 		}
-	}
 
-	return nil
+		return nil
+	})
 }
 
+// Slot is a placeholder for content passed to a component, with Children as its fallback. Inside the component
+// it may expose Props to the content, which the content passed by the caller binds with Let.
 type Slot struct {
 	Name     string
+	Props    []*Prop
+	Let      []string
 	Children []Statement
+	Position helpers.Location
 }
 
 func (s *Slot) Kind() string {
@@ -225,12 +275,70 @@ func (s *Slot) Kind() string {
 }
 
 func (s *Slot) Location() helpers.Location {
-	panic("unreachable")
+	return s.Position
 }
 
+// Dependencies are empty, as the slot folds its fallback content on its own during the static evaluation.
+func (s *Slot) Dependencies() []string {
+	return nil
+}
+
+// Evaluate renders the content passed to the slot by the caller of the dynamic component being evaluated,
+// or the fallback content. Slots of components included statically are replaced by the preprocessor.
+func (s *Slot) Evaluate(e *Evaluator, context Context) error {
+	if e.staticMode {
+		children, err := e.fold(s.Children, context)
+		if err != nil {
+			return err
+		}
+		e.staticOutput.Push(&Slot{Name: s.Name, Props: s.Props, Let: s.Let, Children: children, Position: s.Position})
+		return nil
+	}
+
+	if len(e.components) == 0 {
+		return e.evaluateBlock(s.Children, context)
+	}
+
+	frame := e.components[len(e.components)-1]
+	children, ok := frame.component.Defines[s.Name]
+	if !ok {
+		return e.evaluateBlock(s.Children, context)
+	}
+
+	ctx := make(Context, len(frame.caller)+len(s.Props))
+	maps.Copy(ctx, frame.caller)
+	for _, name := range frame.component.Lets[s.Name] {
+		index := slices.IndexFunc(s.Props, func(prop *Prop) bool { return prop.Name == name })
+		if index == -1 {
+			return e.error(fmt.Sprintf("slot `%s` of component `%s` doesn't expose `%s`", s.Name, frame.name, name), frame.component.Position)
+		}
+
+		value, err := s.Props[index].evaluate(e, context)
+		if err != nil {
+			return err
+		}
+		ctx[name] = value
+	}
+
+	// the content belongs to the caller, so it's evaluated as if the component wasn't there
+	callers, components := slices.Clone(e.callers[frame.callers:]), slices.Clone(e.components[len(e.components)-1:])
+	e.callers, e.components = e.callers[:frame.callers], e.components[:len(e.components)-1]
+	defer func() {
+		e.callers, e.components = append(e.callers, callers...), append(e.components, components...)
+	}()
+
+	return e.evaluateBlock(children, ctx)
+}
+
+// Component includes another file, it's resolved by the preprocessor.
 type Component struct {
 	Name    string
+	Props   []*Prop
 	Defines map[string][]Statement
+
+	// Lets are the names bound by the content of the slots, see Slot.Let
+	Lets     map[string][]string
+	Position helpers.Location
 }
 
 func (t *Component) Kind() string {
@@ -238,5 +346,477 @@ func (t *Component) Kind() string {
 }
 
 func (t *Component) Location() helpers.Location {
-	panic("unreachable")
+	return t.Position
+}
+
+// DynamicComponent includes the component named by the result of Is, which is looked up when it's evaluated.
+type DynamicComponent struct {
+	Is       *expression.VM
+	Props    []*Prop
+	Defines  map[string][]Statement
+	Lets     map[string][]string
+	Position helpers.Location
+}
+
+func (c *DynamicComponent) Kind() string {
+	return "dynamic component"
+}
+
+func (c *DynamicComponent) Location() helpers.Location {
+	return c.Position
+}
+
+// Dependencies are empty, as the component folds the content of its slots on its own during the static evaluation.
+func (c *DynamicComponent) Dependencies() []string {
+	return nil
+}
+
+// maxComponentDepth bounds the nesting of dynamic components without Limits.ComponentDepth, which would
+// otherwise overflow the stack of a component including itself.
+const maxComponentDepth = 100
+
+func (c *DynamicComponent) Evaluate(e *Evaluator, context Context) error {
+	if e.staticMode {
+		component := *c
+		component.Defines = make(map[string][]Statement, len(c.Defines))
+		for name, children := range c.Defines {
+			// values bound from the slots are known at runtime only
+			ctx := maps.Clone(context)
+			for _, let := range c.Lets[name] {
+				delete(ctx, let)
+			}
+
+			var err error
+			if component.Defines[name], err = e.fold(children, ctx); err != nil {
+				return err
+			}
+		}
+		e.staticOutput.Push(&component)
+		return nil
+	}
+
+	result, err := e.run(c.Is, context)
+	if err != nil {
+		return err
+	}
+
+	name, ok := result.(string)
+	if !ok {
+		return e.error(fmt.Sprintf("expected component name <string>, got <%T>", result), c.Is.Location())
+	}
+
+	if e.Components == nil {
+		return e.error("dynamic components aren't available", c.Position)
+	}
+
+	statements, err := e.Components(name)
+	if err != nil {
+		return errors.Wrap(err, c.Is.Location())
+	}
+
+	if limit := e.Limits.ComponentDepth; limit > 0 && len(e.components) >= limit {
+		return errors.LimitExceeded(fmt.Sprintf("%d nested components", limit), c.Position)
+	} else if len(e.components) >= maxComponentDepth {
+		return errors.LimitExceeded(fmt.Sprintf("%d nested components", maxComponentDepth), c.Position)
+	}
+
+	e.components = append(e.components, &componentFrame{component: c, name: name, caller: context, callers: len(e.callers)})
+	defer func() {
+		e.components = e.components[:len(e.components)-1]
+	}()
+
+	scope := &Scope{Props: c.Props, Children: statements, Position: c.Position}
+	// the props the component declares are taken from the passed ones, rather than the context
+	if len(statements) == 1 {
+		if root, ok := statements[0].(*Scope); ok && root.Root {
+			scope.Declarations, scope.Children = root.Declarations, root.Children
+		}
+	}
+	return scope.Evaluate(e, context)
+}
+
+// componentFrame is a dynamic component being evaluated, named name, with the context of its caller
+// and the number of callers of the components around it.
+type componentFrame struct {
+	component *DynamicComponent
+	name      string
+	caller    Context
+	callers   int
+}
+
+// Extends makes the file a copy of the layout Name, with the blocks overridden by Blocks.
+// It's resolved by the preprocessor.
+type Extends struct {
+	Name     string
+	Blocks   []*Block
+	Position helpers.Location
+}
+
+func (t *Extends) Kind() string {
+	return "extends"
+}
+
+func (t *Extends) Location() helpers.Location {
+	return t.Position
+}
+
+// Block is a named part of a layout which can be overridden by the templates extending it.
+type Block struct {
+	Name     string
+	Children []Statement
+	Position helpers.Location
+}
+
+func (b *Block) Kind() string {
+	return "block"
+}
+
+func (b *Block) Location() helpers.Location {
+	return b.Position
+}
+
+// Super stands for the content of the overridden block inside the block overriding it.
+type Super struct {
+	Position helpers.Location
+}
+
+func (s *Super) Kind() string {
+	return "super"
+}
+
+func (s *Super) Location() helpers.Location {
+	return s.Position
+}
+
+// Macro is a fragment defined by `v-define`, which is inlined by the preprocessor wherever it's used.
+type Macro struct {
+	Name     string
+	Params   []string
+	Children []Statement
+	Position helpers.Location
+}
+
+func (m *Macro) Kind() string {
+	return "macro"
+}
+
+func (m *Macro) Location() helpers.Location {
+	return m.Position
+}
+
+// Use calls the macro Name with Args, it's resolved by the preprocessor.
+type Use struct {
+	Name     string
+	Args     []*Prop
+	Position helpers.Location
+}
+
+func (u *Use) Kind() string {
+	return "use"
+}
+
+func (u *Use) Location() helpers.Location {
+	return u.Position
+}
+
+// Import makes the macros defined in the file From available, it's resolved by the preprocessor.
+type Import struct {
+	From     string
+	Position helpers.Location
+}
+
+func (i *Import) Kind() string {
+	return "import"
+}
+
+func (i *Import) Location() helpers.Location {
+	return i.Position
+}
+
+// ---------------------- Component Props ----------------------
+
+// Prop is a value passed to a component, either an expression or the plain text of an attribute.
+type Prop struct {
+	Name     string
+	Value    *expression.VM
+	Text     string
+	Deps     helpers.Set[string]
+	Position helpers.Location
+}
+
+func (p *Prop) evaluate(e *Evaluator, context Context) (any, error) {
+	if p.Value == nil {
+		return p.Text, nil
+	}
+	return e.run(p.Value, context)
+}
+
+// PropDeclaration declares a prop of a component, which is either required or falls back to Default,
+// or to nil without one.
+type PropDeclaration struct {
+	Name     string
+	Required bool
+	Default  *Prop
+	Position helpers.Location
+}
+
+// Props declares the props of the file, it's resolved by the preprocessor into a Scope.
+type Props struct {
+	Declarations []*PropDeclaration
+	Position     helpers.Location
+}
+
+func (p *Props) Kind() string {
+	return "props"
+}
+
+func (p *Props) Location() helpers.Location {
+	return p.Position
+}
+
+// Scope evaluates the content of a component with its props. Props are evaluated in the context of the caller,
+// declared props missing from them are set to their defaults.
+type Scope struct {
+	Props        []*Prop
+	Declarations []*PropDeclaration
+	Children     []Statement
+	Position     helpers.Location
+
+	// Macro marks scopes of macro calls, which aren't components, so caller scopes inside them
+	// still refer to the caller of the enclosing component
+	Macro bool
+
+	// Root marks the scope of a file executed on its own, which takes its props from the context
+	Root bool
+}
+
+func (s *Scope) Kind() string {
+	return "scope"
+}
+
+func (s *Scope) Location() helpers.Location {
+	return s.Position
+}
+
+// Dependencies are empty, as the scope folds its children on its own during the static evaluation.
+func (s *Scope) Dependencies() []string {
+	return nil
+}
+
+func (s *Scope) Evaluate(e *Evaluator, context Context) error {
+	ctx := make(Context, len(context)+len(s.Props))
+	maps.Copy(ctx, context)
+
+	if !s.Macro {
+		e.callers = append(e.callers, context)
+		defer func() {
+			e.callers = e.callers[:len(e.callers)-1]
+		}()
+	}
+
+	if e.staticMode {
+		children, inlined, err := s.inline(e, context)
+		if err != nil {
+			return err
+		}
+
+		// the scope is left out if nothing is left for the runtime
+		if inlined && onlyText(children) {
+			for _, child := range children {
+				e.staticOutput.Push(child)
+			}
+			return nil
+		}
+
+		if !inlined {
+			// props are known at runtime only, so they mustn't be mistaken for values of the static context
+			for _, prop := range s.Props {
+				delete(ctx, prop.Name)
+			}
+			for _, declaration := range s.Declarations {
+				delete(ctx, declaration.Name)
+			}
+
+			if children, err = e.fold(s.Children, ctx); err != nil {
+				return err
+			}
+		}
+		e.staticOutput.Push(&Scope{Props: s.Props, Declarations: s.Declarations, Children: children, Position: s.Position, Macro: s.Macro, Root: s.Root})
+		return nil
+	}
+
+	passed := make(map[string]bool, len(s.Props))
+	for _, prop := range s.Props {
+		value, err := prop.evaluate(e, context)
+		if err != nil {
+			return err
+		}
+		ctx[prop.Name] = value
+		passed[prop.Name] = true
+	}
+
+	// props of components are passed explicitly, so values of the caller of the same name don't count
+	for _, declaration := range s.Declarations {
+		if _, ok := context[declaration.Name]; passed[declaration.Name] || s.Root && ok {
+			continue
+		}
+
+		if declaration.Required {
+			return e.error(fmt.Sprintf("missing required prop `%s`", declaration.Name), declaration.Position)
+		}
+
+		var value any
+		if declaration.Default != nil {
+			var err error
+			if value, err = declaration.Default.evaluate(e, ctx); err != nil {
+				return err
+			}
+		}
+		ctx[declaration.Name] = value
+	}
+
+	return e.evaluateBlock(s.Children, ctx)
+}
+
+// inline folds the children with the values of the props if all of them are known statically.
+// It reports false if they aren't, leaving the children to be folded without them.
+func (s *Scope) inline(e *Evaluator, context Context) ([]Statement, bool, error) {
+	if len(s.Props) == 0 || len(s.Declarations) > 0 {
+		return nil, false, nil
+	}
+
+	available := availableInContext(context)
+	for _, prop := range s.Props {
+		if prop.Value != nil && !helpers.IsSubset(prop.Deps, available) {
+			return nil, false, nil
+		}
+	}
+
+	ctx := make(Context, len(context)+len(s.Props))
+	maps.Copy(ctx, context)
+	for _, prop := range s.Props {
+		value, err := prop.evaluate(e, context)
+		if err != nil {
+			return nil, false, err
+		}
+		ctx[prop.Name] = value
+	}
+
+	children, err := e.fold(s.Children, ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	return children, true, nil
+}
+
+// CallerScope evaluates content passed to a component, e.g. the content of its slots, in the context
+// of the caller of the innermost Scope, so that the props of the component don't leak into it.
+// Bindings are the props exposed by a scoped slot, evaluated in the context of the component.
+type CallerScope struct {
+	Bindings []*Prop
+	Children []Statement
+	Position helpers.Location
+}
+
+func (s *CallerScope) Kind() string {
+	return "caller scope"
+}
+
+func (s *CallerScope) Location() helpers.Location {
+	return s.Position
+}
+
+func (s *CallerScope) Dependencies() []string {
+	return nil
+}
+
+func (s *CallerScope) Evaluate(e *Evaluator, context Context) error {
+	if len(e.callers) == 0 {
+		return e.error("unexpected caller scope outside of a component", s.Position)
+	}
+
+	// the content may include components itself, whose caller scopes refer to the scopes outside of this one
+	caller := e.callers[len(e.callers)-1]
+	e.callers = e.callers[:len(e.callers)-1]
+	defer func() {
+		e.callers = append(e.callers, caller)
+	}()
+
+	ctx := make(Context, len(caller)+len(s.Bindings))
+	maps.Copy(ctx, caller)
+
+	if e.staticMode {
+		// bindings are known at runtime only, same as props
+		for _, binding := range s.Bindings {
+			delete(ctx, binding.Name)
+		}
+
+		children, err := e.fold(s.Children, ctx)
+		if err != nil {
+			return err
+		}
+		e.staticOutput.Push(&CallerScope{Bindings: s.Bindings, Children: children, Position: s.Position})
+		return nil
+	}
+
+	for _, binding := range s.Bindings {
+		value, err := binding.evaluate(e, context)
+		if err != nil {
+			return err
+		}
+		ctx[binding.Name] = value
+	}
+
+	return e.evaluateBlock(s.Children, ctx)
+}
+
+// onlyText reports whether all the statements are text.
+func onlyText(statements []Statement) bool {
+	for _, statement := range statements {
+		if _, ok := statement.(*Text); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// hasBindings reports whether any of the statements binds values of the enclosing context at runtime, e.g. props
+// of components or values exposed by slots, which must be evaluated together with the loops providing the values.
+func hasBindings(statements []Statement) bool {
+	for _, statement := range statements {
+		var children []Statement
+		switch st := statement.(type) {
+		case *DynamicComponent:
+			return true
+		case *Slot:
+			if len(st.Props) > 0 {
+				return true
+			}
+			children = st.Children
+		case *CallerScope:
+			if len(st.Bindings) > 0 {
+				return true
+			}
+			children = st.Children
+		case *Scope:
+			if len(st.Props) > 0 {
+				return true
+			}
+			children = st.Children
+		case *ForStatement:
+			children = st.Body
+		case *IfStatement:
+			children = slices.Clone(st.Consequence)
+			for _, branch := range st.Alternatives {
+				children = append(children, branch.Consequence...)
+			}
+			children = append(children, st.Divergent...)
+		}
+
+		if hasBindings(children) {
+			return true
+		}
+	}
+
+	return false
 }
@@ -2,23 +2,88 @@ package socks
 
 import (
 	"bytes"
+	"context"
+	stderrors "errors"
 	"fmt"
+	"github.com/terawatthour/socks/errors"
+	"github.com/terawatthour/socks/expression"
 	"github.com/terawatthour/socks/internal/helpers"
 	"github.com/terawatthour/socks/runtime"
 	"io"
+	"io/fs"
 	"maps"
+	"net/http"
+	"slices"
 	"strings"
+	"time"
 )
 
 type Socks struct {
-	fs       *fileSystem
-	globals  map[string]any
-	options  *Options
-	compiled bool
+	fs        *fileSystem
+	globals   map[string]any
+	functions map[string]any
+	options   *Options
+	compiled  bool
 }
 
 type Options struct {
 	Sanitizer func(string) string
+
+	// Repanic lets panics raised while executing templates propagate to the caller, instead of
+	// returning them as errors. Meant for debugging, as the stack trace of the panic is kept.
+	Repanic bool
+
+	// Watch configures Socks.Watch, defaults are used if it's nil.
+	Watch *WatchOptions
+
+	// RequestGlobals returns values available to templates rendered by Socks.Render for the request,
+	// e.g. the request itself, a CSRF token or the locale.
+	RequestGlobals func(r *http.Request) map[string]any
+
+	// FlushThreshold makes Socks.Stream flush the output automatically once that many bytes were
+	// rendered since the last flush, in addition to `<v-flush/>` elements. Zero disables it.
+	FlushThreshold int
+
+	// OnStreamError is called by Socks.Stream with errors that occur after the first flush,
+	// when the status code was already sent and the response can't be replaced anymore.
+	OnStreamError func(r *http.Request, err error)
+
+	// Limits bound the resources used by every execution, e.g. of templates edited by untrusted users.
+	Limits *Limits
+
+	// Sandbox restricts which fields and methods expressions can reach, e.g. in templates edited by
+	// untrusted users. Nil leaves all exported fields and methods accessible.
+	Sandbox *Sandbox
+
+	// TaggedFields makes expressions name struct fields by their `socks` tags, falling back to their `json`
+	// tags, e.g. `user.created_at` for a field tagged `json:"created_at"`. Fields without tags keep their
+	// Go names and fields tagged with "-" aren't accessible.
+	TaggedFields bool
+
+	// DynamicComponents restricts the templates included by `<v-component :is="...">` to the ones matching
+	// the pattern, e.g. "widgets/*.html". Patterns use the fs.Glob syntax with the addition of `**`, which
+	// matches any number of directories. Any compiled template can be included if it's empty.
+	DynamicComponents string
+}
+
+// Sandbox restricts the reflection access of expressions, see expression.Sandbox.
+type Sandbox = expression.Sandbox
+
+// Limits bound the resources a single execution may use, see runtime.Limits.
+type Limits = runtime.Limits
+
+type WatchOptions struct {
+	// Interval between two checks for modified templates, defaults to 500ms.
+	Interval time.Duration
+
+	// OnReload is called with the changed files after they and their dependents are recompiled.
+	OnReload func(files []string)
+
+	// OnError is called when some of the changed files can't be read or recompiled, in which case
+	// the other ones are reloaded regardless. The last successfully compiled version of the failed
+	// templates keeps being served, and they're compiled again together with the next changed files.
+	// Removed files stop being watched.
+	OnError func(err error)
 }
 
 func New(options ...*Options) *Socks {
@@ -31,9 +96,10 @@ func New(options ...*Options) *Socks {
 	}
 
 	return &Socks{
-		fs:      newFileSystem(opts),
-		globals: make(map[string]any),
-		options: opts,
+		fs:        newFileSystem(opts),
+		globals:   make(map[string]any),
+		functions: make(map[string]any),
+		options:   opts,
 	}
 }
 
@@ -46,13 +112,25 @@ func (s *Socks) LoadTemplates(glob ...string) error {
 	return nil
 }
 
+// LoadTemplatesFS loads all files of fsys matching the provided patterns. Patterns use the
+// fs.Glob syntax, with the addition of `**`, which matches any number of directories.
+// Templates are keyed by their slash-separated path inside fsys, e.g. "templates/header.html".
+func (s *Socks) LoadTemplatesFS(fsys fs.FS, patterns ...string) error {
+	s.compiled = false
+	if err := s.fs.loadTemplatesFS(fsys, patterns...); err != nil {
+		return err
+	}
+
+	return nil
+}
+
 func (s *Socks) LoadTemplate(filename string, reader io.ReadCloser) {
 	s.compiled = false
 	s.fs.loadTemplate(filename, reader)
 }
 
 func (s *Socks) Compile(staticContext map[string]any) error {
-	if err := s.fs.preprocessTemplates(helpers.Combine(s.globals, staticContext)); err != nil {
+	if err := s.fs.preprocessTemplates(s.staticEnvironment(staticContext)); err != nil {
 		return err
 	}
 
@@ -60,26 +138,70 @@ func (s *Socks) Compile(staticContext map[string]any) error {
 	return nil
 }
 
-func (s *Socks) ExecuteToString(template string, context map[string]any) (string, error) {
-	eval, err := s.resolveTemplate(template)
-	if err != nil {
-		return "", err
+// Recompile reads the provided template files again and recompiles them using the static context of
+// the last Compile call. Only the provided files are parsed and only they and the templates that
+// include them, directly or transitively, are preprocessed again, everything else is reused.
+// Paths are resolved the same way as template names in Execute.
+func (s *Socks) Recompile(paths ...string) error {
+	if !s.compiled {
+		return fmt.Errorf("templates not compiled")
 	}
 
+	resolved := make([]string, len(paths))
+	for i, path := range paths {
+		key, err := resolveName(path, helpers.Keys(s.fs.sources))
+		if err != nil {
+			return err
+		}
+		resolved[i] = key
+	}
+
+	return s.fs.recompilePaths(resolved...)
+}
+
+func (s *Socks) ExecuteToString(template string, data map[string]any) (string, error) {
 	result := bytes.NewBufferString("")
-	if err := eval.Evaluate(result, helpers.Combine(s.globals, context)); err != nil {
+	if err := s.ExecuteContext(context.Background(), result, template, data); err != nil {
 		return "", err
 	}
 	return result.String(), nil
 }
 
-func (s *Socks) Execute(w io.Writer, template string, context map[string]any) error {
+func (s *Socks) Execute(w io.Writer, template string, data map[string]any) error {
+	return s.ExecuteContext(context.Background(), w, template, data)
+}
+
+// ExecuteContext executes template like Execute, but stops once ctx is done, e.g. when the client of an HTTP
+// request goes away. Loops and conditions check ctx before every step, and the returned error wraps ctx.Err()
+// located where the execution stopped. ctx is passed to registered functions taking a context.Context.
+func (s *Socks) ExecuteContext(ctx context.Context, w io.Writer, template string, data map[string]any) error {
 	eval, err := s.resolveTemplate(template)
 	if err != nil {
 		return err
 	}
 
-	return eval.Evaluate(w, helpers.Combine(s.globals, context))
+	if err := eval.EvaluateContext(ctx, w, s.environment(data)); err != nil {
+		return s.annotateError(err, template, data)
+	}
+	return nil
+}
+
+// annotateError fills in the details of the execution of template into located errors.
+func (s *Socks) annotateError(err error, template string, context map[string]any) error {
+	var located *errors.Error
+	if !stderrors.As(err, &located) {
+		return err
+	}
+
+	if key, err := resolveName(template, helpers.Keys(s.fs.allTemplates())); err == nil {
+		template = key
+	}
+	located.Template = template
+	located.Components = s.fs.componentChain(template, located.Location.File)
+	located.ContextKeys = helpers.Keys(context)
+	slices.Sort(located.ContextKeys)
+
+	return err
 }
 
 func (s *Socks) resolveTemplate(template string) (*runtime.Evaluator, error) {
@@ -87,25 +209,126 @@ func (s *Socks) resolveTemplate(template string) (*runtime.Evaluator, error) {
 		return nil, fmt.Errorf("templates not compiled")
 	}
 
-	if eval, ok := s.fs.templates[template]; ok {
+	if eval, ok := s.fs.template(template); ok {
 		return eval, nil
 	}
 
-	var matching *runtime.Evaluator
-	for key, eval := range s.fs.templates {
-		if key == template || strings.HasSuffix(key, "/"+template) {
-			if matching != nil {
-				return nil, fmt.Errorf(`reference "%s" is ambiguous as it matches multiple templates`, template)
+	templates := s.fs.allTemplates()
+	key, err := resolveName(template, helpers.Keys(templates))
+	if err != nil {
+		return nil, err
+	}
+
+	return templates[key], nil
+}
+
+// FormatError renders err with an excerpt of the template it points at, see errors.Error.Format.
+// Errors which aren't *errors.Error are returned as they are printed.
+func (s *Socks) FormatError(err error, style errors.Style) string {
+	var located *errors.Error
+	if !stderrors.As(err, &located) {
+		return err.Error()
+	}
+
+	return located.Format(s.fs.sourceContents(located.Template == ""), style)
+}
+
+// resolveName finds the key referenced by name, which is either the key itself or its unambiguous suffix.
+func resolveName(name string, keys []string) (string, error) {
+	matching := ""
+	for _, key := range keys {
+		if key == name {
+			return key, nil
+		}
+		if strings.HasSuffix(key, "/"+name) {
+			if matching != "" {
+				return "", fmt.Errorf(`reference "%s" is ambiguous as it matches multiple templates`, name)
 			}
-			matching = eval
+			matching = key
 		}
 	}
 
-	if matching != nil {
+	if matching != "" {
 		return matching, nil
 	}
 
-	return nil, fmt.Errorf("template `%s` not found", template)
+	return "", fmt.Errorf("template `%s` not found", name)
+}
+
+// Watch polls all loaded template files and globs for changes until ctx is done. A changed file
+// is recompiled together with every template that includes it, using the static context of
+// the last Compile call, and the results are swapped in atomically. Newly created files matching
+// a loaded glob are picked up as well. Watch must not run concurrently with loading or compiling.
+func (s *Socks) Watch(ctx context.Context) error {
+	if !s.compiled {
+		return fmt.Errorf("templates not compiled")
+	}
+
+	opts := s.options.Watch
+	if opts == nil {
+		opts = &WatchOptions{}
+	}
+
+	interval := opts.Interval
+	if interval <= 0 {
+		interval = 500 * time.Millisecond
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+
+		// files that failed are reported, the other ones are reloaded regardless
+		changed, err := s.fs.reload()
+		if err != nil && opts.OnError != nil {
+			opts.OnError(err)
+		}
+
+		if len(changed) > 0 && opts.OnReload != nil {
+			opts.OnReload(changed)
+		}
+	}
+}
+
+// RegisterFunction makes fn callable from templates under the provided name. Its signature is inspected
+// right away: fn may take a leading context.Context and be variadic, and may return at most one value
+// followed by an optional error. Calls with the wrong number or types of arguments fail the execution
+// with an error pointing at the call, same as a non-nil returned error. Registered functions are
+// available during compilation, so calls with static arguments are evaluated only once, unless fn takes
+// a context.Context, which it receives from ExecuteContext.
+// Globals and the context take precedence over functions of the same name.
+func (s *Socks) RegisterFunction(name string, fn any) error {
+	function, err := expression.NewFunction(name, fn)
+	if err != nil {
+		return err
+	}
+
+	s.functions[name] = function
+	return nil
+}
+
+// environment combines the registered functions, the globals and the provided context, in order of precedence.
+func (s *Socks) environment(context map[string]any) map[string]any {
+	return helpers.Combine(helpers.Combine(s.functions, s.globals), context)
+}
+
+// staticEnvironment is the environment of compilation. Functions taking a context.Context are left out,
+// as their results depend on the context of the execution, so calls to them are never evaluated statically.
+func (s *Socks) staticEnvironment(staticContext map[string]any) map[string]any {
+	functions := make(map[string]any, len(s.functions))
+	for name, fn := range s.functions {
+		if !fn.(*expression.Function).TakesContext() {
+			functions[name] = fn
+		}
+	}
+
+	return helpers.Combine(helpers.Combine(functions, s.globals), staticContext)
 }
 
 func (s *Socks) AddGlobal(key string, value any) {
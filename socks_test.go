@@ -1,8 +1,20 @@
 package socks
 
 import (
+	"bytes"
+	"context"
+	stderrors "errors"
 	"fmt"
+	"github.com/terawatthour/socks/errors"
+	"github.com/terawatthour/socks/runtime"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"testing/fstest"
+	"time"
 )
 
 func TestBasicEvaluation(t *testing.T) {
@@ -63,3 +75,798 @@ func TestBasicEvaluation(t *testing.T) {
 
 	fmt.Println(res)
 }
+
+func TestLoadTemplatesFS(t *testing.T) {
+	fsys := fstest.MapFS{
+		"layouts/base.html":      {Data: []byte(`<main><v-slot name="content"></v-slot></main>`)},
+		"pages/index.html":       {Data: []byte(`<v-component name="../layouts/base.html"><p :slot="content">{{ greeting }}</p></v-component>`)},
+		"pages/nested/deep.html": {Data: []byte(`<span>deep</span>`)},
+		"pages/notes.txt":        {Data: []byte(`not a template`)},
+	}
+
+	s := New()
+	if err := s.LoadTemplatesFS(fsys, "**/*.html"); err != nil {
+		t.Errorf("unexpected error: %s", err)
+		return
+	}
+
+	if err := s.Compile(nil); err != nil {
+		t.Errorf("unexpected error: %s", err)
+		return
+	}
+
+	for _, key := range []string{"layouts/base.html", "pages/index.html", "pages/nested/deep.html"} {
+		if _, ok := s.fs.templates[key]; !ok {
+			t.Errorf("expected template %s to be loaded", key)
+		}
+	}
+	if _, ok := s.fs.templates["pages/notes.txt"]; ok {
+		t.Errorf("expected pages/notes.txt not to be loaded")
+	}
+
+	res, err := s.ExecuteToString("index.html", map[string]any{"greeting": "Hello"})
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+		return
+	}
+
+	expected := `<main ><p >Hello</p></main>`
+	if res != expected {
+		t.Errorf("expected `%s`, got `%s`", expected, res)
+	}
+}
+
+func TestConcurrentExecution(t *testing.T) {
+	s := New()
+	s.LoadTemplate("list.html", io.NopCloser(strings.NewReader(`<ul><li :for="item, i in items" :class="i % 2 == 0 ? 'even' : 'odd'">{{ prefix + item }}</li></ul>`)))
+	if err := s.Compile(nil); err != nil {
+		t.Errorf("unexpected error: %s", err)
+		return
+	}
+
+	const goroutines = 500
+
+	var wg sync.WaitGroup
+	errs := make(chan error, goroutines)
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+
+			prefix := fmt.Sprintf("%d-", g)
+			res, err := s.ExecuteToString("list.html", map[string]any{
+				"items":  []string{"a", "b", "c"},
+				"prefix": prefix,
+			})
+			if err != nil {
+				errs <- err
+				return
+			}
+
+			expected := fmt.Sprintf(`<ul ><li class="even" >%[1]sa</li><li class="odd" >%[1]sb</li><li class="even" >%[1]sc</li></ul>`, prefix)
+			if res != expected {
+				errs <- fmt.Errorf("expected `%s`, got `%s`", expected, res)
+			}
+		}(g)
+	}
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	dir := t.TempDir()
+	// files are replaced at once, so that a check can't see the content without the modification time
+	write := func(name, content string, modTime time.Time) {
+		temp := filepath.Join(dir, name+".tmp")
+		if err := os.WriteFile(temp, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(temp, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(temp, filepath.Join(dir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	start := time.Now().Add(-time.Hour)
+	write("layout.html", `<main><v-slot name="content"></v-slot></main>`, start)
+	write("page.html", `<v-component name="layout.html"><p :slot="content">page</p></v-component>`, start)
+	write("note.txt", `note`, start)
+
+	reloaded := make(chan []string, 1)
+	failed := make(chan error, 1)
+	s := New(&Options{Watch: &WatchOptions{
+		Interval: 5 * time.Millisecond,
+		OnReload: func(files []string) { reloaded <- files },
+		OnError:  func(err error) { failed <- err },
+	}})
+	if err := s.LoadTemplates(filepath.Join(dir, "*.html"), filepath.Join(dir, "*.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Compile(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Watch(ctx)
+
+	expectPage := func(expected string) {
+		t.Helper()
+		res, err := s.ExecuteToString("page.html", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res != expected {
+			t.Errorf("expected `%s`, got `%s`", expected, res)
+		}
+	}
+
+	write("layout.html", `<article><v-slot name="content"></v-slot></article>`, start.Add(time.Minute))
+	select {
+	case files := <-reloaded:
+		if len(files) != 1 || !strings.HasSuffix(files[0], "layout.html") {
+			t.Errorf("expected only layout.html to change, got %v", files)
+		}
+	case err := <-failed:
+		t.Fatal(err)
+	case <-time.After(time.Second):
+		t.Fatal("templates were not reloaded")
+	}
+	expectPage(`<article ><p >page</p></article>`)
+
+	write("layout.html", `<article><v-slot></v-slot></article>`, start.Add(2*time.Minute))
+	select {
+	case <-reloaded:
+		t.Fatal("expected the reload to fail")
+	case <-failed:
+	case <-time.After(time.Second):
+		t.Fatal("templates were not reloaded")
+	}
+	expectPage(`<article ><p >page</p></article>`)
+
+	// removed files, and globs left without matches, don't keep the other files from reloading
+	if err := os.Remove(filepath.Join(dir, "note.txt")); err != nil {
+		t.Fatal(err)
+	}
+	write("layout.html", `<section><v-slot name="content"></v-slot></section>`, start.Add(3*time.Minute))
+	select {
+	case files := <-reloaded:
+		if len(files) != 1 || !strings.HasSuffix(files[0], "layout.html") {
+			t.Errorf("expected only layout.html to change, got %v", files)
+		}
+	case err := <-failed:
+		t.Fatal(err)
+	case <-time.After(time.Second):
+		t.Fatal("templates were not reloaded")
+	}
+	expectPage(`<section ><p >page</p></section>`)
+}
+
+func TestReloadBatch(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string, modTime time.Time) {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	start := time.Now().Add(-time.Hour)
+	write("layout.html", `<main><v-slot name="content"></v-slot></main>`, start)
+	write("page.html", `<v-component name="layout.html"><p :slot="content">page</p></v-component>`, start)
+	write("other.html", `<p>other</p>`, start)
+
+	s := New()
+	if err := s.LoadTemplates(filepath.Join(dir, "*.html")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Compile(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	expect := func(template, expected string) {
+		t.Helper()
+		res, err := s.ExecuteToString(template, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res != expected {
+			t.Errorf("expected `%s`, got `%s`", expected, res)
+		}
+	}
+
+	// the broken file doesn't keep the other changed file from reloading
+	write("layout.html", `<article><v-slot name="content"></v-slot></article>`, start.Add(time.Minute))
+	write("other.html", `<p>{{ user.name + }}</p>`, start.Add(time.Minute))
+	files, err := s.fs.reload()
+	if len(files) != 1 || !strings.HasSuffix(files[0], "layout.html") {
+		t.Errorf("expected only layout.html to reload, got %v", files)
+	}
+	if err == nil || !strings.Contains(s.FormatError(err, errors.StylePlain), "<p>{{ user.name + }}</p>") {
+		t.Errorf("expected the error to be reported with the rejected contents, got %v", err)
+	}
+	expect("page.html", `<article ><p >page</p></article>`)
+	expect("other.html", `<p >other</p>`)
+
+	// the failed file is compiled again with the next changed files
+	write("other.html", `<p>{{ "fixed" }}</p>`, start.Add(2*time.Minute))
+	files, err = s.fs.reload()
+	if err != nil || len(files) != 1 || !strings.HasSuffix(files[0], "other.html") {
+		t.Errorf("expected other.html to reload, got %v, %v", files, err)
+	}
+	expect("other.html", `<p >fixed</p>`)
+	if len(s.fs.pending) != 0 || len(s.fs.rejected) != 0 {
+		t.Errorf("expected no files to be left pending, got %v", s.fs.pending)
+	}
+}
+
+func TestRecompile(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("layout.html", `<main><v-slot name="content"></v-slot></main>`)
+	write("card.html", `<div><v-slot name="content"></v-slot></div>`)
+	write("page.html", `<v-component name="layout.html"><v-component name="card.html" :slot="content"><p :slot="content">page</p></v-component></v-component>`)
+	write("other.html", `<v-component name="card.html"><p :slot="content">other</p></v-component>`)
+
+	s := New()
+	if err := s.LoadTemplates(filepath.Join(dir, "*.html")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Compile(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	other, _ := s.resolveTemplate("other.html")
+	card := s.fs.preprocessor.preprocessed[filepath.ToSlash(filepath.Join(dir, "card.html"))]
+
+	write("layout.html", `<article><v-slot name="content"></v-slot></article>`)
+	if err := s.Recompile("layout.html"); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := s.ExecuteToString("page.html", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := `<article ><div ><p >page</p></div></article>`; res != expected {
+		t.Errorf("expected `%s`, got `%s`", expected, res)
+	}
+
+	if recompiled, _ := s.resolveTemplate("other.html"); recompiled != other {
+		t.Errorf("expected other.html not to be recompiled")
+	}
+	if reused := s.fs.preprocessor.preprocessed[filepath.ToSlash(filepath.Join(dir, "card.html"))]; &reused[0] != &card[0] {
+		t.Errorf("expected card.html not to be preprocessed again")
+	}
+
+	write("card.html", `<section><v-slot name="content"></v-slot></section>`)
+	if err := s.Recompile("card.html"); err != nil {
+		t.Fatal(err)
+	}
+	for template, expected := range map[string]string{
+		"page.html":  `<article ><section ><p >page</p></section></article>`,
+		"other.html": `<section ><p >other</p></section>`,
+	} {
+		res, err := s.ExecuteToString(template, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res != expected {
+			t.Errorf("expected `%s`, got `%s`", expected, res)
+		}
+	}
+}
+
+func TestContextualEscaping(t *testing.T) {
+	s := New()
+	s.LoadTemplate("page.html", io.NopCloser(strings.NewReader(`<a :href="url" :title="value">{{ value }}{{ raw(value) }}</a><script>let v = {{ value }};</script><style>p { color: {{ color }}; }</style>`)))
+	if err := s.Compile(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := s.ExecuteToString("page.html", map[string]any{
+		"url":   "javascript:alert(1)",
+		"value": `<i>"hi"</i>`,
+		"color": "red}",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `<a href="#ZgotmplZ" title="&lt;i&gt;&#34;hi&#34;&lt;/i&gt;" >&lt;i&gt;&#34;hi&#34;&lt;/i&gt;<i>"hi"</i></a><script >let v = "\u003ci\u003e\"hi\"\u003c/i\u003e";</script><style >p { color: ZgotmplZ; }</style>`
+	if res != expected {
+		t.Errorf("expected `%s`, got `%s`", expected, res)
+	}
+}
+
+func TestMapLiterals(t *testing.T) {
+	s := New()
+	s.LoadTemplate("page.html", io.NopCloser(strings.NewReader(`<p :for="value, key in { b: Server, a: user.Name }">{{ key }}={{ value }}</p>{{ {server: Server}.server }}`)))
+	s.AddGlobal("Server", "Socks")
+	if err := s.Compile(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := s.fs.preprocessor.preprocessed["page.html"][1].(*runtime.Text); !ok {
+		t.Errorf("expected map literal with static values to be folded")
+	}
+
+	res, err := s.ExecuteToString("page.html", map[string]any{"user": map[string]any{"Name": "Jan"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := `<p >a=Jan</p><p >b=Socks</p>Socks`; res != expected {
+		t.Errorf("expected `%s`, got `%s`", expected, res)
+	}
+}
+
+func TestRegisterFunction(t *testing.T) {
+	s := New()
+	if err := s.RegisterFunction("invalid", func() (int, string) { return 0, "" }); err == nil {
+		t.Errorf("expected error for function with two non-error results")
+	}
+
+	if err := s.RegisterFunction("greet", func(ctx context.Context, greeting string, names ...string) (string, error) {
+		if len(names) == 0 {
+			return "", fmt.Errorf("nobody to greet")
+		}
+		return greeting + " " + strings.Join(names, " and "), nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RegisterFunction("double", func(n int64) float64 { return float64(n) * 2 }); err != nil {
+		t.Fatal(err)
+	}
+
+	s.LoadTemplate("page.html", io.NopCloser(strings.NewReader(`{{ greet("Hi", name, "Ann") }} {{ double(count) }}`)))
+	if err := s.Compile(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := s.ExecuteToString("page.html", map[string]any{"name": "Jan", "count": 21})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "Hi Jan and Ann 42"; res != expected {
+		t.Errorf("expected `%s`, got `%s`", expected, res)
+	}
+
+	s.LoadTemplate("static.html", io.NopCloser(strings.NewReader(`{{ double("2") }}`)))
+	if err := s.Compile(nil); err == nil || err.Error() != "static.html:1:10: argument 1: can't cast string to int64, in `double(\"2\")`" {
+		t.Errorf("expected static call to fail the compilation, got %v", err)
+	}
+
+	// functions taking a context depend on the execution, so they're never called during compilation
+	s.LoadTemplate("static.html", io.NopCloser(strings.NewReader(`{{ greet("Hi") }}`)))
+	if err := s.Compile(nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.ExecuteToString("static.html", nil); err == nil || err.Error() != "static.html:1:9: nobody to greet, in `greet(\"Hi\")`" {
+		t.Errorf("expected call taking a context to fail the execution, got %v", err)
+	}
+
+	// builtins are only resolved when called, so they don't shadow variables of the same name
+	s.LoadTemplate("shadow.html", io.NopCloser(strings.NewReader(`<p :if="title">{{ title }}</p>{{ first ?: "none" }} {{ "x" | upper }}`)))
+	if err := s.Compile(nil); err != nil {
+		t.Fatal(err)
+	}
+	res, err = s.ExecuteToString("shadow.html", map[string]any{"title": nil})
+	if expected := "none X"; err != nil || res != expected {
+		t.Errorf("expected `%s`, got `%s` (%v)", expected, res, err)
+	}
+
+	sets := []struct {
+		template string
+		err      string
+	}{
+		{`{{ greet(hi, 1) }}`, "argument 2: can't cast int to string"},
+		{`{{ double(half, 1) }}`, "wrong number of arguments, expected 1, got 2"},
+		{`{{ greet(hi) }}`, "nobody to greet"},
+		{`{{ double(half) }}`, "argument 1: can't cast float64 to int64"},
+		{`{{ callback(1) }}`, "wrong number of arguments, expected 0, got 1"},
+		{`{{ callback }}`, "can't print function <func() string>"},
+		{`<a :href="callback">x</a>`, "can't print function <func() string>"},
+	}
+
+	for _, set := range sets {
+		s := New()
+		_ = s.RegisterFunction("greet", func(greeting string, names ...string) (string, error) {
+			return "", fmt.Errorf("nobody to greet")
+		})
+		_ = s.RegisterFunction("double", func(n int64) int64 { return n * 2 })
+		s.LoadTemplate("errors.html", io.NopCloser(strings.NewReader(set.template)))
+		if err := s.Compile(nil); err != nil {
+			t.Fatal(err)
+		}
+
+		_, err := s.ExecuteToString("errors.html", map[string]any{"hi": "Hi", "half": 0.5, "callback": func() string { return "" }})
+		located, ok := err.(*errors.Error)
+		if !ok || located.Message != set.err || located.Location.Line != 1 {
+			t.Errorf("expected located error `%s`, got %#v", set.err, err)
+		}
+	}
+}
+
+func TestPanicRecovery(t *testing.T) {
+	template := `<p>{{ items[1] }}</p><p :for="item in items">{{ explode(item) }}</p>`
+
+	s := New()
+	s.LoadTemplate("page.html", io.NopCloser(strings.NewReader(template)))
+	if err := s.Compile(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	context := map[string]any{
+		"items":   []string{"a", "b"},
+		"explode": func(item string) string { panic("exploded on " + item) },
+	}
+
+	_, err := s.ExecuteToString("page.html", context)
+	located, ok := err.(*errors.Error)
+	if !ok || located.Message != "panic: exploded on a" || located.Expression != "explode(item)" || located.Location.Column != 56 {
+		t.Errorf("expected located panic error, got %#v", err)
+	}
+
+	_, err = s.ExecuteToString("page.html", map[string]any{"items": []string{"a"}})
+	if err == nil || err.Error() != "page.html:1:13: index 1 out of range with length 1, in `items[1]`" {
+		t.Errorf("expected located index error, got %#v", err)
+	}
+
+	s = New(&Options{Repanic: true})
+	s.LoadTemplate("page.html", io.NopCloser(strings.NewReader(template)))
+	if err := s.Compile(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		if r := recover(); r != "exploded on a" {
+			t.Errorf("expected the original panic to be raised again, got %v", r)
+		}
+	}()
+	_, _ = s.ExecuteToString("page.html", context)
+	t.Errorf("expected a panic")
+}
+
+func TestErrorLocations(t *testing.T) {
+	sets := []struct {
+		template string
+		err      string
+	}{
+		{"<div>\n  <p>{{ user.name + }}</p>\n</div>", "page.html:2:20: unexpected end of expression"},
+		{"<ul>\n\t<li :for=\"item in items[\">{{ item }}</li>\n</ul>", "page.html:2:26: unexpected end of expression"},
+		{"<a\n   :href=\"link(1 2)\">x</a>", "page.html:2:18: expected `)`"},
+		{"<p>\n{{ unclosed </p>", "page.html:2:1: unclosed expression"},
+		{"<div>\n  <v-component name=\"missing.html\"></v-component>\n</div>", "page.html:2:3: component `missing.html` not found"},
+		{"<div>\n\n<v-slot></v-slot></div>", "page.html:3:1: slot name is required"},
+		{"<div>\n<p :else>x</p></div>", "page.html:2:1: unexpected `:else` outside if statement"},
+		{"<div>\n</span>", "page.html:2:1: unexpected end tag: <div> is closed by </span>"},
+	}
+
+	for _, set := range sets {
+		s := New()
+		s.LoadTemplate("page.html", io.NopCloser(strings.NewReader(set.template)))
+		err := s.Compile(nil)
+		if _, ok := err.(*errors.Error); !ok || err.Error() != set.err {
+			t.Errorf("expected error `%s`, got %v", set.err, err)
+		}
+	}
+}
+
+func TestFormatError(t *testing.T) {
+	s := New()
+	s.LoadTemplate("page.html", io.NopCloser(strings.NewReader("<body>\n  <p>{{ user.name + }}</p>\n</body>")))
+	err := s.Compile(nil)
+	if err == nil {
+		t.Fatal("expected compilation error")
+	}
+
+	expected := "  ┌─ page.html:2:20:\n1 | <body>\n2 |   <p>{{ user.name + }}</p>\n  |                    ^\n3 | </body>\nunexpected end of expression"
+	if formatted := s.FormatError(err, errors.StylePlain); formatted != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, formatted)
+	}
+
+	if formatted := s.FormatError(io.EOF, errors.StylePlain); formatted != "EOF" {
+		t.Errorf("expected errors without location to be printed as they are, got %s", formatted)
+	}
+}
+
+func TestExecuteContext(t *testing.T) {
+	type key struct{}
+
+	s := New()
+	if err := s.RegisterFunction("requestID", func(ctx context.Context) string {
+		return ctx.Value(key{}).(string)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	s.LoadTemplate("page.html", io.NopCloser(strings.NewReader("<p>{{ requestID() }}</p>\n<p :for=\"item in items\">{{ visit(item) }}</p>")))
+	if err := s.Compile(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), key{}, "abc"))
+	defer cancel()
+
+	var visited []int
+	var output strings.Builder
+	err := s.ExecuteContext(ctx, &output, "page.html", map[string]any{
+		"items": []int{1, 2, 3},
+		"visit": func(item int) int {
+			visited = append(visited, item)
+			if item == 2 {
+				cancel()
+			}
+			return item
+		},
+	})
+
+	if !stderrors.Is(err, context.Canceled) {
+		t.Fatalf("expected the execution to be cancelled, got %v", err)
+	}
+	if located, ok := err.(*errors.Error); !ok || located.Location.Line != 2 || located.Location.Column != 18 {
+		t.Errorf("expected the error to be located at the loop, got %#v", err)
+	}
+	if len(visited) != 2 {
+		t.Errorf("expected the loop to stop after the cancellation, visited %v", visited)
+	}
+	if !strings.HasPrefix(output.String(), "<p >abc</p>") {
+		t.Errorf("expected the context to be passed to functions, got %s", output.String())
+	}
+}
+
+func TestLimits(t *testing.T) {
+	sets := []struct {
+		name     string
+		limits   Limits
+		template string
+		context  map[string]any
+		expected string
+	}{
+		{"instructions", Limits{Instructions: 10}, `{{ 1 + 2 }}<p :for="i in items">{{ i * 2 + 1 }}</p>`, map[string]any{"items": []int{1, 2, 3}}, "page.html:1:42: limit of 10 instructions exceeded, in `i * 2 + 1`"},
+		{"loop iterations", Limits{LoopIterations: 2}, `<p :for="i in items">{{ i }}</p>`, map[string]any{"items": []int{1, 2, 3}}, "page.html:1:15: limit of 2 loop iterations exceeded"},
+		{"range length", Limits{LoopIterations: 10}, `<p :for="i in range(0, n, 1)">{{ i }}</p>`, map[string]any{"n": 30000000}, "page.html:1:20: limit of 10 loop iterations exceeded, in `range(0, n, 1)`"},
+		{"output bytes", Limits{OutputBytes: 12}, `<p :for="i in items">{{ i }}</p>`, map[string]any{"items": []int{1, 2, 3}}, "page.html:1:1: limit of 12 bytes of output exceeded"},
+		{"timeout", Limits{Timeout: 10 * time.Millisecond}, `<p :for="i in items">{{ wait() }}</p>`, map[string]any{"items": []int{1, 2, 3}, "wait": func() string { time.Sleep(20 * time.Millisecond); return "" }}, "page.html:1:15: limit of 10ms of rendering time exceeded"},
+		{"within limits", Limits{Instructions: 100, LoopIterations: 3, OutputBytes: 100, Timeout: time.Second}, `<p :for="i in items">{{ i }}</p>`, map[string]any{"items": []int{1, 2, 3}}, ""},
+	}
+
+	for _, set := range sets {
+		t.Run(set.name, func(t *testing.T) {
+			s := New(&Options{Limits: &set.limits})
+			s.LoadTemplate("page.html", io.NopCloser(strings.NewReader(set.template)))
+			if err := s.Compile(nil); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err := s.ExecuteToString("page.html", set.context)
+			if set.expected == "" {
+				if err != nil {
+					t.Errorf("expected no error, got %v", err)
+				}
+				return
+			}
+
+			if err == nil || err.Error() != set.expected || !stderrors.Is(err, errors.ErrLimitExceeded) {
+				t.Errorf("expected %s, got %v", set.expected, err)
+			}
+		})
+	}
+
+	// static templates are folded during the compilation, within the same limits
+	staticSets := []struct {
+		name     string
+		limits   Limits
+		template string
+		expected string
+	}{
+		{"loop iterations", Limits{LoopIterations: 10}, `<p :for="i in items">{{ i }}</p>`, "page.html:1:15: limit of 10 loop iterations exceeded"},
+		{"range length", Limits{LoopIterations: 10}, `<p :for="i in range(0, 30000000, 1)">{{ i }}</p>`, "page.html:1:20: limit of 10 loop iterations exceeded, in `range(0, 30000000, 1)`"},
+		{"instructions", Limits{Instructions: 10}, `<p :for="i in items">{{ i * 2 + 1 }}</p>`, "page.html:1:31: limit of 10 instructions exceeded, in `i * 2 + 1`"},
+		{"output bytes", Limits{OutputBytes: 12}, `<p :for="i in items">{{ i }}</p>`, "page.html:1:1: limit of 12 bytes of output exceeded"},
+	}
+
+	for _, set := range staticSets {
+		t.Run("static "+set.name, func(t *testing.T) {
+			s := New(&Options{Limits: &set.limits})
+			s.LoadTemplate("page.html", io.NopCloser(strings.NewReader(set.template)))
+			err := s.Compile(map[string]any{"items": make([]int, 100)})
+			if err == nil || err.Error() != set.expected || !stderrors.Is(err, errors.ErrLimitExceeded) {
+				t.Errorf("expected %s, got %v", set.expected, err)
+			}
+		})
+	}
+
+	s := New(&Options{Limits: &Limits{ComponentDepth: 1}})
+	s.LoadTemplate("page.html", io.NopCloser(strings.NewReader(`<v-component name="card.html"></v-component>`)))
+	s.LoadTemplate("card.html", io.NopCloser(strings.NewReader(`<div><v-component name="icon.html"></v-component></div>`)))
+	s.LoadTemplate("icon.html", io.NopCloser(strings.NewReader(`<i></i>`)))
+	err := s.Compile(nil)
+	if expected := "page.html:1:1: limit of 1 nested components exceeded"; err == nil || err.Error() != expected {
+		t.Errorf("expected %s, got %v", expected, err)
+	}
+}
+
+type sandboxedAccount struct {
+	Name string
+}
+
+func (a *sandboxedAccount) Delete() string {
+	return "deleted"
+}
+
+func TestStaticLoops(t *testing.T) {
+	compile := func(staticContext map[string]any) *Socks {
+		t.Helper()
+		s := New()
+		s.LoadTemplate("item.html", io.NopCloser(strings.NewReader(`<v-props><v-prop name="item" required/></v-props><b>{{ item }}{{ suffix }}</b>`)))
+		s.LoadTemplate("wrap.html", io.NopCloser(strings.NewReader(`<v-props><v-prop name="v"/></v-props><v-slot name="s" :w="v + '?'"></v-slot>`)))
+		s.LoadTemplate("page.html", io.NopCloser(strings.NewReader(`<li :for="x, i in List"><v-component name="item.html" :item="x"></v-component><v-component name="wrap.html" :v="x"><template :slot="s" :let="w">{{ w }}{{ i }}</template></v-component></li>`)))
+		if err := s.Compile(staticContext); err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	// the loops are left for the runtime, as their bodies bind the loop variables, while their iterables are static
+	s := compile(map[string]any{"List": []string{"a", "b"}})
+
+	var cache bytes.Buffer
+	if err := s.SaveCompiled(&cache); err != nil {
+		t.Fatal(err)
+	}
+	loaded := New()
+	if err := loaded.LoadCompiled(&cache); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `<li ><b >a!</b>a?0</li><li ><b >b!</b>b?1</li>`
+	for _, s := range []*Socks{s, loaded} {
+		res, err := s.ExecuteToString("page.html", map[string]any{"suffix": "!"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res != expected {
+			t.Errorf("expected `%s`, got `%s`", expected, res)
+		}
+	}
+
+	// values which couldn't be restored as they were aren't written to the cache
+	type Item struct{ Name string }
+	s = compile(map[string]any{"List": []Item{{"a"}}})
+	if err := s.SaveCompiled(&cache); err == nil || !strings.Contains(err.Error(), "can't encode value of type socks.Item") {
+		t.Errorf("expected encoding error, got %v", err)
+	}
+}
+
+func TestSandbox(t *testing.T) {
+	s := New(&Options{Sandbox: &Sandbox{}})
+	s.LoadTemplate("page.html", io.NopCloser(strings.NewReader(`{{ account.Name }}`)))
+	s.LoadTemplate("static.html", io.NopCloser(strings.NewReader(`{{ admin.Delete() }}`)))
+	err := s.Compile(map[string]any{"admin": &sandboxedAccount{Name: "root"}})
+	if expected := "static.html:1:10: call of method `Delete` of *socks.sandboxedAccount is forbidden, in `admin.Delete()`"; err == nil || err.Error() != expected {
+		t.Errorf("expected the sandbox to apply to static evaluation, got %v", err)
+	}
+
+	// a failed compilation consumes the loaded templates
+	s.LoadTemplate("page.html", io.NopCloser(strings.NewReader(`{{ account.Name }}`)))
+	s.LoadTemplate("static.html", io.NopCloser(strings.NewReader(`{{ account.Delete() }}`)))
+	if err := s.Compile(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	context := map[string]any{"account": &sandboxedAccount{Name: "Ann"}}
+	if res, err := s.ExecuteToString("page.html", context); err != nil || res != "Ann" {
+		t.Errorf("expected fields to be accessible, got %s, %v", res, err)
+	}
+	if _, err := s.ExecuteToString("static.html", context); err == nil {
+		t.Error("expected the method call to be forbidden")
+	}
+
+	// printed values can't reveal hidden fields, or call methods that aren't allow-listed
+	type credentials struct {
+		Name     string
+		Password string `socks:"-"`
+	}
+	s = New(&Options{Sandbox: &Sandbox{}})
+	s.LoadTemplate("struct.html", io.NopCloser(strings.NewReader(`{{ p }}`)))
+	s.LoadTemplate("attribute.html", io.NopCloser(strings.NewReader(`<a :title="p"></a>`)))
+	s.LoadTemplate("stringer.html", io.NopCloser(strings.NewReader(`{{ since }}`)))
+	if err := s.Compile(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	context = map[string]any{"p": credentials{Name: "Ann", Password: "hunter2"}, "since": time.Second}
+	sets := []struct {
+		filename string
+		expected string
+	}{
+		{"struct.html", "struct.html:1:4: access to field `Password` of socks.credentials is forbidden, in `p`"},
+		{"attribute.html", "attribute.html:1:12: access to field `Password` of socks.credentials is forbidden, in `p`"},
+		{"stringer.html", "stringer.html:1:4: call of method `String` of time.Duration is forbidden, in `since`"},
+	}
+	for _, set := range sets {
+		if _, err := s.ExecuteToString(set.filename, context); err == nil || err.Error() != set.expected {
+			t.Errorf("expected %s, got %v", set.expected, err)
+		}
+	}
+}
+
+func TestTaggedFields(t *testing.T) {
+	type user struct {
+		FirstName string `json:"first_name"`
+		Email     string `socks:"email" json:"-"`
+	}
+
+	s := New(&Options{TaggedFields: true})
+	s.LoadTemplate("page.html", io.NopCloser(strings.NewReader(`{{ user.first_name }} {{ user["email"] }} {{ static.first_name }}`)))
+	if err := s.Compile(map[string]any{"static": user{FirstName: "Jan"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := s.ExecuteToString("page.html", map[string]any{"user": &user{FirstName: "Ann", Email: "ann@example.com"}})
+	if expected := "Ann ann@example.com Jan"; err != nil || res != expected {
+		t.Errorf("expected `%s`, got `%s`, %v", expected, res, err)
+	}
+}
+
+func TestDynamicComponents(t *testing.T) {
+	s := New(&Options{DynamicComponents: "widgets/*.html"})
+	s.LoadTemplate("widgets/chart.html", io.NopCloser(strings.NewReader(`<v-props><v-prop name="title" required/></v-props><figure>{{ title }}<v-slot name="caption" :size="2">none</v-slot></figure>`)))
+	s.LoadTemplate("widgets/text.html", io.NopCloser(strings.NewReader(`<p>{{ body }}</p>`)))
+	s.LoadTemplate("admin.html", io.NopCloser(strings.NewReader(`<p>secret</p>`)))
+	s.LoadTemplate("page.html", io.NopCloser(strings.NewReader(`<v-component :for="w in widgets" :is="w.Template" :title="w.Title" :body="w.Title"><template :slot="caption" :let="size">{{ label }} {{ size }}</template></v-component>`)))
+	if err := s.Compile(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	type widget struct{ Template, Title any }
+	sets := []struct {
+		widgets  []widget
+		expected string
+		err      string
+	}{
+		{[]widget{{"widgets/chart.html", "Sales"}, {"text.html", "Hi"}}, `<figure >SalesL 2</figure><p >Hi</p>`, ""},
+		{[]widget{{"missing.html", ""}}, "", "page.html:1:39: template `missing.html` not found"},
+		{[]widget{{"admin.html", ""}}, "", "page.html:1:39: component `admin.html` isn't allowed to be included dynamically"},
+		{[]widget{{1, ""}}, "", "page.html:1:39: expected component name <string>, got <int>"},
+	}
+
+	for _, set := range sets {
+		res, err := s.ExecuteToString("page.html", map[string]any{"widgets": set.widgets, "label": "L"})
+		if set.err != "" {
+			if err == nil || err.Error() != set.err {
+				t.Errorf("expected error %q, got %v", set.err, err)
+			}
+			continue
+		}
+
+		if err != nil || res != set.expected {
+			t.Errorf("expected `%s`, got `%s`, %v", set.expected, res, err)
+		}
+	}
+
+	// props are passed explicitly, values of the caller of the same name don't count
+	s.LoadTemplate("untitled.html", io.NopCloser(strings.NewReader(`<v-component :is="name"></v-component>`)))
+	if err := s.Compile(nil); err != nil {
+		t.Fatal(err)
+	}
+	_, err := s.ExecuteToString("untitled.html", map[string]any{"name": "widgets/chart.html", "title": "outer"})
+	if expected := "widgets/chart.html:1:10: missing required prop `title`"; err == nil || err.Error() != expected {
+		t.Errorf("expected %s, got %v", expected, err)
+	}
+}
@@ -0,0 +1,189 @@
+// Package sockshttp serves templates of Socks over HTTP and reports their errors, either with
+// a debug page in development or with an error template in production.
+package sockshttp
+
+import (
+	"bytes"
+	stderrors "errors"
+	"github.com/terawatthour/socks"
+	"github.com/terawatthour/socks/errors"
+	"html/template"
+	"net/http"
+)
+
+// HandlerFunc is an http.HandlerFunc which returns the error of rendering its response.
+type HandlerFunc func(w http.ResponseWriter, r *http.Request) error
+
+type Options struct {
+	// Development makes failed requests respond with a debug page, showing the excerpt of the template,
+	// the failing expression, the chain of included components and the keys of the context.
+	Development bool
+
+	// ErrorTemplate is rendered through Socks for failed requests outside of development, with
+	// the context keys "Status" and "StatusText". A plain text error is sent if it's empty or fails.
+	ErrorTemplate string
+
+	// OnError is called with every error returned by a handler, e.g. to log it.
+	OnError func(r *http.Request, err error)
+}
+
+// Handler wraps h, responding with an error page when it returns an error. The response of h is buffered
+// until it returns, so that a half-rendered page can be replaced. Once h flushes a part of the response,
+// errors are only passed to OnError, as the response can't be replaced anymore.
+func Handler(s *socks.Socks, options *Options, h HandlerFunc) http.Handler {
+	if options == nil {
+		options = &Options{}
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rw := &responseWriter{ResponseWriter: w}
+		err := h(rw, r)
+		if err == nil {
+			rw.commit()
+			return
+		}
+
+		if options.OnError != nil {
+			options.OnError(r, err)
+		}
+
+		if rw.committed {
+			return
+		}
+
+		if options.Development {
+			writeDebugPage(w, s, err)
+			return
+		}
+
+		writeErrorPage(w, s, options.ErrorTemplate, http.StatusInternalServerError)
+	})
+}
+
+// responseWriter buffers the response until it's committed, either when the handler
+// returns successfully or when it flushes.
+type responseWriter struct {
+	http.ResponseWriter
+	status    int
+	buffer    bytes.Buffer
+	committed bool
+}
+
+func (rw *responseWriter) WriteHeader(status int) {
+	if rw.committed {
+		rw.ResponseWriter.WriteHeader(status)
+		return
+	}
+	if rw.status == 0 {
+		rw.status = status
+	}
+}
+
+func (rw *responseWriter) Write(p []byte) (int, error) {
+	if rw.committed {
+		return rw.ResponseWriter.Write(p)
+	}
+	return rw.buffer.Write(p)
+}
+
+func (rw *responseWriter) Flush() {
+	rw.commit()
+	if flusher, ok := rw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// commit sends the buffered status and body, further writes go straight to the underlying writer.
+func (rw *responseWriter) commit() {
+	if rw.committed {
+		return
+	}
+	rw.committed = true
+
+	if rw.status != 0 {
+		rw.ResponseWriter.WriteHeader(rw.status)
+	}
+	if rw.buffer.Len() > 0 {
+		_, _ = rw.ResponseWriter.Write(rw.buffer.Bytes())
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+func writeErrorPage(w http.ResponseWriter, s *socks.Socks, errorTemplate string, status int) {
+	if errorTemplate != "" {
+		page, err := s.ExecuteToString(errorTemplate, map[string]any{
+			"Status":     status,
+			"StatusText": http.StatusText(status),
+		})
+		if err == nil {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.WriteHeader(status)
+			_, _ = w.Write([]byte(page))
+			return
+		}
+	}
+
+	http.Error(w, http.StatusText(status), status)
+}
+
+var debugPage = template.Must(template.New("debug").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{ .Title }}</title>
+<style>
+body { font-family: system-ui, sans-serif; margin: 2rem; color: #222; }
+h1 { font-size: 1.4rem; color: #b00020; }
+h2 { font-size: 1rem; margin-top: 1.5rem; }
+pre, code { font-family: ui-monospace, monospace; }
+.socks-error { background: #f6f6f6; padding: 1rem; overflow-x: auto; }
+.socks-error-gutter { color: #3060c0; }
+.socks-error-underline { color: #b00020; font-weight: bold; }
+.socks-error-message { font-weight: bold; }
+.socks-error-note { color: #777; }
+</style>
+</head>
+<body>
+<h1>{{ .Title }}</h1>
+{{ .Report }}
+{{ with .Error }}
+{{ if .Expression }}<h2>Expression</h2>
+<pre>{{ .Expression }}</pre>{{ end }}
+{{ if .Components }}<h2>Components</h2>
+<ol>{{ range .Components }}<li><code>{{ . }}</code></li>{{ end }}</ol>{{ end }}
+<h2>Context</h2>
+{{ if .ContextKeys }}<ul>{{ range .ContextKeys }}<li><code>{{ . }}</code></li>{{ end }}</ul>{{ else }}<p>The context is empty.</p>{{ end }}
+{{ end }}
+</body>
+</html>
+`))
+
+func writeDebugPage(w http.ResponseWriter, s *socks.Socks, err error) {
+	data := struct {
+		Title  string
+		Report template.HTML
+		Error  *errors.Error
+	}{
+		Title: "Internal Server Error",
+		// FormatError escapes the report itself
+		Report: template.HTML(s.FormatError(err, errors.StyleHTML)),
+	}
+
+	var located *errors.Error
+	if stderrors.As(err, &located) {
+		data.Error = located
+		if located.Template != "" {
+			data.Title = "Error in " + located.Template
+		}
+	} else {
+		data.Report = template.HTML("<pre class=\"socks-error\">" + template.HTMLEscapeString(err.Error()) + "</pre>")
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusInternalServerError)
+	_ = debugPage.Execute(w, data)
+}
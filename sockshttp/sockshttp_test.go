@@ -0,0 +1,132 @@
+package sockshttp
+
+import (
+	"github.com/terawatthour/socks"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func newSocks(t *testing.T) *socks.Socks {
+	t.Helper()
+
+	s := socks.New()
+	if err := s.LoadTemplatesFS(fstest.MapFS{
+		"page.html":  {Data: []byte(`<main><v-component name="card.html"></v-component></main>`)},
+		"card.html":  {Data: []byte("<div>\n  {{ user.name.first }}\n</div>")},
+		"error.html": {Data: []byte(`<h1>{{ Status }} {{ StatusText }}</h1>`)},
+	}, "*.html"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Compile(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	return s
+}
+
+func TestHandler(t *testing.T) {
+	s := newSocks(t)
+
+	render := func(w http.ResponseWriter, r *http.Request) error {
+		return s.Execute(w, "page.html", map[string]any{"user": map[string]any{}, "title": "Home"})
+	}
+
+	tests := []struct {
+		name     string
+		options  *Options
+		handler  HandlerFunc
+		status   int
+		contains []string
+		excludes []string
+	}{
+		{
+			name:    "development",
+			options: &Options{Development: true},
+			handler: render,
+			status:  http.StatusInternalServerError,
+			contains: []string{
+				"Error in page.html",
+				`<span class="socks-error-code">  {{ user.name.first }}</span>`,
+				"<pre>user.name.first</pre>",
+				"<li><code>page.html</code></li><li><code>card.html</code></li>",
+				"<li><code>title</code></li><li><code>user</code></li>",
+			},
+		},
+		{
+			name:     "production",
+			options:  &Options{ErrorTemplate: "error.html"},
+			handler:  render,
+			status:   http.StatusInternalServerError,
+			contains: []string{"500 Internal Server Error</h1>"},
+			excludes: []string{"user.name.first"},
+		},
+		{
+			name:     "production without error template",
+			options:  nil,
+			handler:  render,
+			status:   http.StatusInternalServerError,
+			contains: []string{"Internal Server Error"},
+			excludes: []string{"user.name.first"},
+		},
+		{
+			name:    "success",
+			options: &Options{Development: true},
+			handler: func(w http.ResponseWriter, r *http.Request) error {
+				return s.Execute(w, "error.html", map[string]any{"Status": 200, "StatusText": "OK"})
+			},
+			status:   http.StatusOK,
+			contains: []string{"200 OK</h1>"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			Handler(s, test.options, test.handler).ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+
+			if recorder.Code != test.status {
+				t.Errorf("expected status %d, got %d", test.status, recorder.Code)
+			}
+			body := recorder.Body.String()
+			for _, expected := range test.contains {
+				if !strings.Contains(body, expected) {
+					t.Errorf("expected body to contain %q, got\n%s", expected, body)
+				}
+			}
+			for _, unexpected := range test.excludes {
+				if strings.Contains(body, unexpected) {
+					t.Errorf("expected body not to contain %q, got\n%s", unexpected, body)
+				}
+			}
+		})
+	}
+}
+
+func TestHandlerAfterWrite(t *testing.T) {
+	s := newSocks(t)
+
+	var reported error
+	handler := Handler(s, &Options{
+		Development: true,
+		OnError: func(r *http.Request, err error) {
+			reported = err
+		},
+	}, func(w http.ResponseWriter, r *http.Request) error {
+		_, _ = w.Write([]byte("partial"))
+		w.(http.Flusher).Flush()
+		return s.Execute(w, "page.html", nil)
+	})
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+
+	if reported == nil {
+		t.Error("expected the error to be reported")
+	}
+	if body := recorder.Body.String(); !strings.HasPrefix(body, "partial") || strings.Contains(body, "Internal Server Error") {
+		t.Errorf("expected the written response to be kept, got %s", body)
+	}
+}